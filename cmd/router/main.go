@@ -1,19 +1,31 @@
 package main
 
 import (
+	"context"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"magicrouter/core"
 	"magicrouter/inmem"
 	"magicrouter/openai"
+	"magicrouter/redis"
 	"magicrouter/server"
+	"magicrouter/webhook"
 
+	goredis "github.com/redis/go-redis/v9"
 	"github.com/rs/zerolog/log"
 )
 
 func main() {
-	tokenStore := inmem.TokenStore{"test": "project1"}
+	tokenStore := inmem.TokenStore{
+		"test": &core.Token{
+			ID:        "token1",
+			ProjectID: "project1",
+		},
+	}
 	projectStore := inmem.ProjectStore{
 		"project1": &core.ProjectConfig{
 			ID: "project1",
@@ -31,9 +43,91 @@ func main() {
 	services := core.ChatServices{
 		"openai": openai.NewChatService(http.DefaultClient),
 	}
-	svr := server.New(tokenStore, services, projectStore)
-	err := svr.ListenAndServe()
+	pricing, err := loadPricing(os.Getenv("PRICING_FILE"))
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to load pricing catalog")
+	}
+	if pricing == nil {
+		log.Warn().Msg("no pricing catalog, costs are recorded as zero")
+	}
+	opts := []server.Option{
+		server.WithPricing(pricing),
+		server.WithShadowing(core.NewShadower(services, core.RedactingSink{Sink: core.ZerologSink{}}, pricing, 10)),
+		server.WithTLS(os.Getenv("TLS_CERT_FILE"), os.Getenv("TLS_KEY_FILE")),
+	}
+	if addr := os.Getenv("ADDR"); addr != "" {
+		opts = append(opts, server.WithAddr(addr))
+	}
+
+	// Breakers of provider keys, a key is skipped for a minute after 5 consecutive failures.
+	breakerConfig := core.BreakerConfig{MaxFailures: 5, ResetTimeout: time.Minute}
+	// Jobs and their results are kept for a week after their last update.
+	const jobTTL = 7 * 24 * time.Hour
+	var (
+		budgetStore  core.BudgetStore      = inmem.NewBudgetStore()
+		latencyStore core.LatencyStore     = inmem.NewLatencyStore(0.2)
+		flightStore  core.FlightStore      = inmem.NewFlightStore()
+		idempotency  core.IdempotencyStore = inmem.NewIdempotencyStore()
+		templates    core.TemplateStore    = inmem.NewTemplateStore()
+		keyStore     core.KeyStore         = inmem.NewKeyStore()
+		breaker      core.BreakerService   = inmem.NewBreakerService(breakerConfig)
+		rateLimits   core.RateLimitStore   = inmem.NewRateLimitStore()
+		jobs         core.JobQueue         = inmem.NewJobQueue(1000, jobTTL)
+	)
+	if addr := os.Getenv("REDIS_ADDR"); addr != "" {
+		client := goredis.NewClient(&goredis.Options{Addr: addr})
+		redisBudgets := redis.NewBudgetStore(client)
+		budgetStore = redisBudgets
+		latencyStore = redis.NewLatencyStore(client, 0.2, time.Hour)
+		flightStore = redis.NewFlightStore(client)
+		idempotency = redis.NewIdempotencyStore(client)
+		templates = redis.NewTemplateStore(client)
+		keyStore = redis.NewKeyStore(client)
+		breaker = redis.NewBreakerService(client, breakerConfig)
+		rateLimits = redis.NewRateLimitStore(client)
+		jobs = redis.NewJobQueue(client, jobTTL)
+		opts = append(opts, server.WithReadinessCheck("redis", redisBudgets))
+	}
+	opts = append(opts,
+		server.WithBudgets(core.NewBudgetEnforcer(budgetStore, budgetAlerter(os.Getenv("BUDGET_WEBHOOK_URL")))),
+		server.WithLatencyRouting(core.NewLatencyStrategy(latencyStore, core.LatencyConfig{
+			ExplorationRate: 0.05,
+			MinSamples:      5,
+		})),
+		server.WithDeduplication(flightStore),
+		server.WithIdempotency(idempotency, 24*time.Hour),
+		server.WithTemplates(templates),
+		server.WithKeyPool(core.NewKeyPool(keyStore, breaker, core.KeyPoolConfig{})),
+		server.WithRateLimitTracking(rateLimits),
+		server.WithAsyncJobs(jobs, 4),
+		server.WithAdminToken(os.Getenv("ADMIN_TOKEN")),
+	)
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	svr := server.New(tokenStore, services, projectStore, opts...)
+	err = svr.ListenAndServe(ctx)
 	if err != nil {
 		log.Fatal().Err(err).Msg("failed to start server")
 	}
 }
+
+// budgetAlerter posts budget alerts to url, they are only logged if it's empty.
+func budgetAlerter(url string) core.BudgetAlerter {
+	if url == "" {
+		return nil
+	}
+	return webhook.New(&http.Client{Timeout: 10 * time.Second}, url)
+}
+
+func loadPricing(path string) (core.PricingCatalog, error) {
+	if path == "" {
+		return nil, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return core.ReadPricingCatalog(f)
+}
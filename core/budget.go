@@ -0,0 +1,239 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+var ErrBudgetExceeded = errors.New("budget exceeded")
+
+type BudgetPeriod string
+
+const (
+	BudgetPeriodDaily    BudgetPeriod = "daily"
+	BudgetPeriodMonthly  BudgetPeriod = "monthly"
+	BudgetPeriodLifetime BudgetPeriod = "lifetime"
+)
+
+// Budget caps how much a token can spend. All amounts are in USD.
+type Budget struct {
+	// Daily, Monthly and Lifetime are spend limits. Zero means unlimited.
+	Daily    float64 `json:"daily"`
+	Monthly  float64 `json:"monthly"`
+	Lifetime float64 `json:"lifetime"`
+	// SoftLimit is the fraction of a limit (e.g. 0.8) at which a warning is emitted.
+	SoftLimit float64 `json:"soft_limit"`
+	// Timezone is the IANA zone daily and monthly windows reset in. Defaults to UTC.
+	Timezone string `json:"timezone"`
+	// MonthlyResetDay is the day of the month (1-28) the monthly window resets on. Defaults to 1.
+	MonthlyResetDay int `json:"monthly_reset_day"`
+}
+
+// BudgetWindow is the span of time a single spend counter covers.
+type BudgetWindow struct {
+	Period BudgetPeriod
+	Limit  float64
+	// Start is when the window began, counters are keyed by it.
+	Start time.Time
+	// End is when the window resets. Zero for lifetime windows.
+	End time.Time
+}
+
+// Windows returns the windows with a limit that are active at now.
+func (b Budget) Windows(now time.Time) []BudgetWindow {
+	loc, err := time.LoadLocation(b.Timezone)
+	if err != nil {
+		loc = time.UTC
+	}
+	now = now.In(loc)
+
+	var windows []BudgetWindow
+	if b.Daily > 0 {
+		start := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, loc)
+		windows = append(windows, BudgetWindow{
+			Period: BudgetPeriodDaily,
+			Limit:  b.Daily,
+			Start:  start,
+			End:    start.AddDate(0, 0, 1),
+		})
+	}
+	if b.Monthly > 0 {
+		day := b.MonthlyResetDay
+		if day < 1 || day > 28 {
+			day = 1
+		}
+		start := time.Date(now.Year(), now.Month(), day, 0, 0, 0, 0, loc)
+		if now.Before(start) {
+			start = start.AddDate(0, -1, 0)
+		}
+		windows = append(windows, BudgetWindow{
+			Period: BudgetPeriodMonthly,
+			Limit:  b.Monthly,
+			Start:  start,
+			End:    start.AddDate(0, 1, 0),
+		})
+	}
+	if b.Lifetime > 0 {
+		windows = append(windows, BudgetWindow{
+			Period: BudgetPeriodLifetime,
+			Limit:  b.Lifetime,
+		})
+	}
+	return windows
+}
+
+// Spend is the amount spent in each budget period.
+type Spend map[BudgetPeriod]float64
+
+type BudgetStore interface {
+	GetSpend(ctx context.Context, tokenID string, windows []BudgetWindow) (Spend, error)
+	// AddSpend increments every window by amount and returns the new totals.
+	AddSpend(ctx context.Context, tokenID string, amount float64, windows []BudgetWindow) (Spend, error)
+}
+
+type BudgetAlertKind string
+
+const (
+	BudgetAlertSoftLimit BudgetAlertKind = "soft_limit"
+	BudgetAlertExhausted BudgetAlertKind = "exhausted"
+)
+
+type BudgetAlert struct {
+	Kind      BudgetAlertKind `json:"kind"`
+	TokenID   string          `json:"token_id"`
+	ProjectID string          `json:"project_id"`
+	Period    BudgetPeriod    `json:"period"`
+	Limit     float64         `json:"limit"`
+	Spent     float64         `json:"spent"`
+	ResetsAt  *time.Time      `json:"resets_at,omitempty"`
+}
+
+type BudgetAlerter interface {
+	Alert(ctx context.Context, alert BudgetAlert) error
+}
+
+// BudgetEnforcer rejects requests from tokens that have exhausted their budget
+// and records the spend of completed requests.
+type BudgetEnforcer struct {
+	store   BudgetStore
+	alerter BudgetAlerter
+	now     func() time.Time
+	// sending tracks the alerts being sent, they don't hold up requests.
+	sending sync.WaitGroup
+}
+
+// alertTimeout bounds how long sending a single alert can take.
+const alertTimeout = 10 * time.Second
+
+// NewBudgetEnforcer creates a BudgetEnforcer. alerter is optional, alerts are always logged.
+func NewBudgetEnforcer(store BudgetStore, alerter BudgetAlerter) *BudgetEnforcer {
+	return &BudgetEnforcer{
+		store:   store,
+		alerter: alerter,
+		now:     time.Now,
+	}
+}
+
+// Check returns ErrBudgetExceeded if any of the token's budget windows is exhausted.
+func (e *BudgetEnforcer) Check(ctx context.Context, token *Token) error {
+	if token.Budget == nil {
+		return nil
+	}
+	windows := token.Budget.Windows(e.now())
+	if len(windows) == 0 {
+		return nil
+	}
+	spend, err := e.store.GetSpend(ctx, token.ID, windows)
+	if err != nil {
+		return fmt.Errorf("failed to get spend: %w", err)
+	}
+	for _, w := range windows {
+		if spend[w.Period] >= w.Limit {
+			return fmt.Errorf("%w: %s limit of $%.2f reached", ErrBudgetExceeded, w.Period, w.Limit)
+		}
+	}
+	return nil
+}
+
+// Record adds cost to the token's spend and emits alerts for any limits crossed.
+func (e *BudgetEnforcer) Record(ctx context.Context, token *Token, cost float64) error {
+	if token.Budget == nil || cost <= 0 {
+		return nil
+	}
+	windows := token.Budget.Windows(e.now())
+	if len(windows) == 0 {
+		return nil
+	}
+	spend, err := e.store.AddSpend(ctx, token.ID, cost, windows)
+	if err != nil {
+		return fmt.Errorf("failed to add spend: %w", err)
+	}
+
+	for _, w := range windows {
+		spent := spend[w.Period]
+		before := spent - cost
+		alert := BudgetAlert{
+			TokenID:   token.ID,
+			ProjectID: token.ProjectID,
+			Period:    w.Period,
+			Limit:     w.Limit,
+			Spent:     spent,
+		}
+		if !w.End.IsZero() {
+			alert.ResetsAt = &w.End
+		}
+		switch {
+		case before < w.Limit && spent >= w.Limit:
+			alert.Kind = BudgetAlertExhausted
+		case token.Budget.SoftLimit > 0 && before < w.Limit*token.Budget.SoftLimit && spent >= w.Limit*token.Budget.SoftLimit:
+			alert.Kind = BudgetAlertSoftLimit
+		default:
+			continue
+		}
+		e.alert(ctx, alert)
+	}
+	return nil
+}
+
+func (e *BudgetEnforcer) alert(ctx context.Context, alert BudgetAlert) {
+	log.Warn().
+		Str("kind", string(alert.Kind)).
+		Str("token_id", alert.TokenID).
+		Str("project_id", alert.ProjectID).
+		Str("period", string(alert.Period)).
+		Float64("limit", alert.Limit).
+		Float64("spent", alert.Spent).
+		Msg("budget_alert")
+	if e.alerter == nil {
+		return
+	}
+	e.sending.Add(1)
+	go func() {
+		defer e.sending.Done()
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), alertTimeout)
+		defer cancel()
+		if err := e.alerter.Alert(ctx, alert); err != nil {
+			log.Err(err).Msg("failed to send budget alert")
+		}
+	}()
+}
+
+// Wait waits for the alerts being sent until ctx is done.
+func (e *BudgetEnforcer) Wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		e.sending.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
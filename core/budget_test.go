@@ -0,0 +1,108 @@
+package core_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"magicrouter/core"
+	"magicrouter/inmem"
+	"magicrouter/mocks"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestBudget_Windows(t *testing.T) {
+	now := time.Date(2023, time.November, 3, 15, 0, 0, 0, time.UTC)
+
+	t.Run("no limits", func(t *testing.T) {
+		assert.Empty(t, core.Budget{}.Windows(now))
+	})
+
+	t.Run("calendar windows", func(t *testing.T) {
+		windows := core.Budget{Daily: 1, Monthly: 10, Lifetime: 100}.Windows(now)
+		assert.Equal(t, []core.BudgetWindow{
+			{
+				Period: core.BudgetPeriodDaily,
+				Limit:  1,
+				Start:  time.Date(2023, time.November, 3, 0, 0, 0, 0, time.UTC),
+				End:    time.Date(2023, time.November, 4, 0, 0, 0, 0, time.UTC),
+			},
+			{
+				Period: core.BudgetPeriodMonthly,
+				Limit:  10,
+				Start:  time.Date(2023, time.November, 1, 0, 0, 0, 0, time.UTC),
+				End:    time.Date(2023, time.December, 1, 0, 0, 0, 0, time.UTC),
+			},
+			{
+				Period: core.BudgetPeriodLifetime,
+				Limit:  100,
+			},
+		}, windows)
+	})
+
+	t.Run("monthly reset day before today", func(t *testing.T) {
+		windows := core.Budget{Monthly: 10, MonthlyResetDay: 15}.Windows(now)
+		assert.Equal(t, time.Date(2023, time.October, 15, 0, 0, 0, 0, time.UTC), windows[0].Start)
+		assert.Equal(t, time.Date(2023, time.November, 15, 0, 0, 0, 0, time.UTC), windows[0].End)
+	})
+
+	t.Run("timezone", func(t *testing.T) {
+		windows := core.Budget{Daily: 1, Timezone: "Asia/Tokyo"}.Windows(now)
+		// 15:00 UTC is already the next day in Tokyo.
+		assert.Equal(t, time.Date(2023, time.November, 3, 15, 0, 0, 0, time.UTC), windows[0].Start.UTC())
+	})
+}
+
+func TestBudgetEnforcer(t *testing.T) {
+	token := &core.Token{
+		ID:        "token1",
+		ProjectID: "project1",
+		Budget:    &core.Budget{Daily: 1, SoftLimit: 0.5},
+	}
+	ctx := context.Background()
+
+	t.Run("no budget", func(t *testing.T) {
+		enforcer := core.NewBudgetEnforcer(inmem.NewBudgetStore(), nil)
+		token := &core.Token{ID: "token1"}
+		assert.NoError(t, enforcer.Record(ctx, token, 100))
+		assert.NoError(t, enforcer.Check(ctx, token))
+	})
+
+	t.Run("soft limit then exhausted", func(t *testing.T) {
+		alerter := mocks.NewBudgetAlerter(t)
+		alerter.On("Alert", mock.Anything, mock.MatchedBy(func(a core.BudgetAlert) bool {
+			return a.Kind == core.BudgetAlertSoftLimit && a.Period == core.BudgetPeriodDaily
+		})).Return(nil).Once()
+		alerter.On("Alert", mock.Anything, mock.MatchedBy(func(a core.BudgetAlert) bool {
+			return a.Kind == core.BudgetAlertExhausted && a.Period == core.BudgetPeriodDaily
+		})).Return(nil).Once()
+		enforcer := core.NewBudgetEnforcer(inmem.NewBudgetStore(), alerter)
+
+		assert.NoError(t, enforcer.Record(ctx, token, 0.3))
+		assert.NoError(t, enforcer.Check(ctx, token))
+		// Crosses the soft limit
+		assert.NoError(t, enforcer.Record(ctx, token, 0.3))
+		assert.NoError(t, enforcer.Check(ctx, token))
+		// Crosses the hard limit
+		assert.NoError(t, enforcer.Record(ctx, token, 0.5))
+		err := enforcer.Check(ctx, token)
+		assert.True(t, errors.Is(err, core.ErrBudgetExceeded))
+		// Alerts are sent in the background.
+		assert.NoError(t, enforcer.Wait(context.Background()))
+	})
+	t.Run("wait is bounded", func(t *testing.T) {
+		sent := make(chan time.Time)
+		defer close(sent)
+		alerter := mocks.NewBudgetAlerter(t)
+		alerter.On("Alert", mock.Anything, mock.Anything).WaitUntil(sent).Return(nil).Once()
+		enforcer := core.NewBudgetEnforcer(inmem.NewBudgetStore(), alerter)
+
+		assert.NoError(t, enforcer.Record(ctx, token, 0.6))
+		waitCtx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+		defer cancel()
+		assert.ErrorIs(t, enforcer.Wait(waitCtx), context.DeadlineExceeded)
+	})
+}
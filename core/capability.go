@@ -0,0 +1,96 @@
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/tidwall/gjson"
+)
+
+var ErrUnsupportedCapability = errors.New("no route supports the requested capabilities")
+
+// Capability is a feature of the chat completion API that not every model supports.
+type Capability string
+
+const (
+	CapabilityTools      Capability = "tools"
+	CapabilityVision     Capability = "vision"
+	CapabilityJSONMode   Capability = "json_mode"
+	CapabilityJSONSchema Capability = "json_schema"
+	CapabilityLogprobs   Capability = "logprobs"
+	CapabilityStreaming  Capability = "streaming"
+)
+
+// RequiredCapabilities returns the capabilities a route needs to serve req.
+func RequiredCapabilities(req json.RawMessage) []Capability {
+	var caps []Capability
+	if gjson.GetBytes(req, "tools.#").Int() > 0 || gjson.GetBytes(req, "functions.#").Int() > 0 {
+		caps = append(caps, CapabilityTools)
+	}
+	if hasImage(req) {
+		caps = append(caps, CapabilityVision)
+	}
+	switch gjson.GetBytes(req, "response_format.type").String() {
+	case "json_object":
+		caps = append(caps, CapabilityJSONMode)
+	case "json_schema":
+		caps = append(caps, CapabilityJSONSchema)
+	}
+	if gjson.GetBytes(req, "logprobs").Bool() {
+		caps = append(caps, CapabilityLogprobs)
+	}
+	if gjson.GetBytes(req, "stream").Bool() {
+		caps = append(caps, CapabilityStreaming)
+	}
+	return caps
+}
+
+func hasImage(req json.RawMessage) bool {
+	for _, msg := range gjson.GetBytes(req, "messages").Array() {
+		for _, part := range msg.Get("content").Array() {
+			if part.Get("type").String() == "image_url" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Supports reports whether the route supports all of caps.
+// Routes that don't declare their capabilities are assumed to support everything.
+// Routes synthesizing streams support streaming.
+func (r Route) Supports(caps []Capability) bool {
+	if r.Capabilities == nil {
+		return true
+	}
+	for _, c := range caps {
+		if !slices.Contains(r.Capabilities, c) && !(c == CapabilityStreaming && r.SynthesizeStreams) {
+			return false
+		}
+	}
+	return true
+}
+
+// streamsNatively reports whether the provider of the route can stream itself.
+func (r Route) streamsNatively() bool {
+	return r.Capabilities == nil || slices.Contains(r.Capabilities, CapabilityStreaming)
+}
+
+// capable returns the routes supporting caps. It fails with ErrUnsupportedCapability when none do.
+func capable(caps []Capability, routes []Route) ([]Route, error) {
+	if len(caps) == 0 {
+		return routes, nil
+	}
+	supported := make([]Route, 0, len(routes))
+	for _, route := range routes {
+		if route.Supports(caps) {
+			supported = append(supported, route)
+		}
+	}
+	if len(supported) == 0 && len(routes) > 0 {
+		return nil, fmt.Errorf("%w: %v", ErrUnsupportedCapability, caps)
+	}
+	return supported, nil
+}
@@ -0,0 +1,94 @@
+package core_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+
+	"magicrouter/core"
+	"magicrouter/mocks"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestRequiredCapabilities(t *testing.T) {
+	tests := []struct {
+		name string
+		req  string
+		caps []core.Capability
+	}{
+		{
+			name: "plain text",
+			req:  `{"messages": [{"role": "user", "content": "hello"}]}`,
+		},
+		{
+			name: "tools",
+			req:  `{"messages": [], "tools": [{"type": "function", "function": {"name": "f"}}]}`,
+			caps: []core.Capability{core.CapabilityTools},
+		},
+		{
+			name: "vision",
+			req:  `{"messages": [{"role": "user", "content": [{"type": "text", "text": "what's this?"}, {"type": "image_url", "image_url": {"url": "https://example.com/cat.png"}}]}]}`,
+			caps: []core.Capability{core.CapabilityVision},
+		},
+		{
+			name: "json schema, logprobs and streaming",
+			req:  `{"messages": [], "response_format": {"type": "json_schema"}, "logprobs": true, "stream": true}`,
+			caps: []core.Capability{core.CapabilityJSONSchema, core.CapabilityLogprobs, core.CapabilityStreaming},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.caps, core.RequiredCapabilities(json.RawMessage(tt.req)))
+		})
+	}
+}
+
+func TestFallbackChatService_Capabilities(t *testing.T) {
+	req := json.RawMessage(`{"messages": [{"role": "user", "content": [{"type": "image_url", "image_url": {"url": "https://example.com/cat.png"}}]}]}`)
+	routes := []core.Route{
+		{ID: "text", Priority: 1, Provider: "openai", Model: "text", Capabilities: []core.Capability{core.CapabilityTools}},
+		{ID: "vision", Priority: 2, Provider: "openai", Model: "vision", Capabilities: []core.Capability{core.CapabilityVision}},
+	}
+
+	t.Run("falls back onto a capable route only", func(t *testing.T) {
+		mockService := mocks.NewChatService(t)
+		mockService.
+			On("ChatCompletion", mock.Anything, req, "vision", "").
+			Return(nil, core.ErrProviderRateLimited).
+			Once()
+		svc := core.NewFallbackChatService(routes, core.ChatServices{"openai": mockService}, core.NoOpBreaker{},
+			core.WithCapabilities(core.RequiredCapabilities(req)),
+		)
+		_, err := svc.ChatCompletion(context.Background(), req)
+		assert.Equal(t, core.FallbackError{"vision": core.ErrProviderRateLimited}, err)
+	})
+
+	t.Run("no capable route", func(t *testing.T) {
+		mockService := mocks.NewChatService(t)
+		svc := core.NewFallbackChatService(routes[:1], core.ChatServices{"openai": mockService}, core.NoOpBreaker{},
+			core.WithCapabilities(core.RequiredCapabilities(req)),
+		)
+		_, err := svc.ChatCompletion(context.Background(), req)
+		assert.True(t, errors.Is(err, core.ErrUnsupportedCapability))
+	})
+
+	t.Run("undeclared capabilities", func(t *testing.T) {
+		mockService := mocks.NewChatService(t)
+		mockService.
+			On("ChatCompletion", mock.Anything, req, "any", "").
+			Return(&http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil).
+			Once()
+		svc := core.NewFallbackChatService(
+			[]core.Route{{ID: "any", Provider: "openai", Model: "any"}},
+			core.ChatServices{"openai": mockService},
+			core.NoOpBreaker{},
+			core.WithCapabilities(core.RequiredCapabilities(req)),
+		)
+		_, err := svc.ChatCompletion(context.Background(), req)
+		assert.NoError(t, err)
+	})
+}
@@ -8,8 +8,9 @@ import (
 )
 
 var (
-	ErrProviderRateLimited = errors.New("provider rate limited")
-	ErrProviderTimeout     = errors.New("provider timeout")
+	ErrProviderRateLimited   = errors.New("provider rate limited")
+	ErrProviderTimeout       = errors.New("provider timeout")
+	ErrContextLengthExceeded = errors.New("context length exceeded")
 )
 
 type ChatService interface {
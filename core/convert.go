@@ -0,0 +1,378 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"magicrouter/sse"
+
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+// callRoute sends req to route with the route's parameter overrides, once the route's
+// concurrency limit admits it. The slot is held until the response body is closed.
+func callRoute(ctx context.Context, svc ChatService, req json.RawMessage, route Route) (*http.Response, error) {
+	if len(route.Params) > 0 {
+		var err error
+		if req, err = overrideParams(req, route.Params); err != nil {
+			return nil, err
+		}
+	}
+	release, err := acquireRoute(ctx, route)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := dispatch(ctx, svc, req, route)
+	if release == nil {
+		return resp, err
+	}
+	if err != nil {
+		release()
+		return nil, err
+	}
+	releaseOnClose(resp, release)
+	return resp, nil
+}
+
+// dispatch sends req to route using the key pool from ctx for routes with several keys.
+// Routes and keys about to be throttled according to the rate limits tracked in ctx are skipped.
+func dispatch(ctx context.Context, svc ChatService, req json.RawMessage, route Route) (*http.Response, error) {
+	limits := rateLimitsFrom(ctx)
+	tokens := 0
+	if limits != nil {
+		tokens = EstimatePromptTokens(req) + MaxOutputTokens(req, 0)
+	}
+	if len(route.Keys) > 0 {
+		return keyPoolFrom(ctx).call(ctx, route, func(key ProviderKey) bool {
+			return limits.throttled(ctx, keyRateLimitID(key.ID), tokens)
+		}, func(route Route, key ProviderKey) (*http.Response, error) {
+			resp, err := sendRoute(ctx, svc, req, route)
+			limits.observe(ctx, keyRateLimitID(key.ID), resp, err)
+			return resp, err
+		})
+	}
+	if limits.throttled(ctx, routeRateLimitID(ctx, route.ID), tokens) {
+		return nil, errAboutToBeThrottled
+	}
+	resp, err := sendRoute(ctx, svc, req, route)
+	limits.observe(ctx, routeRateLimitID(ctx, route.ID), resp, err)
+	return resp, err
+}
+
+// sendRoute sends req to route. Streams are synthesized from a regular response for
+// routes opting into it with SynthesizeStreams, and stream only routes have their
+// stream aggregated into a regular response, so clients get the mode they asked for.
+func sendRoute(ctx context.Context, svc ChatService, req json.RawMessage, route Route) (*http.Response, error) {
+	stream := gjson.GetBytes(req, "stream").Bool()
+	switch {
+	case stream && route.SynthesizeStreams && !route.streamsNatively():
+		includeUsage := gjson.GetBytes(req, "stream_options.include_usage").Bool()
+		req, err := sjson.SetBytes(req, "stream", false)
+		if err != nil {
+			return nil, fmt.Errorf("failed to disable streaming: %w", err)
+		}
+		req, err = sjson.DeleteBytes(req, "stream_options")
+		if err != nil {
+			return nil, fmt.Errorf("failed to remove stream options: %w", err)
+		}
+		resp, err := svc.ChatCompletion(ctx, req, route.Model, route.ProviderToken)
+		if err != nil {
+			return nil, err
+		}
+		return toStream(resp, includeUsage)
+
+	case !stream && route.StreamOnly:
+		req, err := sjson.SetBytes(req, "stream", true)
+		if err != nil {
+			return nil, fmt.Errorf("failed to enable streaming: %w", err)
+		}
+		req, err = sjson.SetBytes(req, "stream_options.include_usage", true)
+		if err != nil {
+			return nil, fmt.Errorf("failed to set stream options: %w", err)
+		}
+		resp, err := svc.ChatCompletion(ctx, req, route.Model, route.ProviderToken)
+		if err != nil {
+			return nil, err
+		}
+		return fromStream(resp)
+	}
+	return svc.ChatCompletion(ctx, req, route.Model, route.ProviderToken)
+}
+
+type completionChunk struct {
+	ID                string          `json:"id"`
+	Object            string          `json:"object"`
+	Created           int64           `json:"created"`
+	Model             string          `json:"model"`
+	SystemFingerprint string          `json:"system_fingerprint,omitempty"`
+	Choices           []chunkChoice   `json:"choices"`
+	Usage             json.RawMessage `json:"usage,omitempty"`
+}
+
+type chunkChoice struct {
+	Index        int64           `json:"index"`
+	Delta        json.RawMessage `json:"delta"`
+	Logprobs     json.RawMessage `json:"logprobs,omitempty"`
+	FinishReason *string         `json:"finish_reason"`
+}
+
+// toStream turns a chat completion response into the event stream the provider would
+// have sent: a chunk with the message and one with the finish reason for each choice,
+// then the usage if includeUsage is set. Unsuccessful responses are returned as is.
+func toStream(resp *http.Response, includeUsage bool) (*http.Response, error) {
+	if resp.StatusCode != http.StatusOK || isEventStream(resp) {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response body: %w", err)
+	}
+	completion := gjson.ParseBytes(body)
+	base := completionChunk{
+		ID:                completion.Get("id").String(),
+		Object:            "chat.completion.chunk",
+		Created:           completion.Get("created").Int(),
+		Model:             completion.Get("model").String(),
+		SystemFingerprint: completion.Get("system_fingerprint").String(),
+	}
+
+	var stream bytes.Buffer
+	write := func(chunk completionChunk) error {
+		data, err := json.Marshal(chunk)
+		if err != nil {
+			return fmt.Errorf("failed to marshal chunk: %w", err)
+		}
+		return sse.WriteEvent(&stream, sse.Event{Data: data})
+	}
+	for _, choice := range completion.Get("choices").Array() {
+		index := choice.Get("index").Int()
+		// Tool call deltas are identified by their index.
+		delta := []byte(choice.Get("message").Raw)
+		for i := range choice.Get("message.tool_calls").Array() {
+			if delta, err = sjson.SetBytes(delta, "tool_calls."+strconv.Itoa(i)+".index", i); err != nil {
+				return nil, fmt.Errorf("failed to set tool call index: %w", err)
+			}
+		}
+		chunk := base
+		chunk.Choices = []chunkChoice{{Index: index, Delta: delta}}
+		if logprobs := choice.Get("logprobs"); logprobs.Exists() && logprobs.Type != gjson.Null {
+			chunk.Choices[0].Logprobs = json.RawMessage(logprobs.Raw)
+		}
+		if err := write(chunk); err != nil {
+			return nil, err
+		}
+		finishReason := choice.Get("finish_reason").String()
+		chunk.Choices = []chunkChoice{{Index: index, Delta: json.RawMessage(`{}`), FinishReason: &finishReason}}
+		if err := write(chunk); err != nil {
+			return nil, err
+		}
+	}
+	if usage := completion.Get("usage"); includeUsage && usage.Exists() {
+		chunk := base
+		chunk.Choices = []chunkChoice{}
+		chunk.Usage = json.RawMessage(usage.Raw)
+		if err := write(chunk); err != nil {
+			return nil, err
+		}
+	}
+	sse.WriteEvent(&stream, sse.Event{Data: sse.Done})
+
+	converted := *resp
+	converted.Header = cloneHeader(resp.Header)
+	converted.Header.Set("Content-Type", "text/event-stream")
+	converted.Header.Del("Content-Length")
+	converted.ContentLength = -1
+	converted.Body = io.NopCloser(&stream)
+	return &converted, nil
+}
+
+type aggregatedCompletion struct {
+	ID                string              `json:"id"`
+	Object            string              `json:"object"`
+	Created           int64               `json:"created"`
+	Model             string              `json:"model"`
+	SystemFingerprint string              `json:"system_fingerprint,omitempty"`
+	Choices           []*aggregatedChoice `json:"choices"`
+	Usage             json.RawMessage     `json:"usage,omitempty"`
+}
+
+type aggregatedChoice struct {
+	Index        int64               `json:"index"`
+	Message      aggregatedMessage   `json:"message"`
+	Logprobs     *aggregatedLogprobs `json:"logprobs"`
+	FinishReason *string             `json:"finish_reason"`
+
+	// The texts are built up here and set in Message once the stream is done.
+	content, refusal       strings.Builder
+	hasContent, hasRefusal bool
+}
+
+type aggregatedMessage struct {
+	Role      string                `json:"role"`
+	Content   *string               `json:"content"`
+	Refusal   *string               `json:"refusal,omitempty"`
+	ToolCalls []*aggregatedToolCall `json:"tool_calls,omitempty"`
+}
+
+type aggregatedLogprobs struct {
+	Content []json.RawMessage `json:"content"`
+}
+
+type aggregatedToolCall struct {
+	ID       string `json:"id"`
+	Type     string `json:"type"`
+	Function struct {
+		Name      string `json:"name"`
+		Arguments string `json:"arguments"`
+	} `json:"function"`
+
+	name, arguments strings.Builder
+}
+
+// maxStreamToolCalls bounds the index of the tool calls of streamed choices, which
+// comes from upstream.
+const maxStreamToolCalls = 128
+
+// fromStream aggregates the chunks of an event stream into a chat completion response.
+// Streams that end before [DONE] are an error. Other responses are returned as is.
+func fromStream(resp *http.Response) (*http.Response, error) {
+	if resp.StatusCode != http.StatusOK || !isEventStream(resp) {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+
+	completion := aggregatedCompletion{Object: "chat.completion"}
+	choices := make(map[int64]*aggregatedChoice)
+	events := sse.NewReader(resp.Body)
+	for {
+		ev, err := events.Next()
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read stream: %w", err)
+		}
+		if bytes.Equal(ev.Data, sse.Done) {
+			break
+		}
+		chunk := gjson.ParseBytes(ev.Data)
+		if completion.ID == "" {
+			completion.ID = chunk.Get("id").String()
+			completion.Created = chunk.Get("created").Int()
+			completion.Model = chunk.Get("model").String()
+		}
+		if fingerprint := chunk.Get("system_fingerprint").String(); fingerprint != "" {
+			completion.SystemFingerprint = fingerprint
+		}
+		if usage := chunk.Get("usage"); usage.IsObject() {
+			completion.Usage = json.RawMessage(usage.Raw)
+		}
+		for _, c := range chunk.Get("choices").Array() {
+			index := c.Get("index").Int()
+			choice, ok := choices[index]
+			if !ok {
+				choice = &aggregatedChoice{Index: index}
+				choices[index] = choice
+			}
+			if err := choice.add(c); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	for _, choice := range choices {
+		choice.finish()
+		completion.Choices = append(completion.Choices, choice)
+	}
+	sort.Slice(completion.Choices, func(i, j int) bool {
+		return completion.Choices[i].Index < completion.Choices[j].Index
+	})
+	body, err := json.Marshal(completion)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal completion: %w", err)
+	}
+
+	converted := *resp
+	converted.Header = cloneHeader(resp.Header)
+	converted.Header.Set("Content-Type", "application/json")
+	converted.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	converted.ContentLength = int64(len(body))
+	converted.Body = io.NopCloser(bytes.NewReader(body))
+	return &converted, nil
+}
+
+// add appends the delta of a stream chunk's choice.
+func (c *aggregatedChoice) add(choice gjson.Result) error {
+	delta := choice.Get("delta")
+	if role := delta.Get("role").String(); role != "" {
+		c.Message.Role = role
+	}
+	if content := delta.Get("content"); content.Type == gjson.String {
+		c.content.WriteString(content.String())
+		c.hasContent = true
+	}
+	if refusal := delta.Get("refusal"); refusal.Type == gjson.String {
+		c.refusal.WriteString(refusal.String())
+		c.hasRefusal = true
+	}
+	for _, tc := range delta.Get("tool_calls").Array() {
+		index := tc.Get("index").Int()
+		if index < 0 || index >= maxStreamToolCalls {
+			return fmt.Errorf("invalid tool call index in stream: %d", index)
+		}
+		for int64(len(c.Message.ToolCalls)) <= index {
+			c.Message.ToolCalls = append(c.Message.ToolCalls, &aggregatedToolCall{})
+		}
+		call := c.Message.ToolCalls[index]
+		if id := tc.Get("id").String(); id != "" {
+			call.ID = id
+		}
+		if typ := tc.Get("type").String(); typ != "" {
+			call.Type = typ
+		}
+		call.name.WriteString(tc.Get("function.name").String())
+		call.arguments.WriteString(tc.Get("function.arguments").String())
+	}
+	for _, lp := range choice.Get("logprobs.content").Array() {
+		if c.Logprobs == nil {
+			c.Logprobs = &aggregatedLogprobs{}
+		}
+		c.Logprobs.Content = append(c.Logprobs.Content, json.RawMessage(lp.Raw))
+	}
+	if reason := choice.Get("finish_reason").String(); reason != "" {
+		c.FinishReason = &reason
+	}
+	return nil
+}
+
+// finish sets the texts of the message once all the deltas were added.
+func (c *aggregatedChoice) finish() {
+	if c.hasContent {
+		content := c.content.String()
+		c.Message.Content = &content
+	}
+	if c.hasRefusal {
+		refusal := c.refusal.String()
+		c.Message.Refusal = &refusal
+	}
+	for _, call := range c.Message.ToolCalls {
+		call.Function.Name = call.name.String()
+		call.Function.Arguments = call.arguments.String()
+	}
+}
+
+func cloneHeader(h http.Header) http.Header {
+	if h == nil {
+		return make(http.Header)
+	}
+	return h.Clone()
+}
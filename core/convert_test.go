@@ -0,0 +1,124 @@
+package core_test
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"testing"
+
+	"magicrouter/core"
+	"magicrouter/mocks"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/tidwall/gjson"
+)
+
+func TestFallbackChatService_SynthesizedStream(t *testing.T) {
+	routes := []core.Route{
+		{ID: "route1", Provider: "openai", Model: "batch", Capabilities: []core.Capability{core.CapabilityTools}, SynthesizeStreams: true},
+	}
+	req := json.RawMessage(`{"stream": true, "stream_options": {"include_usage": true}, "messages": []}`)
+
+	mockService := mocks.NewChatService(t)
+	mockService.On("ChatCompletion", mock.Anything, mock.MatchedBy(func(req json.RawMessage) bool {
+		return !gjson.GetBytes(req, "stream").Bool() && !gjson.GetBytes(req, "stream_options").Exists()
+	}), "batch", "").
+		Return(textResponse(`{
+			"id": "chatcmpl-1", "object": "chat.completion", "created": 1, "model": "batch",
+			"choices": [{"index": 0, "message": {"role": "assistant", "content": null, "tool_calls": [{"id": "call_1", "type": "function", "function": {"name": "f", "arguments": "{}"}}]}, "finish_reason": "tool_calls"}],
+			"usage": {"prompt_tokens": 1, "completion_tokens": 2, "total_tokens": 3}
+		}`), nil)
+
+	svc := core.NewFallbackChatService(routes, core.ChatServices{"openai": mockService}, core.NoOpBreaker{})
+	resp, err := svc.ChatCompletion(context.Background(), req)
+	assert.NoError(t, err)
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	body, err := io.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, `data: {"id":"chatcmpl-1","object":"chat.completion.chunk","created":1,"model":"batch","choices":[{"index":0,"delta":{"role":"assistant","content":null,"tool_calls":[{"id":"call_1","type":"function","function":{"name":"f","arguments":"{}"},"index":0}]},"finish_reason":null}]}
+
+data: {"id":"chatcmpl-1","object":"chat.completion.chunk","created":1,"model":"batch","choices":[{"index":0,"delta":{},"finish_reason":"tool_calls"}]}
+
+data: {"id":"chatcmpl-1","object":"chat.completion.chunk","created":1,"model":"batch","choices":[],"usage":{"prompt_tokens":1,"completion_tokens":2,"total_tokens":3}}
+
+data: [DONE]
+
+`, string(body))
+}
+
+func TestFallbackChatService_AggregatedStream(t *testing.T) {
+	routes := []core.Route{
+		{ID: "route1", Priority: 1, Provider: "openai", Model: "truncated", StreamOnly: true},
+		{ID: "route2", Priority: 2, Provider: "openai", Model: "stream", StreamOnly: true},
+	}
+	req := json.RawMessage(`{"messages": []}`)
+	isStream := mock.MatchedBy(func(req json.RawMessage) bool {
+		return gjson.GetBytes(req, "stream").Bool() && gjson.GetBytes(req, "stream_options.include_usage").Bool()
+	})
+
+	mockService := mocks.NewChatService(t)
+	mockService.On("ChatCompletion", mock.Anything, isStream, "truncated", "").
+		Return(streamResponse(`{"id": "chatcmpl-1", "choices": [{"index": 0, "delta": {"content": "Hel"}}]}`), nil)
+	mockService.On("ChatCompletion", mock.Anything, isStream, "stream", "").
+		Return(streamResponse(
+			`{"id": "chatcmpl-2", "created": 2, "model": "stream", "choices": [{"index": 0, "delta": {"role": "assistant", "content": ""}}]}`,
+			`{"id": "chatcmpl-2", "choices": [{"index": 0, "delta": {"content": "Hel"}}]}`,
+			`{"id": "chatcmpl-2", "choices": [{"index": 0, "delta": {"content": "lo"}, "finish_reason": "stop"}]}`,
+			`{"id": "chatcmpl-2", "choices": [], "usage": {"prompt_tokens": 1, "completion_tokens": 2, "total_tokens": 3}}`,
+			`[DONE]`,
+		), nil)
+
+	svc := core.NewFallbackChatService(routes, core.ChatServices{"openai": mockService}, core.NoOpBreaker{})
+	resp, err := svc.ChatCompletion(context.Background(), req)
+	assert.NoError(t, err)
+	assert.Equal(t, "route2", resp.Route.ID)
+	assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+
+	body, err := io.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{
+		"id": "chatcmpl-2", "object": "chat.completion", "created": 2, "model": "stream",
+		"choices": [{"index": 0, "message": {"role": "assistant", "content": "Hello"}, "logprobs": null, "finish_reason": "stop"}],
+		"usage": {"prompt_tokens": 1, "completion_tokens": 2, "total_tokens": 3}
+	}`, string(body))
+}
+
+func TestFallbackChatService_AggregatedToolCalls(t *testing.T) {
+	routes := []core.Route{{ID: "route1", Provider: "openai", Model: "stream", StreamOnly: true}}
+	req := json.RawMessage(`{"messages": []}`)
+
+	t.Run("arguments", func(t *testing.T) {
+		mockService := mocks.NewChatService(t)
+		mockService.On("ChatCompletion", mock.Anything, mock.Anything, "stream", "").
+			Return(streamResponse(
+				`{"choices": [{"index": 0, "delta": {"role": "assistant", "tool_calls": [{"index": 0, "id": "call_1", "type": "function", "function": {"name": "f", "arguments": "{\"a\""}}]}}]}`,
+				`{"choices": [{"index": 0, "delta": {"tool_calls": [{"index": 0, "function": {"arguments": ": 1}"}}]}, "finish_reason": "tool_calls"}]}`,
+				`[DONE]`,
+			), nil)
+
+		svc := core.NewFallbackChatService(routes, core.ChatServices{"openai": mockService}, core.NoOpBreaker{})
+		resp, err := svc.ChatCompletion(context.Background(), req)
+		assert.NoError(t, err)
+		body, err := io.ReadAll(resp.Body)
+		assert.NoError(t, err)
+		assert.JSONEq(t, `{"role": "assistant", "content": null, "tool_calls": [{"id": "call_1", "type": "function", "function": {"name": "f", "arguments": "{\"a\": 1}"}}]}`,
+			gjson.GetBytes(body, "choices.0.message").Raw)
+	})
+
+	for _, index := range []string{"-1", "1000000000"} {
+		t.Run("invalid index "+index, func(t *testing.T) {
+			mockService := mocks.NewChatService(t)
+			mockService.On("ChatCompletion", mock.Anything, mock.Anything, "stream", "").
+				Return(streamResponse(
+					`{"choices": [{"index": 0, "delta": {"tool_calls": [{"index": `+index+`, "function": {"name": "f"}}]}}]}`,
+					`[DONE]`,
+				), nil)
+
+			svc := core.NewFallbackChatService(routes, core.ChatServices{"openai": mockService}, core.NoOpBreaker{})
+			_, err := svc.ChatCompletion(context.Background(), req)
+			assert.ErrorContains(t, err, "invalid tool call index")
+		})
+	}
+}
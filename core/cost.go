@@ -0,0 +1,68 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sort"
+)
+
+var ErrQualityUnavailable = errors.New("no route meets the minimum quality")
+
+type minQualityContextKey struct{}
+
+// WithMinQuality sets the minimum route quality a request may be served by.
+func WithMinQuality(ctx context.Context, quality int) context.Context {
+	return context.WithValue(ctx, minQualityContextKey{}, quality)
+}
+
+func minQuality(ctx context.Context) int {
+	quality, _ := ctx.Value(minQualityContextKey{}).(int)
+	return quality
+}
+
+// CostStrategy attempts the routes meeting the minimum quality set with WithMinQuality
+// from cheapest to most expensive, estimated from the size of the request.
+// Routes without a known price are attempted last.
+type CostStrategy struct {
+	catalog PricingCatalog
+}
+
+func NewCostStrategy(catalog PricingCatalog) *CostStrategy {
+	return &CostStrategy{catalog: catalog}
+}
+
+func (s *CostStrategy) Order(ctx context.Context, req json.RawMessage, routes []Route) []Route {
+	usage := Usage{
+		PromptTokens:     EstimatePromptTokens(req),
+		CompletionTokens: MaxOutputTokens(req, defaultOutputTokens),
+	}
+
+	type candidate struct {
+		route Route
+		cost  float64
+		known bool
+	}
+	var candidates []candidate
+	min := minQuality(ctx)
+	for _, route := range routes {
+		if route.Quality < min {
+			continue
+		}
+		cost, known := s.catalog.Cost(route, usage)
+		candidates = append(candidates, candidate{route, cost, known})
+	}
+	// routes are sorted by priority so that breaks ties.
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if candidates[i].known != candidates[j].known {
+			return candidates[i].known
+		}
+		return candidates[i].cost < candidates[j].cost
+	})
+
+	ordered := make([]Route, len(candidates))
+	for i, c := range candidates {
+		ordered[i] = c.route
+	}
+	return ordered
+}
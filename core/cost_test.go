@@ -0,0 +1,49 @@
+package core_test
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"magicrouter/core"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCostStrategy_Order(t *testing.T) {
+	catalog := core.PricingCatalog{
+		"openai": {
+			"gpt-3.5-turbo": {Input: 0.5, Output: 1.5},
+			"gpt-4":         {Input: 30, Output: 60},
+			"gpt-4o":        {Input: 2.5, Output: 10},
+		},
+	}
+	routes := []core.Route{
+		{ID: "gpt-4", Priority: 1, Provider: "openai", Model: "gpt-4", Quality: 3},
+		{ID: "custom", Priority: 1, Provider: "openai", Model: "ft:custom", Quality: 3},
+		{ID: "gpt-4o", Priority: 2, Provider: "openai", Model: "gpt-4o", Quality: 3},
+		{ID: "gpt-3.5-turbo", Priority: 3, Provider: "openai", Model: "gpt-3.5-turbo", Quality: 1},
+	}
+	req := json.RawMessage(`{"messages": [{"role": "user", "content": "hello"}], "max_tokens": 100}`)
+	strategy := core.NewCostStrategy(catalog)
+
+	t.Run("cheapest first, unpriced last", func(t *testing.T) {
+		ordered := strategy.Order(context.Background(), req, routes)
+		assert.Equal(t, []string{"gpt-3.5-turbo", "gpt-4o", "gpt-4", "custom"}, routeIDs(ordered))
+	})
+
+	t.Run("minimum quality", func(t *testing.T) {
+		ctx := core.WithMinQuality(context.Background(), 2)
+		ordered := strategy.Order(ctx, req, routes)
+		assert.Equal(t, []string{"gpt-4o", "gpt-4", "custom"}, routeIDs(ordered))
+	})
+
+	t.Run("no route meets quality", func(t *testing.T) {
+		ctx := core.WithMinQuality(context.Background(), 5)
+		assert.Empty(t, strategy.Order(ctx, req, routes))
+
+		svc := core.NewFallbackChatService(routes, core.ChatServices{}, core.NoOpBreaker{}, core.WithStrategy(strategy))
+		_, err := svc.ChatCompletion(ctx, req)
+		assert.ErrorIs(t, err, core.ErrQualityUnavailable)
+	})
+}
@@ -0,0 +1,64 @@
+package core
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// DedupConfig coalesces concurrent identical requests of a project into one upstream call.
+// Streaming requests aren't coalesced, each of them gets its own stream.
+type DedupConfig struct {
+	// Timeout is how long followers wait for the leading request before making their own.
+	// Defaults to 30s.
+	Timeout Duration `json:"timeout,omitempty"`
+}
+
+const defaultDedupTimeout = 30 * time.Second
+
+// TimeoutOrDefault returns the configured timeout or the default one.
+func (c DedupConfig) TimeoutOrDefault() time.Duration {
+	if c.Timeout <= 0 {
+		return defaultDedupTimeout
+	}
+	return time.Duration(c.Timeout)
+}
+
+// RequestHash returns a hash of a JSON request that ignores key order and whitespace.
+func RequestHash(req json.RawMessage) (string, error) {
+	var v any
+	if err := json.Unmarshal(req, &v); err != nil {
+		return "", fmt.Errorf("failed to parse request: %w", err)
+	}
+	// Maps are marshalled with sorted keys.
+	canonical, err := json.Marshal(v)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal request: %w", err)
+	}
+	sum := sha256.Sum256(canonical)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// CachedResponse is a complete response that can be replayed to other clients.
+type CachedResponse struct {
+	StatusCode int         `json:"status_code"`
+	Header     http.Header `json:"header"`
+	Body       []byte      `json:"body"`
+}
+
+// FlightStore coordinates requests in flight with the same key, possibly across replicas.
+// The first to acquire a key leads, the others wait for its response.
+type FlightStore interface {
+	// Acquire reports whether the caller leads key. The lead expires after ttl.
+	Acquire(ctx context.Context, key string, ttl time.Duration) (bool, error)
+	// Complete hands resp to the followers of key and releases it.
+	Complete(ctx context.Context, key string, resp CachedResponse) error
+	// Abandon releases key without a response, followers make their own requests.
+	Abandon(ctx context.Context, key string) error
+	// Wait waits for the leader of key. It returns nil when the leader abandoned key or its lead expired.
+	Wait(ctx context.Context, key string) (*CachedResponse, error)
+}
@@ -0,0 +1,61 @@
+package core
+
+import (
+	"hash/fnv"
+	"math/rand"
+)
+
+// Variant is one arm of an experiment, served by its own routes.
+type Variant struct {
+	Name string `json:"name"`
+	// Weight is the share of traffic assigned to the variant relative to the others,
+	// e.g. 90 and 10 for a 10% canary.
+	Weight float64 `json:"weight"`
+	VirtualModel
+}
+
+// Experiment splits the traffic of a model between variants.
+type Experiment struct {
+	ID string `json:"id"`
+	// Model limits the experiment to requests for this model. Empty means all requests.
+	Model    string    `json:"model,omitempty"`
+	Variants []Variant `json:"variants"`
+	// StickyHeader is the request header used to keep assignments sticky.
+	// The request's user field is used when the header isn't set.
+	StickyHeader string `json:"sticky_header,omitempty"`
+}
+
+// Assign picks a variant for key. The same key always gets the same variant as long
+// as the variants don't change. Requests without a key are assigned at random.
+func (e Experiment) Assign(key string) Variant {
+	total := 0.0
+	for _, v := range e.Variants {
+		total += v.Weight
+	}
+
+	point := rand.Float64()
+	if key != "" {
+		h := fnv.New64a()
+		h.Write([]byte(e.ID + ":" + key))
+		point = float64(h.Sum64()>>11) / (1 << 53)
+	}
+	point *= total
+
+	for _, v := range e.Variants {
+		if point < v.Weight {
+			return v
+		}
+		point -= v.Weight
+	}
+	return e.Variants[len(e.Variants)-1]
+}
+
+// Experiment returns the experiment running for model, if any.
+func (c *ProjectConfig) Experiment(model string) (Experiment, bool) {
+	for _, e := range c.Experiments {
+		if len(e.Variants) > 0 && (e.Model == "" || e.Model == model) {
+			return e, true
+		}
+	}
+	return Experiment{}, false
+}
@@ -0,0 +1,56 @@
+package core_test
+
+import (
+	"fmt"
+	"testing"
+
+	"magicrouter/core"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExperiment_Assign(t *testing.T) {
+	experiment := core.Experiment{
+		ID: "gpt-4o-canary",
+		Variants: []core.Variant{
+			{Name: "control", Weight: 90},
+			{Name: "canary", Weight: 10},
+		},
+	}
+
+	t.Run("sticky", func(t *testing.T) {
+		for i := 0; i < 100; i++ {
+			key := fmt.Sprintf("user-%d", i)
+			assert.Equal(t, experiment.Assign(key).Name, experiment.Assign(key).Name)
+		}
+	})
+
+	t.Run("split by weight", func(t *testing.T) {
+		counts := map[string]int{}
+		for i := 0; i < 10000; i++ {
+			counts[experiment.Assign(fmt.Sprintf("user-%d", i)).Name]++
+		}
+		assert.InDelta(t, 9000, counts["control"], 300)
+		assert.InDelta(t, 1000, counts["canary"], 300)
+	})
+}
+
+func TestProjectConfig_Experiment(t *testing.T) {
+	cfg := &core.ProjectConfig{
+		Experiments: []core.Experiment{
+			{ID: "no-variants", Model: "gpt-4"},
+			{ID: "gpt-4", Model: "gpt-4", Variants: []core.Variant{{Name: "a", Weight: 1}}},
+			{ID: "catch-all", Variants: []core.Variant{{Name: "a", Weight: 1}}},
+		},
+	}
+	experiment, ok := cfg.Experiment("gpt-4")
+	assert.True(t, ok)
+	assert.Equal(t, "gpt-4", experiment.ID)
+
+	experiment, ok = cfg.Experiment("gpt-3.5-turbo")
+	assert.True(t, ok)
+	assert.Equal(t, "catch-all", experiment.ID)
+
+	_, ok = (&core.ProjectConfig{}).Experiment("gpt-4")
+	assert.False(t, ok)
+}
@@ -0,0 +1,197 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+
+	"magicrouter/sse"
+
+	"github.com/rs/zerolog/log"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+// continuationPrompt asks the next route to pick up a response that was cut off.
+const continuationPrompt = "Your previous response was cut off. Continue it exactly where it stopped, without repeating any of it or commenting on the interruption."
+
+// WithStreamFailover continues streams that break before they are done on the next
+// route, with the partial output as context. The client sees a single stream.
+func WithStreamFailover() FallbackOption {
+	return func(s *FallbackChatService) {
+		s.streamFailover = true
+	}
+}
+
+func isEventStream(resp *http.Response) bool {
+	return strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream")
+}
+
+// StreamSegment is the part of a stream served by a route that broke before it was done.
+type StreamSegment struct {
+	Route Route
+	// Usage is estimated from the request and the output received, the route never reported it.
+	Usage Usage
+}
+
+// failoverStream proxies an event stream and, when it ends without [DONE], re-issues
+// the request to the remaining routes. Chunks of the continuation get the ID of the
+// original stream so that clients can't tell.
+type failoverStream struct {
+	ctx       context.Context
+	svc       *FallbackChatService
+	req       json.RawMessage
+	route     Route
+	body      io.ReadCloser
+	events    *sse.Reader
+	remaining []Route
+	// segmentReq is the request sent to route and segmentStart where its output starts in content.
+	segmentReq   json.RawMessage
+	segmentStart int
+	segments     []StreamSegment
+
+	out          bytes.Buffer
+	id           string
+	content      strings.Builder
+	toolCalls    bool
+	continuation bool
+	err          error
+}
+
+func newFailoverStream(ctx context.Context, svc *FallbackChatService, req json.RawMessage, route Route, body io.ReadCloser, remaining []Route) *failoverStream {
+	return &failoverStream{
+		ctx:        ctx,
+		svc:        svc,
+		req:        req,
+		route:      route,
+		body:       body,
+		events:     sse.NewReader(body),
+		remaining:  remaining,
+		segmentReq: req,
+	}
+}
+
+func (f *failoverStream) Read(p []byte) (int, error) {
+	for f.out.Len() == 0 && f.err == nil {
+		f.next()
+	}
+	if f.out.Len() > 0 {
+		return f.out.Read(p)
+	}
+	return 0, f.err
+}
+
+func (f *failoverStream) Close() error {
+	return f.body.Close()
+}
+
+func (f *failoverStream) next() {
+	ev, err := f.events.Next()
+	if err != nil {
+		f.failover(err)
+		return
+	}
+	if bytes.Equal(ev.Data, sse.Done) {
+		sse.WriteEvent(&f.out, ev)
+		f.err = io.EOF
+		return
+	}
+
+	chunk := gjson.ParseBytes(ev.Data)
+	if f.id == "" {
+		f.id = chunk.Get("id").String()
+	}
+	if f.continuation {
+		delta := chunk.Get("choices.0.delta")
+		if delta.Get("role").Exists() && delta.Get("content").String() == "" {
+			// The continuation's role chunk would look like a new message.
+			return
+		}
+		if ev.Data, err = sjson.SetBytes(ev.Data, "id", f.id); err != nil {
+			f.err = fmt.Errorf("failed to rewrite chunk id: %w", err)
+			return
+		}
+	}
+	f.content.WriteString(chunk.Get("choices.0.delta.content").String())
+	f.toolCalls = f.toolCalls || chunk.Get("choices.0.delta.tool_calls").Exists()
+	sse.WriteEvent(&f.out, ev)
+}
+
+// failover continues the stream on the next available route after it broke with cause.
+func (f *failoverStream) failover(cause error) {
+	if cause == io.EOF {
+		cause = io.ErrUnexpectedEOF
+	}
+	f.body.Close()
+	f.svc.breaker.ReportFailure(f.ctx, f.route.ID)
+	// The output the client received was generated, and billed, by the broken route.
+	f.segments = append(f.segments, StreamSegment{
+		Route: f.route,
+		Usage: Usage{
+			PromptTokens:     EstimatePromptTokens(f.segmentReq),
+			CompletionTokens: CountTokens(f.content.String()[f.segmentStart:]),
+		},
+	})
+	log.Warn().Err(cause).Str("route_id", f.route.ID).Int("remaining", len(f.remaining)).Msg("stream_broken")
+
+	if len(f.remaining) == 0 || f.toolCalls || f.ctx.Err() != nil {
+		// Partial tool calls can't be continued.
+		f.err = fmt.Errorf("stream from route %s broke: %w", f.route.ID, cause)
+		return
+	}
+
+	req, err := f.continuationRequest()
+	if err != nil {
+		f.err = err
+		return
+	}
+	next := &FallbackChatService{
+		routes:   f.remaining,
+		services: f.svc.services,
+		breaker:  f.svc.breaker,
+	}
+	completion, err := next.ChatCompletion(f.ctx, req)
+	if err != nil {
+		f.err = fmt.Errorf("stream from route %s broke and could not be continued: %w", f.route.ID, err)
+		return
+	}
+	if !isEventStream(completion.Response) {
+		completion.Body.Close()
+		f.err = fmt.Errorf("stream from route %s broke and route %s did not stream", f.route.ID, completion.Route.ID)
+		return
+	}
+
+	log.Info().Str("from_route_id", f.route.ID).Str("to_route_id", completion.Route.ID).Msg("stream_failover")
+	i := slices.IndexFunc(f.remaining, func(r Route) bool { return r.ID == completion.Route.ID })
+	f.remaining = f.remaining[i+1:]
+	f.route = completion.Route
+	f.segmentReq = req
+	f.segmentStart = f.content.Len()
+	f.body = completion.Body
+	f.events = sse.NewReader(completion.Body)
+	f.continuation = true
+}
+
+// continuationRequest appends the partial output and a prompt to continue it to the request.
+func (f *failoverStream) continuationRequest() (json.RawMessage, error) {
+	req, err := sjson.SetBytes(f.req, "messages.-1", map[string]string{
+		"role":    "assistant",
+		"content": f.content.String(),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to append partial output: %w", err)
+	}
+	req, err = sjson.SetBytes(req, "messages.-1", map[string]string{
+		"role":    "user",
+		"content": continuationPrompt,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to append continuation prompt: %w", err)
+	}
+	return req, nil
+}
@@ -0,0 +1,95 @@
+package core_test
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"magicrouter/core"
+	"magicrouter/mocks"
+	"magicrouter/sse"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/tidwall/gjson"
+)
+
+func streamResponse(events ...string) *http.Response {
+	var body strings.Builder
+	for _, ev := range events {
+		body.WriteString("data: " + ev + "\n\n")
+	}
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": []string{"text/event-stream"}},
+		Body:       io.NopCloser(strings.NewReader(body.String())),
+	}
+}
+
+func TestFallbackChatService_StreamFailover(t *testing.T) {
+	routes := []core.Route{
+		{ID: "route1", Priority: 1, Provider: "openai", Model: "flaky"},
+		{ID: "route2", Priority: 2, Provider: "openai", Model: "stable"},
+	}
+	req := json.RawMessage(`{"stream": true, "messages": [{"role": "user", "content": "count to 4"}]}`)
+
+	mockService := mocks.NewChatService(t)
+	mockService.On("ChatCompletion", mock.Anything, req, "flaky", "").
+		Return(streamResponse(
+			`{"id": "chatcmpl-1", "choices": [{"delta": {"role": "assistant", "content": ""}}]}`,
+			`{"id": "chatcmpl-1", "choices": [{"delta": {"content": "1 2"}}]}`,
+		), nil).
+		Once()
+	mockService.On("ChatCompletion", mock.Anything, mock.MatchedBy(func(req json.RawMessage) bool {
+		messages := gjson.GetBytes(req, "messages").Array()
+		return len(messages) == 3 &&
+			messages[1].Get("role").String() == "assistant" &&
+			messages[1].Get("content").String() == "1 2" &&
+			messages[2].Get("role").String() == "user"
+	}), "stable", "").
+		Return(streamResponse(
+			`{"id": "chatcmpl-2", "choices": [{"delta": {"role": "assistant", "content": ""}}]}`,
+			`{"id": "chatcmpl-2", "choices": [{"delta": {"content": " 3 4"}}]}`,
+			`[DONE]`,
+		), nil).
+		Once()
+
+	svc := core.NewFallbackChatService(routes, core.ChatServices{"openai": mockService}, core.NoOpBreaker{},
+		core.WithStreamFailover(),
+	)
+	resp, err := svc.ChatCompletion(context.Background(), req)
+	assert.NoError(t, err)
+
+	var (
+		content strings.Builder
+		done    bool
+	)
+	events := sse.NewReader(resp.Body)
+	for {
+		ev, err := events.Next()
+		if err == io.EOF {
+			break
+		}
+		assert.NoError(t, err)
+		if string(ev.Data) == "[DONE]" {
+			done = true
+			continue
+		}
+		assert.Equal(t, "chatcmpl-1", gjson.GetBytes(ev.Data, "id").String())
+		content.WriteString(gjson.GetBytes(ev.Data, "choices.0.delta.content").String())
+	}
+	assert.True(t, done)
+	assert.Equal(t, "1 2 3 4", content.String())
+
+	// The stream was finished by route2, route1 is billed for what it produced.
+	assert.Equal(t, "route1", resp.Route.ID)
+	assert.Equal(t, "route2", resp.FinalRoute().ID)
+	segments := resp.BrokenSegments()
+	assert.Len(t, segments, 1)
+	assert.Equal(t, "route1", segments[0].Route.ID)
+	assert.Equal(t, core.EstimatePromptTokens(req), segments[0].Usage.PromptTokens)
+	assert.Equal(t, core.CountTokens("1 2"), segments[0].Usage.CompletionTokens)
+}
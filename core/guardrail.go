@@ -0,0 +1,442 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"magicrouter/sse"
+
+	"github.com/tidwall/gjson"
+)
+
+var ErrContentPolicyViolation = errors.New("content policy violation")
+
+// GuardrailStage is when a guardrail runs.
+type GuardrailStage string
+
+const (
+	// GuardrailStageRequest runs before the request is routed.
+	GuardrailStageRequest GuardrailStage = "request"
+	// GuardrailStageResponse runs once the response is received.
+	GuardrailStageResponse GuardrailStage = "response"
+)
+
+// GuardrailViolation is returned by guardrails rejecting a request or response.
+// The chain fills in the guardrail and stage, and the reason with the name of the
+// guardrail when it has none.
+type GuardrailViolation struct {
+	Guardrail string
+	Stage     GuardrailStage
+	Reason    string
+}
+
+func (v *GuardrailViolation) Error() string {
+	return fmt.Sprintf("%s: %s rejected by guardrail %s: %s", ErrContentPolicyViolation, v.Stage, v.Guardrail, v.Reason)
+}
+
+func (v *GuardrailViolation) Is(target error) bool {
+	return target == ErrContentPolicyViolation
+}
+
+// Guardrail checks requests before they are routed and their output once it's received.
+// A *GuardrailViolation rejects them, other errors are logged and ignored.
+type Guardrail interface {
+	CheckRequest(ctx context.Context, req json.RawMessage) error
+	CheckResponse(ctx context.Context, req json.RawMessage, output string) error
+}
+
+// StreamingGuardrail is a guardrail cheap enough to check the output of streams as it
+// is generated, so that they can be cut off midway. Other guardrails check streams once
+// they are done, before [DONE] is passed on.
+type StreamingGuardrail interface {
+	Guardrail
+	CheckPartial(ctx context.Context, output string) error
+}
+
+// GuardrailType selects the implementation of a configured guardrail.
+type GuardrailType string
+
+const (
+	GuardrailBlocklist   GuardrailType = "blocklist"
+	GuardrailMaxMessages GuardrailType = "max_messages"
+	GuardrailModeration  GuardrailType = "moderation"
+	GuardrailWebhook     GuardrailType = "webhook"
+)
+
+// GuardrailConfig configures a guardrail of a project's chain.
+type GuardrailConfig struct {
+	Name string        `json:"name"`
+	Type GuardrailType `json:"type"`
+	// Stages the guardrail runs at. Both when empty.
+	Stages []GuardrailStage `json:"stages,omitempty"`
+
+	// Keywords and Patterns (regular expressions) are rejected by blocklists.
+	// Keywords match whole words, case insensitively.
+	Keywords []string `json:"keywords,omitempty"`
+	Patterns []string `json:"patterns,omitempty"`
+	// MaxMessages is the maximum number of messages of a request.
+	MaxMessages int `json:"max_messages,omitempty"`
+	// Route is the model asked to moderate content.
+	Route *Route `json:"route,omitempty"`
+	// URL is the endpoint of webhook guardrails.
+	URL     string   `json:"url,omitempty"`
+	Timeout Duration `json:"timeout,omitempty"`
+}
+
+// NamedGuardrail is a guardrail of a chain.
+type NamedGuardrail struct {
+	Name   string
+	Stages []GuardrailStage
+	Guardrail
+}
+
+func (g NamedGuardrail) runsAt(stage GuardrailStage) bool {
+	return len(g.Stages) == 0 || slices.Contains(g.Stages, stage)
+}
+
+// GuardrailChain runs guardrails in order, the first violation wins.
+type GuardrailChain struct {
+	projectID  string
+	guardrails []NamedGuardrail
+}
+
+func NewGuardrailChain(projectID string, guardrails ...NamedGuardrail) *GuardrailChain {
+	return &GuardrailChain{projectID: projectID, guardrails: guardrails}
+}
+
+// NewGuardrail creates the built-in guardrails, webhooks excepted.
+func NewGuardrail(cfg GuardrailConfig, services ChatServices) (Guardrail, error) {
+	switch cfg.Type {
+	case GuardrailBlocklist:
+		return NewBlocklist(cfg.Keywords, cfg.Patterns)
+	case GuardrailMaxMessages:
+		return MaxMessages(cfg.MaxMessages), nil
+	case GuardrailModeration:
+		if cfg.Route == nil {
+			return nil, errors.New("moderation guardrail needs a route")
+		}
+		return NewModeration(services, *cfg.Route), nil
+	default:
+		return nil, fmt.Errorf("unknown guardrail type: %s", cfg.Type)
+	}
+}
+
+func (c *GuardrailChain) CheckRequest(ctx context.Context, req json.RawMessage) error {
+	return c.run(ctx, GuardrailStageRequest, func(g NamedGuardrail) error {
+		return g.CheckRequest(ctx, req)
+	})
+}
+
+func (c *GuardrailChain) CheckResponse(ctx context.Context, req json.RawMessage, output string) error {
+	return c.run(ctx, GuardrailStageResponse, func(g NamedGuardrail) error {
+		return g.CheckResponse(ctx, req, output)
+	})
+}
+
+func (c *GuardrailChain) checkPartial(ctx context.Context, output string) error {
+	return c.run(ctx, GuardrailStageResponse, func(g NamedGuardrail) error {
+		if sg, ok := g.Guardrail.(StreamingGuardrail); ok {
+			return sg.CheckPartial(ctx, output)
+		}
+		return nil
+	})
+}
+
+func (c *GuardrailChain) run(ctx context.Context, stage GuardrailStage, check func(NamedGuardrail) error) error {
+	for _, g := range c.guardrails {
+		if !g.runsAt(stage) {
+			continue
+		}
+		err := check(g)
+		var violation *GuardrailViolation
+		if errors.As(err, &violation) {
+			violation.Guardrail = g.Name
+			violation.Stage = stage
+			if violation.Reason == "" {
+				violation.Reason = g.Name
+			}
+			Logger(ctx).Warn().
+				Str("project_id", c.projectID).
+				Str("guardrail", g.Name).
+				Str("stage", string(stage)).
+				Str("reason", violation.Reason).
+				Msg("guardrail_violation")
+			return violation
+		}
+		if err != nil {
+			// Don't block traffic when a guardrail is unavailable.
+			Logger(ctx).Err(err).Str("guardrail", g.Name).Msg("guardrail failed")
+		}
+	}
+	return nil
+}
+
+// CheckCompletion checks the output of a successful response. Event streams are checked
+// as they're read: streaming guardrails run on every chunk, the others before [DONE] is
+// passed on. A violation ends the stream with the *GuardrailViolation as read error.
+func (c *GuardrailChain) CheckCompletion(ctx context.Context, req json.RawMessage, resp *http.Response) error {
+	if len(c.guardrails) == 0 || resp.StatusCode != http.StatusOK {
+		return nil
+	}
+	if isEventStream(resp) {
+		resp.Body = &guardedStream{ctx: ctx, chain: c, req: req, body: resp.Body, events: sse.NewReader(resp.Body), outputs: make(map[int64]*streamOutput)}
+		return nil
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return fmt.Errorf("failed to read response body: %w", err)
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	for _, choice := range gjson.GetBytes(body, "choices").Array() {
+		if err := c.CheckResponse(ctx, req, choice.Get("message.content").String()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type guardedStream struct {
+	ctx    context.Context
+	chain  *GuardrailChain
+	req    json.RawMessage
+	body   io.ReadCloser
+	events *sse.Reader
+	// outputs are the texts generated so far by choice index.
+	outputs map[int64]*streamOutput
+	out     bytes.Buffer
+	err     error
+}
+
+// partialOverlap is how much of the output already checked is checked again with new
+// text, so that matches spanning chunks are found. Longer ones are caught by the check of
+// the whole output before [DONE].
+const partialOverlap = 256
+
+type streamOutput struct {
+	text strings.Builder
+	// checked is the length of text already checked by streaming guardrails.
+	checked int
+}
+
+// unchecked returns the text that wasn't checked yet, preceded by up to partialOverlap
+// bytes of the checked text. It starts at a word so that keywords can't match the end
+// of one.
+func (o *streamOutput) unchecked() string {
+	text := o.text.String()
+	start := o.checked - partialOverlap
+	if start <= 0 {
+		return text
+	}
+	if space := strings.IndexFunc(text[start:o.checked], unicode.IsSpace); space >= 0 {
+		start += space
+	} else {
+		for start < o.checked && !utf8.RuneStart(text[start]) {
+			start++
+		}
+	}
+	return text[start:]
+}
+
+func (s *guardedStream) Read(p []byte) (int, error) {
+	for s.out.Len() == 0 && s.err == nil {
+		s.next()
+	}
+	if s.out.Len() > 0 {
+		return s.out.Read(p)
+	}
+	return 0, s.err
+}
+
+func (s *guardedStream) Close() error {
+	return s.body.Close()
+}
+
+func (s *guardedStream) next() {
+	ev, err := s.events.Next()
+	if err != nil {
+		s.err = err
+		return
+	}
+	if bytes.Equal(ev.Data, sse.Done) {
+		indexes := make([]int64, 0, len(s.outputs))
+		for index := range s.outputs {
+			indexes = append(indexes, index)
+		}
+		slices.Sort(indexes)
+		for _, index := range indexes {
+			if err := s.chain.CheckResponse(s.ctx, s.req, s.outputs[index].text.String()); err != nil {
+				s.err = err
+				return
+			}
+		}
+		sse.WriteEvent(&s.out, ev)
+		return
+	}
+	for _, choice := range gjson.GetBytes(ev.Data, "choices").Array() {
+		delta := choice.Get("delta.content").String()
+		if delta == "" {
+			continue
+		}
+		index := choice.Get("index").Int()
+		output, ok := s.outputs[index]
+		if !ok {
+			output = &streamOutput{}
+			s.outputs[index] = output
+		}
+		output.text.WriteString(delta)
+		if err := s.chain.checkPartial(s.ctx, output.unchecked()); err != nil {
+			s.err = err
+			return
+		}
+		output.checked = output.text.Len()
+	}
+	sse.WriteEvent(&s.out, ev)
+}
+
+// MessagesText returns the text of every message of a request, one per line.
+func MessagesText(req json.RawMessage) string {
+	var text strings.Builder
+	for _, msg := range gjson.GetBytes(req, "messages").Array() {
+		content := msg.Get("content")
+		if content.Type == gjson.String {
+			text.WriteString(content.String())
+			text.WriteByte('\n')
+			continue
+		}
+		for _, part := range content.Array() {
+			if part.Get("type").String() == "text" {
+				text.WriteString(part.Get("text").String())
+				text.WriteByte('\n')
+			}
+		}
+	}
+	return text.String()
+}
+
+// Blocklist rejects content containing any of its keywords or patterns.
+type Blocklist struct {
+	re *regexp.Regexp
+}
+
+// NewBlocklist creates a Blocklist. Keywords match whole words, case insensitively.
+func NewBlocklist(keywords, patterns []string) (*Blocklist, error) {
+	alternatives := slices.Clone(patterns)
+	for _, kw := range keywords {
+		alternatives = append(alternatives, `(?i:\b`+regexp.QuoteMeta(kw)+`\b)`)
+	}
+	if len(alternatives) == 0 {
+		return nil, errors.New("blocklist needs keywords or patterns")
+	}
+	re, err := regexp.Compile(strings.Join(alternatives, "|"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid blocklist pattern: %w", err)
+	}
+	return &Blocklist{re: re}, nil
+}
+
+func (b *Blocklist) check(text string) error {
+	// The matched text isn't the reason, it would be echoed to clients and logs.
+	if b.re.MatchString(text) {
+		return &GuardrailViolation{}
+	}
+	return nil
+}
+
+func (b *Blocklist) CheckRequest(ctx context.Context, req json.RawMessage) error {
+	return b.check(MessagesText(req))
+}
+
+func (b *Blocklist) CheckResponse(ctx context.Context, req json.RawMessage, output string) error {
+	return b.check(output)
+}
+
+func (b *Blocklist) CheckPartial(ctx context.Context, output string) error {
+	return b.check(output)
+}
+
+// MaxMessages rejects requests with more messages than it.
+type MaxMessages int
+
+func (m MaxMessages) CheckRequest(ctx context.Context, req json.RawMessage) error {
+	if n := gjson.GetBytes(req, "messages.#").Int(); n > int64(m) {
+		return &GuardrailViolation{Reason: fmt.Sprintf("%d messages exceed the maximum of %d", n, m)}
+	}
+	return nil
+}
+
+func (m MaxMessages) CheckResponse(ctx context.Context, req json.RawMessage, output string) error {
+	return nil
+}
+
+// moderationPrompt asks the moderation model for a verdict in JSON.
+const moderationPrompt = `You are a content moderator. Decide whether the content provided by the user is harmful: hate, harassment, violence, self-harm, sexual content involving minors or illegal activity. Respond with a JSON object {"flagged": boolean, "reason": string}.`
+
+// Moderation asks a model whether content is harmful.
+type Moderation struct {
+	services ChatServices
+	route    Route
+}
+
+func NewModeration(services ChatServices, route Route) *Moderation {
+	return &Moderation{services: services, route: route}
+}
+
+func (m *Moderation) CheckRequest(ctx context.Context, req json.RawMessage) error {
+	return m.check(ctx, MessagesText(req))
+}
+
+func (m *Moderation) CheckResponse(ctx context.Context, req json.RawMessage, output string) error {
+	return m.check(ctx, output)
+}
+
+func (m *Moderation) check(ctx context.Context, content string) error {
+	svc, ok := m.services[m.route.Provider]
+	if !ok {
+		return fmt.Errorf("unknown provider: %s", m.route.Provider)
+	}
+	req, err := json.Marshal(map[string]any{
+		"messages": []map[string]string{
+			{"role": "system", "content": moderationPrompt},
+			{"role": "user", "content": content},
+		},
+		"response_format": map[string]string{"type": "json_object"},
+		"temperature":     0,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal moderation request: %w", err)
+	}
+	resp, err := callRoute(ctx, svc, req, m.route)
+	if err != nil {
+		return fmt.Errorf("moderation request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read moderation response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("moderation route responded with status %d: %s", resp.StatusCode, body)
+	}
+	var verdict struct {
+		Flagged bool   `json:"flagged"`
+		Reason  string `json:"reason"`
+	}
+	if err := json.Unmarshal([]byte(CompletionText(body)), &verdict); err != nil {
+		return fmt.Errorf("failed to parse moderation verdict: %w", err)
+	}
+	if verdict.Flagged {
+		return &GuardrailViolation{Reason: verdict.Reason}
+	}
+	return nil
+}
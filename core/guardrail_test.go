@@ -0,0 +1,140 @@
+package core_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"magicrouter/core"
+	"magicrouter/mocks"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// failingGuardrail is a guardrail whose service is unavailable.
+type failingGuardrail struct{}
+
+func (failingGuardrail) CheckRequest(ctx context.Context, req json.RawMessage) error {
+	return errors.New("connection refused")
+}
+
+func (failingGuardrail) CheckResponse(ctx context.Context, req json.RawMessage, output string) error {
+	return errors.New("connection refused")
+}
+
+func TestGuardrailChain_CheckRequest(t *testing.T) {
+	blocklist, err := core.NewBlocklist([]string{"secret project"}, []string{`sk-[a-z0-9]{8}`})
+	assert.NoError(t, err)
+	chain := core.NewGuardrailChain("project1",
+		core.NamedGuardrail{Name: "unavailable", Guardrail: failingGuardrail{}},
+		core.NamedGuardrail{Name: "length", Guardrail: core.MaxMessages(2)},
+		core.NamedGuardrail{Name: "words", Guardrail: blocklist},
+		core.NamedGuardrail{Name: "output_only", Stages: []core.GuardrailStage{core.GuardrailStageResponse}, Guardrail: core.MaxMessages(0)},
+	)
+
+	tests := []struct {
+		name      string
+		req       string
+		guardrail string
+	}{
+		{"allowed", `{"messages": [{"role": "user", "content": "projects are fun"}]}`, ""},
+		{"keyword", `{"messages": [{"role": "user", "content": "Tell me about the Secret Project."}]}`, "words"},
+		{"pattern", `{"messages": [{"role": "user", "content": [{"type": "text", "text": "my key is sk-abcd1234"}]}]}`, "words"},
+		{"too many messages", `{"messages": [{"content": "1"}, {"content": "2"}, {"content": "3"}]}`, "length"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := chain.CheckRequest(context.Background(), json.RawMessage(tt.req))
+			if tt.guardrail == "" {
+				assert.NoError(t, err)
+				return
+			}
+			assert.ErrorIs(t, err, core.ErrContentPolicyViolation)
+			var violation *core.GuardrailViolation
+			assert.ErrorAs(t, err, &violation)
+			assert.Equal(t, tt.guardrail, violation.Guardrail)
+			assert.Equal(t, core.GuardrailStageRequest, violation.Stage)
+		})
+	}
+}
+
+func TestGuardrailChain_CheckCompletion(t *testing.T) {
+	blocklist, _ := core.NewBlocklist([]string{"forbidden"}, nil)
+	req := json.RawMessage(`{"messages": []}`)
+
+	t.Run("json", func(t *testing.T) {
+		chain := core.NewGuardrailChain("project1", core.NamedGuardrail{Name: "words", Guardrail: blocklist})
+		resp := textResponse(`{"choices": [{"message": {"content": "this is forbidden"}}]}`)
+		err := chain.CheckCompletion(context.Background(), req, resp)
+		assert.ErrorIs(t, err, core.ErrContentPolicyViolation)
+	})
+
+	t.Run("stream cut off", func(t *testing.T) {
+		chain := core.NewGuardrailChain("project1", core.NamedGuardrail{Name: "words", Guardrail: blocklist})
+		resp := streamResponse(
+			`{"choices": [{"delta": {"content": "this is forb"}}]}`,
+			`{"choices": [{"delta": {"content": "idden"}}]}`,
+			`[DONE]`,
+		)
+		assert.NoError(t, chain.CheckCompletion(context.Background(), req, resp))
+		body, err := io.ReadAll(resp.Body)
+		assert.ErrorIs(t, err, core.ErrContentPolicyViolation)
+		assert.Equal(t, "data: {\"choices\": [{\"delta\": {\"content\": \"this is forb\"}}]}\n\n", string(body))
+	})
+
+	t.Run("stream choices", func(t *testing.T) {
+		chain := core.NewGuardrailChain("project1", core.NamedGuardrail{Name: "words", Guardrail: blocklist})
+		resp := streamResponse(
+			`{"choices": [{"index": 0, "delta": {"content": "fine"}}, {"index": 1, "delta": {"content": "forb"}}]}`,
+			`{"choices": [{"index": 1, "delta": {"content": "idden"}}]}`,
+			`[DONE]`,
+		)
+		assert.NoError(t, chain.CheckCompletion(context.Background(), req, resp))
+		_, err := io.ReadAll(resp.Body)
+		var violation *core.GuardrailViolation
+		assert.ErrorAs(t, err, &violation)
+		// The reason names the guardrail rather than quoting the blocked text.
+		assert.Equal(t, "words", violation.Reason)
+	})
+
+	t.Run("stream long output", func(t *testing.T) {
+		chain := core.NewGuardrailChain("project1", core.NamedGuardrail{Name: "words", Guardrail: blocklist})
+		long := strings.Repeat("fine words ", 100)
+		resp := streamResponse(
+			`{"choices": [{"delta": {"content": "`+long+`"}}]}`,
+			`{"choices": [{"delta": {"content": "un"}}]}`,
+			`{"choices": [{"delta": {"content": "forbidden "}}]}`,
+			`{"choices": [{"delta": {"content": "`+long+`forb"}}]}`,
+			`{"choices": [{"delta": {"content": "idden"}}]}`,
+			`[DONE]`,
+		)
+		assert.NoError(t, chain.CheckCompletion(context.Background(), req, resp))
+		body, err := io.ReadAll(resp.Body)
+		assert.ErrorIs(t, err, core.ErrContentPolicyViolation)
+		// Words merely ending in a keyword aren't cut off when only the end of the output is checked.
+		assert.Contains(t, string(body), "forbidden ")
+		assert.NotContains(t, string(body), "idden\"")
+	})
+
+	t.Run("stream checked before done", func(t *testing.T) {
+		moderation := mocks.NewChatService(t)
+		moderation.On("ChatCompletion", mock.Anything, mock.Anything, "moderator", "").
+			Return(textResponse(`{"choices": [{"message": {"content": "{\"flagged\": true, \"reason\": \"violence\"}"}}]}`), nil).
+			Once()
+		chain := core.NewGuardrailChain("project1", core.NamedGuardrail{
+			Name:      "moderation",
+			Guardrail: core.NewModeration(core.ChatServices{"openai": moderation}, core.Route{ID: "moderation", Provider: "openai", Model: "moderator"}),
+		})
+		resp := streamResponse(`{"choices": [{"delta": {"content": "hit them"}}]}`, `[DONE]`)
+		assert.NoError(t, chain.CheckCompletion(context.Background(), req, resp))
+		body, err := io.ReadAll(resp.Body)
+		var violation *core.GuardrailViolation
+		assert.ErrorAs(t, err, &violation)
+		assert.Equal(t, "violence", violation.Reason)
+		assert.NotContains(t, string(body), "[DONE]")
+	})
+}
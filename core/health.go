@@ -0,0 +1,8 @@
+package core
+
+import "context"
+
+// HealthChecker is implemented by dependencies that can report whether they are reachable.
+type HealthChecker interface {
+	Ping(ctx context.Context) error
+}
@@ -0,0 +1,218 @@
+package core
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"magicrouter/metrics"
+
+	"github.com/rs/zerolog/log"
+)
+
+// HedgeConfig configures hedged requests: when a route hasn't produced its first byte
+// within Delay, the next route is raced against it and the first to respond wins.
+type HedgeConfig struct {
+	Delay Duration `json:"delay"`
+	// MaxHedges is the maximum number of extra routes started per request.
+	MaxHedges int `json:"max_hedges"`
+	// MaxPerMinute caps the hedged attempts of a project to control cost. Zero means unlimited.
+	MaxPerMinute int `json:"max_per_minute"`
+}
+
+type hedging struct {
+	cfg   HedgeConfig
+	allow func() bool
+}
+
+// WithHedging races the next route when the current one is slow, see HedgeConfig.
+// allow is consulted before each hedged attempt, it may be nil.
+func WithHedging(cfg HedgeConfig, allow func() bool) FallbackOption {
+	return func(s *FallbackChatService) {
+		if allow == nil {
+			allow = func() bool { return true }
+		}
+		s.hedge = &hedging{cfg: cfg, allow: allow}
+	}
+}
+
+// HedgeLimiter counts hedged attempts per key in one minute windows.
+type HedgeLimiter struct {
+	mu      sync.Mutex
+	window  time.Time
+	counts  map[string]int
+	nowFunc func() time.Time
+}
+
+func NewHedgeLimiter() *HedgeLimiter {
+	return &HedgeLimiter{
+		counts:  make(map[string]int),
+		nowFunc: time.Now,
+	}
+}
+
+// Allow reports whether key can make another hedged attempt this minute and counts it if so.
+func (l *HedgeLimiter) Allow(key string, perMinute int) bool {
+	if perMinute <= 0 {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if window := l.nowFunc().Truncate(time.Minute); !window.Equal(l.window) {
+		l.window = window
+		clear(l.counts)
+	}
+	if l.counts[key] >= perMinute {
+		return false
+	}
+	l.counts[key]++
+	return true
+}
+
+type hedgeAttempt struct {
+	route  Route
+	start  time.Time
+	resp   *http.Response
+	cancel context.CancelFunc
+	err    error
+}
+
+// hedged attempts routes in order, starting the next one whenever the in-flight
+// ones haven't produced a byte within the hedge delay or have all failed.
+func (s *FallbackChatService) hedged(ctx context.Context, req json.RawMessage, routes []Route) (*Completion, error) {
+	var (
+		results     = make(chan hedgeAttempt, len(routes))
+		fallbackErr = make(FallbackError)
+		next        int
+		inflight    int
+		hedges      int
+	)
+	start := func() (bool, error) {
+		for next < len(routes) {
+			route := routes[next]
+			next++
+			if !s.shouldAttempt(ctx, route) {
+				continue
+			}
+			svc, ok := s.services[route.Provider]
+			if !ok {
+				return false, fmt.Errorf("unknown provider: %s", route.Provider)
+			}
+			actx, cancel := context.WithCancel(ctx)
+			inflight++
+			go func() {
+				start := time.Now()
+				resp, err := firstByte(callRoute(actx, svc, req, route))
+				results <- hedgeAttempt{route: route, start: start, resp: resp, cancel: cancel, err: err}
+			}()
+			return true, nil
+		}
+		return false, nil
+	}
+	// drain cancels the attempts that lost the race so that their completions aren't paid for.
+	drain := func() {
+		for ; inflight > 0; inflight-- {
+			a := <-results
+			a.cancel()
+			if a.resp != nil {
+				a.resp.Body.Close()
+			}
+		}
+	}
+
+	if started, err := start(); !started {
+		if err != nil {
+			return nil, err
+		}
+		return nil, fallbackErr
+	}
+	delay := time.Duration(s.hedge.cfg.Delay)
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	for inflight > 0 {
+		select {
+		case a := <-results:
+			inflight--
+			if a.err != nil {
+				a.cancel()
+				fallbackErr[a.route.ID] = a.err
+				s.breaker.ReportFailure(ctx, a.route.ID)
+				s.observeFailure(ctx, a.route, a.start)
+				if inflight > 0 {
+					continue
+				}
+				if _, err := start(); err != nil {
+					return nil, err
+				}
+				timer.Reset(delay)
+				continue
+			}
+
+			s.breaker.ReportSuccess(ctx, a.route.ID)
+			if hedges > 0 {
+				metrics.HedgeWins.Add(a.route.ID, 1)
+				log.Info().Str("route_id", a.route.ID).Int("hedges", hedges).Msg("hedged_request_won")
+			}
+			go drain()
+			a.resp.Body = &cancelBody{ReadCloser: a.resp.Body, cancel: a.cancel}
+			return s.complete(ctx, req, a.route, a.start, a.resp, routes[next:]), nil
+
+		case <-timer.C:
+			if hedges >= s.hedge.cfg.MaxHedges || next >= len(routes) || !s.hedge.allow() {
+				continue
+			}
+			started, err := start()
+			if err != nil {
+				drain()
+				return nil, err
+			}
+			if started {
+				hedges++
+				hedged := routes[next-1]
+				metrics.Hedges.Add(hedged.ID, 1)
+				log.Info().Str("route_id", hedged.ID).Dur("delay", delay).Msg("hedged_request")
+				timer.Reset(delay)
+			}
+
+		case <-ctx.Done():
+			drain()
+			return nil, ctx.Err()
+		}
+	}
+	return nil, fallbackErr
+}
+
+// firstByte waits for the first byte of the response body so that slow streams can be hedged.
+func firstByte(resp *http.Response, err error) (*http.Response, error) {
+	if err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(resp.Body)
+	if _, err := br.Peek(1); err != nil && err != io.EOF {
+		resp.Body.Close()
+		return nil, fmt.Errorf("failed to read response: %w", err)
+	}
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{br, resp.Body}
+	return resp, nil
+}
+
+// cancelBody cancels the context of the request once its body is closed.
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
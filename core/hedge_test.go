@@ -0,0 +1,122 @@
+package core_test
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"magicrouter/core"
+	"magicrouter/mocks"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func textResponse(body string) *http.Response {
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Body:       io.NopCloser(strings.NewReader(body)),
+	}
+}
+
+// closeRecorder is a body that records whether it was closed.
+type closeRecorder struct {
+	*strings.Reader
+	closed atomic.Bool
+}
+
+func (b *closeRecorder) Close() error {
+	b.closed.Store(true)
+	return nil
+}
+
+func TestFallbackChatService_Hedging(t *testing.T) {
+	routes := []core.Route{
+		{ID: "route1", Priority: 1, Provider: "openai", Model: "slow"},
+		{ID: "route2", Priority: 2, Provider: "openai", Model: "fast"},
+	}
+	hedge := core.HedgeConfig{Delay: core.Duration(20 * time.Millisecond), MaxHedges: 1}
+	req := json.RawMessage(`{}`)
+
+	t.Run("backup wins when primary is slow", func(t *testing.T) {
+		loser := &closeRecorder{Reader: strings.NewReader(strings.Repeat("slow", 10000))}
+		mockService := mocks.NewChatService(t)
+		mockService.On("ChatCompletion", mock.Anything, req, "slow", "").
+			Return(&http.Response{StatusCode: http.StatusOK, Body: loser}, nil).
+			After(200 * time.Millisecond).
+			Once()
+		mockService.On("ChatCompletion", mock.Anything, req, "fast", "").
+			Return(textResponse("fast"), nil).
+			Once()
+		svc := core.NewFallbackChatService(routes, core.ChatServices{"openai": mockService}, core.NoOpBreaker{},
+			core.WithHedging(hedge, nil),
+		)
+		resp, err := svc.ChatCompletion(context.Background(), req)
+		assert.NoError(t, err)
+		assert.Equal(t, "route2", resp.Route.ID)
+		body, _ := io.ReadAll(resp.Body)
+		assert.Equal(t, "fast", string(body))
+		// Let the loser finish so the mock expectations are met.
+		time.Sleep(250 * time.Millisecond)
+		// The loser is closed without being read, it isn't streamed to the end.
+		assert.True(t, loser.closed.Load())
+		assert.Positive(t, loser.Len())
+	})
+
+	t.Run("no hedge when primary is fast", func(t *testing.T) {
+		mockService := mocks.NewChatService(t)
+		mockService.On("ChatCompletion", mock.Anything, req, "slow", "").
+			Return(textResponse("slow"), nil).
+			Once()
+		svc := core.NewFallbackChatService(routes, core.ChatServices{"openai": mockService}, core.NoOpBreaker{},
+			core.WithHedging(hedge, nil),
+		)
+		resp, err := svc.ChatCompletion(context.Background(), req)
+		assert.NoError(t, err)
+		assert.Equal(t, "route1", resp.Route.ID)
+	})
+
+	t.Run("falls back when primary fails", func(t *testing.T) {
+		mockService := mocks.NewChatService(t)
+		mockService.On("ChatCompletion", mock.Anything, req, "slow", "").
+			Return(nil, core.ErrProviderRateLimited).
+			Once()
+		mockService.On("ChatCompletion", mock.Anything, req, "fast", "").
+			Return(textResponse("fast"), nil).
+			Once()
+		svc := core.NewFallbackChatService(routes, core.ChatServices{"openai": mockService}, core.NoOpBreaker{},
+			core.WithHedging(hedge, func() bool { return false }),
+		)
+		resp, err := svc.ChatCompletion(context.Background(), req)
+		assert.NoError(t, err)
+		assert.Equal(t, "route2", resp.Route.ID)
+	})
+
+	t.Run("waits for primary when hedging isn't allowed", func(t *testing.T) {
+		mockService := mocks.NewChatService(t)
+		mockService.On("ChatCompletion", mock.Anything, req, "slow", "").
+			Return(textResponse("slow"), nil).
+			After(50 * time.Millisecond).
+			Once()
+		svc := core.NewFallbackChatService(routes, core.ChatServices{"openai": mockService}, core.NoOpBreaker{},
+			core.WithHedging(hedge, func() bool { return false }),
+		)
+		resp, err := svc.ChatCompletion(context.Background(), req)
+		assert.NoError(t, err)
+		assert.Equal(t, "route1", resp.Route.ID)
+	})
+}
+
+func TestHedgeLimiter(t *testing.T) {
+	limiter := core.NewHedgeLimiter()
+	assert.True(t, limiter.Allow("project1", 2))
+	assert.True(t, limiter.Allow("project1", 2))
+	assert.False(t, limiter.Allow("project1", 2))
+	assert.True(t, limiter.Allow("project2", 2))
+	assert.True(t, limiter.Allow("project1", 0), "zero means unlimited")
+}
@@ -0,0 +1,34 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ErrIdempotencyLeaseLost is returned when a request finishes after its claim on a key
+// expired and another request took it over.
+var ErrIdempotencyLeaseLost = errors.New("idempotency key claimed by another request")
+
+// IdempotencyRecord is what is kept for an idempotency key.
+type IdempotencyRecord struct {
+	// RequestHash identifies the request the key was first used with, see RequestHash.
+	RequestHash string `json:"request_hash"`
+	// Owner identifies the request holding the key while it's in flight.
+	Owner string `json:"owner,omitempty"`
+	// Response is nil while the request is in flight.
+	Response *CachedResponse `json:"response,omitempty"`
+}
+
+type IdempotencyStore interface {
+	// Begin claims key for the request with hash for up to lease on behalf of owner.
+	// When the key was already claimed it reports false and returns its record.
+	Begin(ctx context.Context, key, hash, owner string, lease time.Duration) (*IdempotencyRecord, bool, error)
+	// Finish stores the response of the request that claimed key for ttl. It returns
+	// ErrIdempotencyLeaseLost when owner no longer holds key.
+	Finish(ctx context.Context, key, owner string, record IdempotencyRecord, ttl time.Duration) error
+	// Release forgets key so that the request can be retried, unless owner no longer holds it.
+	Release(ctx context.Context, key, owner string) error
+	// Get returns the record of key, nil if there is none.
+	Get(ctx context.Context, key string) (*IdempotencyRecord, error)
+}
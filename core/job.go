@@ -0,0 +1,102 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+type JobStatus string
+
+const (
+	JobQueued    JobStatus = "queued"
+	JobRunning   JobStatus = "running"
+	JobSucceeded JobStatus = "succeeded"
+	JobFailed    JobStatus = "failed"
+)
+
+// JobResult is the response of the route that completed a job.
+type JobResult struct {
+	StatusCode int             `json:"status_code"`
+	Body       json.RawMessage `json:"body"`
+}
+
+// Job is a chat completion run in the background, see JobQueue.
+type Job struct {
+	ID string `json:"id"`
+	// Token is the token the job was submitted with, its spend is recorded against it.
+	Token   *Token          `json:"token"`
+	Request json.RawMessage `json:"request"`
+	// MinQuality is the minimum quality of the routes the job can run on.
+	MinQuality int `json:"min_quality,omitempty"`
+	// WebhookURL is notified once the job is done. Optional.
+	WebhookURL string     `json:"webhook_url,omitempty"`
+	Status     JobStatus  `json:"status"`
+	Attempts   int        `json:"attempts"`
+	RouteID    string     `json:"route_id,omitempty"`
+	Result     *JobResult `json:"result,omitempty"`
+	Error      string     `json:"error,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	UpdatedAt  time.Time  `json:"updated_at"`
+}
+
+// Done reports whether the job won't run anymore.
+func (j *Job) Done() bool {
+	return j.Status == JobSucceeded || j.Status == JobFailed
+}
+
+// AsyncConfig configures the completion jobs of a project.
+type AsyncConfig struct {
+	// MaxAttempts is the number of times a job is attempted before it fails, 5 if zero.
+	MaxAttempts int `json:"max_attempts,omitempty"`
+	// WebhookSecret signs webhooks, see webhook.Sign. Jobs can't have a webhook without one.
+	WebhookSecret string `json:"webhook_secret,omitempty"`
+	// WebhookHosts are the hosts webhooks can be sent to, e.g. "hooks.example.com" or
+	// "*.example.com" for its subdomains. Any public host is allowed if empty.
+	WebhookHosts []string `json:"webhook_hosts,omitempty"`
+}
+
+const defaultJobAttempts = 5
+
+// MaxAttemptsOrDefault returns the configured number of attempts or the default one.
+func (c AsyncConfig) MaxAttemptsOrDefault() int {
+	if c.MaxAttempts <= 0 {
+		return defaultJobAttempts
+	}
+	return c.MaxAttempts
+}
+
+// AllowsWebhookHost reports whether webhooks can be sent to host.
+func (c AsyncConfig) AllowsWebhookHost(host string) bool {
+	if len(c.WebhookHosts) == 0 {
+		return true
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, allowed := range c.WebhookHosts {
+		allowed = strings.ToLower(allowed)
+		if suffix, ok := strings.CutPrefix(allowed, "*."); ok {
+			if strings.HasSuffix(host, "."+suffix) {
+				return true
+			}
+		} else if host == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// JobQueue keeps jobs and hands queued ones to workers.
+type JobQueue interface {
+	// Enqueue stores job and queues it.
+	Enqueue(ctx context.Context, job *Job) error
+	// Dequeue waits up to timeout for a queued job, it returns nil if there is none.
+	// Queues shared by several replicas queue jobs again if their worker stops updating
+	// them before they are done.
+	Dequeue(ctx context.Context, timeout time.Duration) (*Job, error)
+	// UpdateJob stores the new state of job. Updates of running jobs tell the queue that
+	// their worker is still alive.
+	UpdateJob(ctx context.Context, job *Job) error
+	// GetJob returns the job with id, nil if there is none.
+	GetJob(ctx context.Context, id string) (*Job, error)
+}
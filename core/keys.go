@@ -0,0 +1,255 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+var ErrNoProviderKey = errors.New("no provider key available")
+
+// ProviderKey is one of the API keys a route can use, possibly of another provider account.
+type ProviderKey struct {
+	// ID identifies the key in logs, breakers and the admin API, the token is never shown.
+	ID    string
+	Token string
+}
+
+type KeySelection string
+
+const (
+	// KeyRoundRobin rotates through the keys of a route. It is the default.
+	KeyRoundRobin KeySelection = "round_robin"
+	// KeyLeastUsed picks the key that served the fewest requests.
+	KeyLeastUsed KeySelection = "least_used"
+)
+
+// KeyStore keeps the keys disabled at runtime, e.g. because they leaked.
+type KeyStore interface {
+	// DisabledKeys maps the IDs of disabled keys to the reason they were disabled.
+	DisabledKeys(ctx context.Context) (map[string]string, error)
+	DisableKey(ctx context.Context, keyID, reason string) error
+	EnableKey(ctx context.Context, keyID string) error
+}
+
+type KeyPoolConfig struct {
+	// RateLimitCooldown is how long a rate limited key is skipped, 1m if zero.
+	RateLimitCooldown time.Duration
+}
+
+// KeyPool picks the key used for each attempt of routes with several keys. Keys that are
+// disabled, have an open breaker or were recently rate limited are skipped, and requests
+// failing because of their key are retried with the next one on the same route.
+type KeyPool struct {
+	store   KeyStore
+	breaker BreakerService
+	cfg     KeyPoolConfig
+	now     func() time.Time
+
+	mu sync.Mutex
+	// next is the position of the next key of each route for round robin, by scoped route ID.
+	next map[string]int
+	// uses counts the requests sent with each key for least used selection.
+	uses map[string]int64
+	// limited is when each rate limited key can be used again.
+	limited map[string]time.Time
+}
+
+// NewKeyPool tracks keys with breaker. store may be nil if keys are never disabled at runtime.
+func NewKeyPool(store KeyStore, breaker BreakerService, cfg KeyPoolConfig) *KeyPool {
+	if cfg.RateLimitCooldown <= 0 {
+		cfg.RateLimitCooldown = time.Minute
+	}
+	return &KeyPool{
+		store:   store,
+		breaker: breaker,
+		cfg:     cfg,
+		now:     time.Now,
+		next:    make(map[string]int),
+		uses:    make(map[string]int64),
+		limited: make(map[string]time.Time),
+	}
+}
+
+type keyPoolContextKey struct{}
+
+// WithKeyPool makes routes with several keys use pool. Without one they try their keys in order.
+func WithKeyPool(ctx context.Context, pool *KeyPool) context.Context {
+	return context.WithValue(ctx, keyPoolContextKey{}, pool)
+}
+
+func keyPoolFrom(ctx context.Context) *KeyPool {
+	pool, _ := ctx.Value(keyPoolContextKey{}).(*KeyPool)
+	return pool
+}
+
+// DisabledKeys returns the keys disabled at runtime and why.
+func (p *KeyPool) DisabledKeys(ctx context.Context) (map[string]string, error) {
+	if p.store == nil {
+		return map[string]string{}, nil
+	}
+	return p.store.DisabledKeys(ctx)
+}
+
+func (p *KeyPool) DisableKey(ctx context.Context, keyID, reason string) error {
+	if p.store == nil {
+		return errors.New("keys can't be disabled without a key store")
+	}
+	return p.store.DisableKey(ctx, keyID, reason)
+}
+
+func (p *KeyPool) EnableKey(ctx context.Context, keyID string) error {
+	if p.store == nil {
+		return errors.New("keys can't be enabled without a key store")
+	}
+	return p.store.EnableKey(ctx, keyID)
+}
+
+func keyBreakerID(keyID string) string {
+	return "key:" + keyID
+}
+
+// call sends the attempt with the route's keys in selection order until one isn't
+// rejected because of the key. Keys for which throttled reports true are skipped.
+// The route passed to send has ProviderToken set to the key's token.
+func (p *KeyPool) call(ctx context.Context, route Route, throttled func(ProviderKey) bool, send func(Route, ProviderKey) (*http.Response, error)) (*http.Response, error) {
+	keys := p.order(ctx, route)
+	if len(keys) == 0 {
+		return nil, ErrNoProviderKey
+	}
+	// keys can be the route's own slice, it must not be filtered in place.
+	usable := make([]ProviderKey, 0, len(keys))
+	for _, key := range keys {
+		if !throttled(key) {
+			usable = append(usable, key)
+		}
+	}
+	if len(usable) == 0 {
+		return nil, errAboutToBeThrottled
+	}
+	keys = usable
+	var lastErr error
+	for i, key := range keys {
+		p.used(key.ID)
+		attempt := route
+		attempt.ProviderToken = key.Token
+		resp, err := send(attempt, key)
+
+		last := i == len(keys)-1
+		switch {
+		case errors.Is(err, ErrProviderRateLimited):
+			p.rateLimited(key.ID)
+		case err != nil:
+			p.report(ctx, key.ID, false)
+			return nil, err
+		case (resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden) && !last:
+			// The key was revoked or lacks access, another one may not.
+			resp.Body.Close()
+			p.report(ctx, key.ID, false)
+			err = errors.New(resp.Status)
+		default:
+			p.report(ctx, key.ID, true)
+			return resp, nil
+		}
+		log.Warn().
+			Str("route_id", route.ID).
+			Str("key_id", key.ID).
+			Str("error", err.Error()).
+			Msg("provider_key_failed")
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+// order returns the usable keys of route, the selected one first.
+func (p *KeyPool) order(ctx context.Context, route Route) []ProviderKey {
+	if p == nil {
+		return route.Keys
+	}
+	disabled, err := p.DisabledKeys(ctx)
+	if err != nil {
+		// Rather use a disabled key than none when the store is unavailable.
+		log.Err(err).Msg("failed to get disabled keys")
+	}
+	keys := p.rotate(scopedRouteID(ctx, route.ID), route, disabled)
+	// Breakers may call out to Redis, so they are checked without holding the lock.
+	usable := keys[:0]
+	for _, key := range keys {
+		state, err := p.breaker.GetState(ctx, keyBreakerID(key.ID))
+		if err != nil {
+			log.Err(err).Msg("failed to get breaker state")
+		}
+		if err != nil || state.ShouldAttempt() {
+			usable = append(usable, key)
+		}
+	}
+	return usable
+}
+
+// rotate returns the keys of route that aren't disabled or rate limited, starting with
+// the one picked by the route's selection. routeID is unique across projects.
+func (p *KeyPool) rotate(routeID string, route Route, disabled map[string]string) []ProviderKey {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := p.now()
+	keys := make([]ProviderKey, 0, len(route.Keys))
+	for _, key := range route.Keys {
+		if _, ok := disabled[key.ID]; ok {
+			continue
+		}
+		if until, ok := p.limited[key.ID]; ok && now.Before(until) {
+			continue
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return keys
+	}
+
+	start := 0
+	switch route.KeySelection {
+	case KeyLeastUsed:
+		for i, key := range keys {
+			if p.uses[key.ID] < p.uses[keys[start].ID] {
+				start = i
+			}
+		}
+	default:
+		start = p.next[routeID] % len(keys)
+		p.next[routeID] = start + 1
+	}
+	return append(keys[start:], keys[:start]...)
+}
+
+func (p *KeyPool) used(keyID string) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.uses[keyID]++
+}
+
+func (p *KeyPool) rateLimited(keyID string) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.limited[keyID] = p.now().Add(p.cfg.RateLimitCooldown)
+}
+
+func (p *KeyPool) report(ctx context.Context, keyID string, ok bool) {
+	if p == nil {
+		return
+	}
+	if ok {
+		p.breaker.ReportSuccess(ctx, keyBreakerID(keyID))
+		return
+	}
+	p.breaker.ReportFailure(ctx, keyBreakerID(keyID))
+}
@@ -0,0 +1,121 @@
+package core_test
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"magicrouter/core"
+	"magicrouter/inmem"
+	"magicrouter/mocks"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func statusResponse(status int) *http.Response {
+	return &http.Response{
+		StatusCode: status,
+		Status:     http.StatusText(status),
+		Body:       io.NopCloser(strings.NewReader(`{}`)),
+	}
+}
+
+func TestFallbackChatService_KeyPool(t *testing.T) {
+	keys := []core.ProviderKey{{ID: "a", Token: "sk-a"}, {ID: "b", Token: "sk-b"}, {ID: "c", Token: "sk-c"}}
+	req := json.RawMessage(`{}`)
+
+	t.Run("round robin", func(t *testing.T) {
+		routes := []core.Route{{ID: "route1", Provider: "openai", Model: "gpt-4o", Keys: keys}}
+		pool := core.NewKeyPool(nil, core.NoOpBreaker{}, core.KeyPoolConfig{})
+		ctx := core.WithKeyPool(context.Background(), pool)
+
+		mockService := mocks.NewChatService(t)
+		for _, token := range []string{"sk-a", "sk-b", "sk-c", "sk-a"} {
+			mockService.On("ChatCompletion", mock.Anything, req, "gpt-4o", token).
+				Return(statusResponse(http.StatusOK), nil).Once()
+		}
+		svc := core.NewFallbackChatService(routes, core.ChatServices{"openai": mockService}, core.NoOpBreaker{})
+		for i := 0; i < 4; i++ {
+			_, err := svc.ChatCompletion(ctx, req)
+			assert.NoError(t, err)
+		}
+	})
+
+	t.Run("round robin by project", func(t *testing.T) {
+		routes := []core.Route{{ID: "route1", Provider: "openai", Model: "gpt-4o", Keys: keys}}
+		ctx := core.WithKeyPool(context.Background(), core.NewKeyPool(nil, core.NoOpBreaker{}, core.KeyPoolConfig{}))
+
+		mockService := mocks.NewChatService(t)
+		mockService.On("ChatCompletion", mock.Anything, req, "gpt-4o", "sk-a").
+			Return(statusResponse(http.StatusOK), nil).Twice()
+		mockService.On("ChatCompletion", mock.Anything, req, "gpt-4o", "sk-b").
+			Return(statusResponse(http.StatusOK), nil).Once()
+		svc := core.NewFallbackChatService(routes, core.ChatServices{"openai": mockService}, core.NoOpBreaker{})
+		// Routes of different projects with the same ID rotate on their own.
+		for _, project := range []string{"project1", "project2", "project1"} {
+			_, err := svc.ChatCompletion(core.WithProject(ctx, project), req)
+			assert.NoError(t, err)
+		}
+	})
+
+	t.Run("rate limited and revoked keys are skipped", func(t *testing.T) {
+		routes := []core.Route{{ID: "route1", Provider: "openai", Model: "gpt-4o", Keys: keys}}
+		store := inmem.NewKeyStore()
+		pool := core.NewKeyPool(store, inmem.NewBreakerService(core.BreakerConfig{MaxFailures: 1, ResetTimeout: time.Minute}), core.KeyPoolConfig{})
+		ctx := core.WithKeyPool(context.Background(), pool)
+
+		mockService := mocks.NewChatService(t)
+		mockService.On("ChatCompletion", mock.Anything, req, "gpt-4o", "sk-a").
+			Return(nil, core.ErrProviderRateLimited).Once()
+		mockService.On("ChatCompletion", mock.Anything, req, "gpt-4o", "sk-b").
+			Return(statusResponse(http.StatusUnauthorized), nil).Once()
+		mockService.On("ChatCompletion", mock.Anything, req, "gpt-4o", "sk-c").
+			Return(statusResponse(http.StatusOK), nil).Twice()
+		svc := core.NewFallbackChatService(routes, core.ChatServices{"openai": mockService}, core.NoOpBreaker{})
+
+		resp, err := svc.ChatCompletion(ctx, req)
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		// a is cooling down and b's breaker is open.
+		_, err = svc.ChatCompletion(ctx, req)
+		assert.NoError(t, err)
+
+		assert.NoError(t, pool.DisableKey(ctx, "c", "leaked"))
+		_, err = svc.ChatCompletion(ctx, req)
+		var fallbackErr core.FallbackError
+		assert.ErrorAs(t, err, &fallbackErr)
+		assert.True(t, fallbackErr.All(core.ErrNoProviderKey))
+	})
+
+	t.Run("least used", func(t *testing.T) {
+		routes := []core.Route{
+			{ID: "route1", Provider: "openai", Model: "gpt-4o", Keys: keys[:2], KeySelection: core.KeyLeastUsed},
+			{ID: "route2", Provider: "openai", Model: "gpt-4o-mini", Keys: keys[1:], KeySelection: core.KeyLeastUsed},
+		}
+		pool := core.NewKeyPool(nil, core.NoOpBreaker{}, core.KeyPoolConfig{})
+		ctx := core.WithKeyPool(context.Background(), pool)
+
+		mockService := mocks.NewChatService(t)
+		mockService.On("ChatCompletion", mock.Anything, req, "gpt-4o", "sk-a").
+			Return(nil, core.ErrProviderTimeout).Once()
+		mockService.On("ChatCompletion", mock.Anything, req, "gpt-4o-mini", "sk-b").
+			Return(statusResponse(http.StatusOK), nil).Once()
+		svc := core.NewFallbackChatService(routes, core.ChatServices{"openai": mockService}, core.NoOpBreaker{})
+
+		// Timeouts aren't the key's fault, the next route is attempted.
+		resp, err := svc.ChatCompletion(ctx, req)
+		assert.NoError(t, err)
+		assert.Equal(t, "route2", resp.Route.ID)
+		// a and b were used once each, a comes first.
+		mockService.On("ChatCompletion", mock.Anything, req, "gpt-4o", "sk-a").
+			Return(statusResponse(http.StatusOK), nil).Once()
+		resp, err = svc.ChatCompletion(ctx, req)
+		assert.NoError(t, err)
+		assert.Equal(t, "route1", resp.Route.ID)
+	})
+}
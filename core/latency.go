@@ -0,0 +1,183 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"math/rand"
+	"net/http"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/tidwall/gjson"
+)
+
+// LatencyStats are exponentially weighted moving averages of a route's performance.
+type LatencyStats struct {
+	// Latency is the time until the response was fully received.
+	Latency time.Duration
+	// TTFT is the time until the first byte of the body was received.
+	TTFT    time.Duration
+	Samples int64
+}
+
+type LatencyStore interface {
+	GetLatency(ctx context.Context, routeIDs []string) (map[string]LatencyStats, error)
+	ObserveLatency(ctx context.Context, routeID string, latency, ttft time.Duration) error
+}
+
+type LatencyConfig struct {
+	// ExplorationRate is the probability (0-1) of trying a random route of a tier first,
+	// so that routes which were slow get sampled again once they recover.
+	ExplorationRate float64
+	// MinSamples is the number of samples before a route's stats are trusted.
+	// Routes with fewer samples are tried first to gather them.
+	MinSamples int64
+	// FailurePenalty is recorded as the latency of failed attempts that were faster,
+	// so that failing routes aren't ranked fastest. Defaults to 10s.
+	FailurePenalty time.Duration
+}
+
+const defaultFailurePenalty = 10 * time.Second
+
+// LatencyStrategy orders routes of the same priority by their observed performance.
+// Streaming requests are ordered by time to first token, others by latency.
+type LatencyStrategy struct {
+	store LatencyStore
+	cfg   LatencyConfig
+	rand  func() float64
+	// project scopes the stats, route IDs are only unique within a project.
+	project string
+}
+
+func NewLatencyStrategy(store LatencyStore, cfg LatencyConfig) *LatencyStrategy {
+	return &LatencyStrategy{
+		store: store,
+		cfg:   cfg,
+		rand:  rand.Float64,
+	}
+}
+
+// ForProject returns the strategy for the routes of projectID.
+func (s *LatencyStrategy) ForProject(projectID string) *LatencyStrategy {
+	scoped := *s
+	scoped.project = projectID
+	return &scoped
+}
+
+// statsID is the ID routes are observed with in the store.
+func (s *LatencyStrategy) statsID(route Route) string {
+	if s.project == "" {
+		return route.ID
+	}
+	return s.project + "/" + route.ID
+}
+
+func (s *LatencyStrategy) Order(ctx context.Context, req json.RawMessage, routes []Route) []Route {
+	ids := make([]string, len(routes))
+	for i, route := range routes {
+		ids[i] = s.statsID(route)
+	}
+	stats, err := s.store.GetLatency(ctx, ids)
+	if err != nil {
+		log.Err(err).Msg("failed to get route latency")
+		return routes
+	}
+
+	stream := gjson.GetBytes(req, "stream").Bool()
+	score := func(route Route) (time.Duration, bool) {
+		st, ok := stats[s.statsID(route)]
+		if !ok || st.Samples < s.cfg.MinSamples {
+			return 0, false
+		}
+		if stream {
+			return st.TTFT, true
+		}
+		return st.Latency, true
+	}
+
+	ordered := slices.Clone(routes)
+	for _, tier := range tiers(ordered) {
+		tier := ordered[tier[0]:tier[1]]
+		if len(tier) < 2 {
+			continue
+		}
+		sort.SliceStable(tier, func(i, j int) bool {
+			si, iok := score(tier[i])
+			sj, jok := score(tier[j])
+			if iok != jok {
+				return !iok
+			}
+			return si < sj
+		})
+		if s.rand() < s.cfg.ExplorationRate {
+			pick := int(s.rand() * float64(len(tier)))
+			explored := tier[pick]
+			copy(tier[1:pick+1], tier[:pick])
+			tier[0] = explored
+		}
+	}
+	return ordered
+}
+
+// Observe records the latency of successful responses once their body has been read to the end.
+// Other responses are penalised as failures.
+func (s *LatencyStrategy) Observe(route Route, start time.Time, resp *http.Response) {
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		s.ObserveFailure(route, start)
+		return
+	}
+	resp.Body = &timedBody{
+		ReadCloser: resp.Body,
+		start:      start,
+		done: func(latency, ttft time.Duration) {
+			s.record(route, latency, ttft)
+		},
+	}
+}
+
+// ObserveFailure records a failed attempt as taking at least the failure penalty.
+func (s *LatencyStrategy) ObserveFailure(route Route, start time.Time) {
+	penalty := s.cfg.FailurePenalty
+	if penalty <= 0 {
+		penalty = defaultFailurePenalty
+	}
+	latency := max(time.Since(start), penalty)
+	s.record(route, latency, latency)
+}
+
+func (s *LatencyStrategy) record(route Route, latency, ttft time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := s.store.ObserveLatency(ctx, s.statsID(route), latency, ttft); err != nil {
+		log.Err(err).Msg("failed to record route latency")
+	}
+}
+
+// timedBody measures the time to the first byte and to the end of a body.
+// Bodies closed before the end aren't reported as they'd skew the latency.
+type timedBody struct {
+	io.ReadCloser
+	start    time.Time
+	ttft     time.Duration
+	reported bool
+	done     func(latency, ttft time.Duration)
+}
+
+func (b *timedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 && b.ttft == 0 {
+		b.ttft = time.Since(b.start)
+	}
+	if err == io.EOF && !b.reported {
+		b.reported = true
+		latency := time.Since(b.start)
+		if b.ttft == 0 {
+			b.ttft = latency
+		}
+		b.done(latency, b.ttft)
+	}
+	return n, err
+}
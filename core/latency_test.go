@@ -0,0 +1,122 @@
+package core_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"magicrouter/core"
+	"magicrouter/inmem"
+	"magicrouter/mocks"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func routeIDs(routes []core.Route) []string {
+	ids := make([]string, len(routes))
+	for i, route := range routes {
+		ids[i] = route.ID
+	}
+	return ids
+}
+
+func TestLatencyStrategy_Order(t *testing.T) {
+	ctx := context.Background()
+	routes := []core.Route{
+		{ID: "route1", Priority: 1},
+		{ID: "route2", Priority: 1},
+		{ID: "route3", Priority: 1},
+		{ID: "route4", Priority: 2},
+	}
+	store := inmem.NewLatencyStore(0.5)
+	store.ObserveLatency(ctx, "route1", 3*time.Second, 100*time.Millisecond)
+	store.ObserveLatency(ctx, "route2", 1*time.Second, 500*time.Millisecond)
+	store.ObserveLatency(ctx, "route3", 2*time.Second, 300*time.Millisecond)
+	store.ObserveLatency(ctx, "route4", 1*time.Millisecond, 1*time.Millisecond)
+	strategy := core.NewLatencyStrategy(store, core.LatencyConfig{})
+
+	t.Run("by latency within tier", func(t *testing.T) {
+		ordered := strategy.Order(ctx, json.RawMessage(`{}`), routes)
+		assert.Equal(t, []string{"route2", "route3", "route1", "route4"}, routeIDs(ordered))
+	})
+
+	t.Run("by time to first token when streaming", func(t *testing.T) {
+		ordered := strategy.Order(ctx, json.RawMessage(`{"stream": true}`), routes)
+		assert.Equal(t, []string{"route1", "route3", "route2", "route4"}, routeIDs(ordered))
+	})
+
+	t.Run("routes without enough samples first", func(t *testing.T) {
+		strategy := core.NewLatencyStrategy(store, core.LatencyConfig{MinSamples: 2})
+		store.ObserveLatency(ctx, "route1", 3*time.Second, 100*time.Millisecond)
+		store.ObserveLatency(ctx, "route3", 2*time.Second, 300*time.Millisecond)
+		ordered := strategy.Order(ctx, json.RawMessage(`{}`), routes)
+		assert.Equal(t, []string{"route2", "route3", "route1", "route4"}, routeIDs(ordered))
+	})
+
+	t.Run("does not modify routes", func(t *testing.T) {
+		strategy.Order(ctx, json.RawMessage(`{}`), routes)
+		assert.Equal(t, []string{"route1", "route2", "route3", "route4"}, routeIDs(routes))
+	})
+}
+
+func TestLatencyStrategy_Observe(t *testing.T) {
+	store := inmem.NewLatencyStore(0.5)
+	mockService := mocks.NewChatService(t)
+	mockService.
+		On("ChatCompletion", mock.Anything, mock.Anything, "gpt-4", "test").
+		Return(&http.Response{
+			StatusCode: http.StatusOK,
+			Body:       io.NopCloser(strings.NewReader(`{}`)),
+		}, nil).
+		Once()
+	svc := core.NewFallbackChatService(
+		[]core.Route{{ID: "route1", Provider: "openai", Model: "gpt-4", ProviderToken: "test"}},
+		core.ChatServices{"openai": mockService},
+		core.NoOpBreaker{},
+		core.WithStrategy(core.NewLatencyStrategy(store, core.LatencyConfig{})),
+	)
+	resp, err := svc.ChatCompletion(context.Background(), json.RawMessage(`{}`))
+	assert.NoError(t, err)
+
+	stats, _ := store.GetLatency(context.Background(), []string{"route1"})
+	assert.Empty(t, stats, "latency is recorded once the body is read")
+	io.ReadAll(resp.Body)
+	stats, _ = store.GetLatency(context.Background(), []string{"route1"})
+	assert.Equal(t, int64(1), stats["route1"].Samples)
+}
+
+func TestLatencyStrategy_ObserveFailures(t *testing.T) {
+	ctx := context.Background()
+	store := inmem.NewLatencyStore(1)
+	routes := []core.Route{
+		{ID: "route1", Provider: "openai", Model: "gpt-4"},
+		{ID: "route2", Provider: "openai", Model: "gpt-4o"},
+	}
+	mockService := mocks.NewChatService(t)
+	mockService.On("ChatCompletion", mock.Anything, mock.Anything, "gpt-4", "").
+		Return(nil, errors.New("timeout")).Once()
+	mockService.On("ChatCompletion", mock.Anything, mock.Anything, "gpt-4o", "").
+		Return(&http.Response{
+			StatusCode: http.StatusInternalServerError,
+			Body:       io.NopCloser(strings.NewReader(`{}`)),
+		}, nil).Once()
+	strategy := core.NewLatencyStrategy(store, core.LatencyConfig{FailurePenalty: time.Minute})
+	svc := core.NewFallbackChatService(routes, core.ChatServices{"openai": mockService}, core.NoOpBreaker{},
+		core.WithStrategy(strategy.ForProject("project1")))
+
+	resp, err := svc.ChatCompletion(ctx, json.RawMessage(`{}`))
+	assert.NoError(t, err)
+	assert.Equal(t, "route2", resp.Route.ID)
+
+	// Stats are kept per project.
+	stats, _ := store.GetLatency(ctx, []string{"route1", "project1/route1", "project1/route2"})
+	assert.NotContains(t, stats, "route1")
+	assert.Equal(t, time.Minute, stats["project1/route1"].Latency)
+	assert.Equal(t, time.Minute, stats["project1/route2"].Latency, "error responses are failures")
+}
@@ -0,0 +1,221 @@
+package core
+
+import (
+	"container/heap"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"magicrouter/metrics"
+)
+
+var ErrConcurrencyLimited = errors.New("concurrency limit reached")
+
+// ConcurrencyLimit caps the requests in flight. Requests over the limit wait in a
+// bounded queue, highest priority first, until a slot frees up or their deadline passes.
+type ConcurrencyLimit struct {
+	// MaxInFlight is the maximum number of concurrent requests. Zero means unlimited.
+	MaxInFlight int `json:"max_in_flight"`
+	// MaxQueue is the number of requests that can wait for a slot. Further requests fail right away.
+	MaxQueue int `json:"max_queue,omitempty"`
+	// MaxWait is how long requests wait at most. Defaults to 30s, and to 1s for routes
+	// as requests waiting for a route fail over to the next one once it's passed.
+	MaxWait Duration `json:"max_wait,omitempty"`
+}
+
+const (
+	defaultMaxWait      = 30 * time.Second
+	defaultRouteMaxWait = time.Second
+)
+
+type priorityContextKey struct{}
+
+// WithPriority sets the priority of the request, higher priority requests leave queues first.
+func WithPriority(ctx context.Context, priority int) context.Context {
+	return context.WithValue(ctx, priorityContextKey{}, priority)
+}
+
+func priorityFrom(ctx context.Context) int {
+	priority, _ := ctx.Value(priorityContextKey{}).(int)
+	return priority
+}
+
+type waiter struct {
+	priority int
+	seq      uint64
+	// ready is closed once the waiter was handed a slot.
+	ready chan struct{}
+	index int
+}
+
+// waitQueue is a heap of waiters, by priority and then arrival.
+type waitQueue []*waiter
+
+func (q waitQueue) Len() int { return len(q) }
+func (q waitQueue) Less(i, j int) bool {
+	if q[i].priority != q[j].priority {
+		return q[i].priority > q[j].priority
+	}
+	return q[i].seq < q[j].seq
+}
+func (q waitQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+func (q *waitQueue) Push(x any) {
+	w := x.(*waiter)
+	w.index = len(*q)
+	*q = append(*q, w)
+}
+func (q *waitQueue) Pop() any {
+	old := *q
+	w := old[len(old)-1]
+	old[len(old)-1] = nil
+	*q = old[:len(old)-1]
+	w.index = -1
+	return w
+}
+
+// Limiter admits requests up to a ConcurrencyLimit.
+type Limiter struct {
+	name string
+
+	mu       sync.Mutex
+	limit    ConcurrencyLimit
+	inflight int
+	queue    waitQueue
+	seq      uint64
+}
+
+// Acquire waits for a slot and returns the function releasing it.
+// It fails with ErrConcurrencyLimited if the queue is full or the wait is too long.
+func (l *Limiter) Acquire(ctx context.Context) (func(), error) {
+	l.mu.Lock()
+	if l.limit.MaxInFlight <= 0 || (l.inflight < l.limit.MaxInFlight && len(l.queue) == 0) {
+		l.inflight++
+		l.mu.Unlock()
+		return l.release, nil
+	}
+	if len(l.queue) >= l.limit.MaxQueue {
+		l.mu.Unlock()
+		metrics.QueueRejected.Add(l.name, 1)
+		return nil, fmt.Errorf("%w: %s queue is full", ErrConcurrencyLimited, l.name)
+	}
+	l.seq++
+	w := &waiter{priority: priorityFrom(ctx), seq: l.seq, ready: make(chan struct{})}
+	heap.Push(&l.queue, w)
+	maxWait := time.Duration(l.limit.MaxWait)
+	if maxWait <= 0 {
+		maxWait = defaultMaxWait
+	}
+	l.mu.Unlock()
+
+	start := time.Now()
+	defer func() {
+		metrics.Queued.Add(l.name, 1)
+		metrics.QueueWaitMS.Add(l.name, time.Since(start).Milliseconds())
+	}()
+	wctx, cancel := context.WithTimeout(ctx, maxWait)
+	defer cancel()
+	select {
+	case <-w.ready:
+		return l.release, nil
+	case <-wctx.Done():
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if w.index < 0 {
+		// The slot was handed over while giving up, pass it on.
+		l.releaseLocked()
+	} else {
+		heap.Remove(&l.queue, w.index)
+	}
+	metrics.QueueRejected.Add(l.name, 1)
+	return nil, fmt.Errorf("%w: timed out waiting in %s queue: %w", ErrConcurrencyLimited, l.name, wctx.Err())
+}
+
+func (l *Limiter) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.releaseLocked()
+}
+
+// releaseLocked hands the slot to the first waiter, if any.
+func (l *Limiter) releaseLocked() {
+	if len(l.queue) > 0 && (l.limit.MaxInFlight <= 0 || l.inflight <= l.limit.MaxInFlight) {
+		w := heap.Pop(&l.queue).(*waiter)
+		close(w.ready)
+		return
+	}
+	l.inflight--
+}
+
+// Limiters holds a Limiter per project and route.
+type Limiters struct {
+	mu       sync.Mutex
+	limiters map[string]*Limiter
+}
+
+func NewLimiters() *Limiters {
+	return &Limiters{limiters: make(map[string]*Limiter)}
+}
+
+// Get returns the limiter named name, applying limit as configs can change at any time.
+func (l *Limiters) Get(name string, limit ConcurrencyLimit) *Limiter {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	limiter, ok := l.limiters[name]
+	if !ok {
+		limiter = &Limiter{name: name}
+		l.limiters[name] = limiter
+	}
+	limiter.mu.Lock()
+	limiter.limit = limit
+	limiter.mu.Unlock()
+	return limiter
+}
+
+type limitersContextKey struct{}
+
+// WithLimiters makes routes with a concurrency limit use limiters.
+func WithLimiters(ctx context.Context, limiters *Limiters) context.Context {
+	return context.WithValue(ctx, limitersContextKey{}, limiters)
+}
+
+// acquireRoute takes a slot of route's limiter if it has a limit and there are limiters
+// in ctx. The release function is nil otherwise. Requests only wait briefly by default,
+// rather than for a busy route they fail over to the next one.
+func acquireRoute(ctx context.Context, route Route) (func(), error) {
+	limiters, _ := ctx.Value(limitersContextKey{}).(*Limiters)
+	if limiters == nil || route.Concurrency == nil {
+		return nil, nil
+	}
+	limit := *route.Concurrency
+	if limit.MaxWait <= 0 {
+		limit.MaxWait = Duration(defaultRouteMaxWait)
+	}
+	return limiters.Get("route:"+scopedRouteID(ctx, route.ID), limit).Acquire(ctx)
+}
+
+// releasingBody releases a concurrency slot once the response body is closed, streams hold it until done.
+type releasingBody struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (b *releasingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
+
+func releaseOnClose(resp *http.Response, release func()) {
+	resp.Body = &releasingBody{ReadCloser: resp.Body, release: release}
+}
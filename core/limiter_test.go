@@ -0,0 +1,148 @@
+package core_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"magicrouter/core"
+	"magicrouter/mocks"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestLimiter(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("admits higher priorities first", func(t *testing.T) {
+		limiter := core.NewLimiters().Get("project:p1", core.ConcurrencyLimit{MaxInFlight: 1, MaxQueue: 3})
+		release, err := limiter.Acquire(ctx)
+		assert.NoError(t, err)
+
+		admitted := make(chan int, 3)
+		for _, priority := range []int{0, 5, 1} {
+			go func(priority int) {
+				release, err := limiter.Acquire(core.WithPriority(ctx, priority))
+				assert.NoError(t, err)
+				admitted <- priority
+				release()
+			}(priority)
+			// Queue the waiters in order.
+			time.Sleep(10 * time.Millisecond)
+		}
+		release()
+		assert.Equal(t, 5, <-admitted)
+		assert.Equal(t, 1, <-admitted)
+		assert.Equal(t, 0, <-admitted)
+	})
+
+	t.Run("rejects when the queue is full", func(t *testing.T) {
+		limiter := core.NewLimiters().Get("project:p1", core.ConcurrencyLimit{MaxInFlight: 1})
+		release, err := limiter.Acquire(ctx)
+		assert.NoError(t, err)
+		defer release()
+
+		_, err = limiter.Acquire(ctx)
+		assert.ErrorIs(t, err, core.ErrConcurrencyLimited)
+	})
+
+	t.Run("waiting counts against the deadline", func(t *testing.T) {
+		limiter := core.NewLimiters().Get("project:p1", core.ConcurrencyLimit{MaxInFlight: 1, MaxQueue: 1})
+		release, err := limiter.Acquire(ctx)
+		assert.NoError(t, err)
+
+		tctx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+		defer cancel()
+		_, err = limiter.Acquire(tctx)
+		assert.ErrorIs(t, err, core.ErrConcurrencyLimited)
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+		// The slot isn't lost to the request that gave up.
+		release()
+		release, err = limiter.Acquire(ctx)
+		assert.NoError(t, err)
+		release()
+	})
+}
+
+func TestFallbackChatService_RouteConcurrency(t *testing.T) {
+	routes := []core.Route{
+		{ID: "route1", Priority: 1, Provider: "openai", Model: "gpt-4o", Concurrency: &core.ConcurrencyLimit{MaxInFlight: 1}},
+		{ID: "route2", Priority: 2, Provider: "openai", Model: "gpt-4o-mini"},
+	}
+	req := json.RawMessage(`{}`)
+	ctx := core.WithLimiters(context.Background(), core.NewLimiters())
+
+	mockService := mocks.NewChatService(t)
+	mockService.On("ChatCompletion", mock.Anything, req, "gpt-4o", "").
+		Return(statusResponse(http.StatusOK), nil).Once()
+	mockService.On("ChatCompletion", mock.Anything, req, "gpt-4o-mini", "").
+		Return(statusResponse(http.StatusOK), nil).Once()
+	svc := core.NewFallbackChatService(routes, core.ChatServices{"openai": mockService}, core.NoOpBreaker{})
+
+	first, err := svc.ChatCompletion(ctx, req)
+	assert.NoError(t, err)
+	assert.Equal(t, "route1", first.Route.ID)
+	// route1 is busy until the first response is closed.
+	second, err := svc.ChatCompletion(ctx, req)
+	assert.NoError(t, err)
+	assert.Equal(t, "route2", second.Route.ID)
+
+	first.Body.Close()
+	mockService.On("ChatCompletion", mock.Anything, req, "gpt-4o", "").
+		Return(statusResponse(http.StatusOK), nil).Once()
+	third, err := svc.ChatCompletion(ctx, req)
+	assert.NoError(t, err)
+	assert.Equal(t, "route1", third.Route.ID)
+}
+
+func TestFallbackChatService_RouteQueueFailover(t *testing.T) {
+	routes := []core.Route{
+		{ID: "route1", Priority: 1, Provider: "openai", Model: "gpt-4o", Concurrency: &core.ConcurrencyLimit{MaxInFlight: 1, MaxQueue: 1}},
+		{ID: "route2", Priority: 2, Provider: "openai", Model: "gpt-4o-mini"},
+	}
+	req := json.RawMessage(`{}`)
+	ctx := core.WithLimiters(context.Background(), core.NewLimiters())
+
+	mockService := mocks.NewChatService(t)
+	mockService.On("ChatCompletion", mock.Anything, req, "gpt-4o", "").
+		Return(statusResponse(http.StatusOK), nil).Once()
+	mockService.On("ChatCompletion", mock.Anything, req, "gpt-4o-mini", "").
+		Return(statusResponse(http.StatusOK), nil).Once()
+	svc := core.NewFallbackChatService(routes, core.ChatServices{"openai": mockService}, core.NoOpBreaker{})
+
+	first, err := svc.ChatCompletion(ctx, req)
+	assert.NoError(t, err)
+	defer first.Body.Close()
+
+	// Queued for the busy route1 without a deadline, the request fails over after a short wait.
+	start := time.Now()
+	second, err := svc.ChatCompletion(ctx, req)
+	assert.NoError(t, err)
+	assert.Equal(t, "route2", second.Route.ID)
+	assert.Less(t, time.Since(start), 5*time.Second)
+}
+
+func TestFallbackChatService_RouteConcurrencyByProject(t *testing.T) {
+	routes := []core.Route{
+		{ID: "primary", Provider: "openai", Model: "gpt-4o", Concurrency: &core.ConcurrencyLimit{MaxInFlight: 1}},
+	}
+	req := json.RawMessage(`{}`)
+	limiters := core.WithLimiters(context.Background(), core.NewLimiters())
+
+	mockService := mocks.NewChatService(t)
+	mockService.On("ChatCompletion", mock.Anything, req, "gpt-4o", "").
+		Return(statusResponse(http.StatusOK), nil).Twice()
+	svc := core.NewFallbackChatService(routes, core.ChatServices{"openai": mockService}, core.NoOpBreaker{})
+
+	first, err := svc.ChatCompletion(core.WithProject(limiters, "project1"), req)
+	assert.NoError(t, err)
+	defer first.Body.Close()
+	// Another project's route of the same name has slots of its own.
+	second, err := svc.ChatCompletion(core.WithProject(limiters, "project2"), req)
+	assert.NoError(t, err)
+	defer second.Body.Close()
+}
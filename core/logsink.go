@@ -0,0 +1,20 @@
+package core
+
+import (
+	"context"
+
+	"github.com/rs/zerolog/log"
+)
+
+// LogSink receives structured records of requests, such as shadow comparisons.
+type LogSink interface {
+	Write(ctx context.Context, event string, record any) error
+}
+
+// ZerologSink writes records to the global zerolog logger.
+type ZerologSink struct{}
+
+func (ZerologSink) Write(ctx context.Context, event string, record any) error {
+	log.Info().Interface("record", record).Msg(event)
+	return nil
+}
@@ -0,0 +1,436 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+var ErrPIIDetected = errors.New("request contains personal data")
+
+// PIIKind is a kind of personal data the redactor detects.
+type PIIKind string
+
+const (
+	PIIEmail      PIIKind = "email"
+	PIIPhone      PIIKind = "phone"
+	PIICreditCard PIIKind = "credit_card"
+	PIIIBAN       PIIKind = "iban"
+)
+
+// PIIAction is what happens to requests containing personal data.
+type PIIAction string
+
+const (
+	// PIIBlock rejects the request.
+	PIIBlock PIIAction = "block"
+	// PIIMask replaces personal data with its kind, e.g. [EMAIL].
+	PIIMask PIIAction = "mask"
+	// PIITokenize replaces personal data with numbered placeholders, e.g. [EMAIL_1],
+	// which are replaced with the originals in the response.
+	PIITokenize PIIAction = "tokenize"
+)
+
+// PIIPattern is a custom kind of personal data.
+type PIIPattern struct {
+	Name    string `json:"name"`
+	Pattern string `json:"pattern"`
+}
+
+// PIIPolicy configures the detection of personal data in the messages of a project.
+type PIIPolicy struct {
+	Action PIIAction `json:"action"`
+	// Kinds are the built-in kinds to detect. All of them when empty.
+	Kinds  []PIIKind    `json:"kinds,omitempty"`
+	Custom []PIIPattern `json:"custom,omitempty"`
+}
+
+type piiDetector struct {
+	kind  PIIKind
+	re    *regexp.Regexp
+	valid func(string) bool
+}
+
+// Built-in detectors, in order of precedence when matches overlap.
+var builtinDetectors = []piiDetector{
+	{kind: PIICreditCard, re: regexp.MustCompile(`\b(?:\d[ -]?){12,18}\d\b`), valid: luhn},
+	{kind: PIIIBAN, re: regexp.MustCompile(`\b[A-Z]{2}\d{2}(?: ?[A-Z0-9]){11,30}\b`), valid: validIBAN},
+	{kind: PIIEmail, re: regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`)},
+	{kind: PIIPhone, re: regexp.MustCompile(`(?:\+|\b)\d[\d ().-]{6,}\d\b`), valid: validPhone},
+}
+
+// PIIMatch is personal data found in a text.
+type PIIMatch struct {
+	Kind       PIIKind
+	Start, End int
+}
+
+// Redactor finds personal data according to a policy.
+type Redactor struct {
+	action    PIIAction
+	detectors []piiDetector
+}
+
+// NewRedactor compiles the custom patterns of policy.
+func NewRedactor(policy PIIPolicy) (*Redactor, error) {
+	r := &Redactor{action: policy.Action}
+	for _, p := range policy.Custom {
+		re, err := regexp.Compile(p.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern for %s: %w", p.Name, err)
+		}
+		r.detectors = append(r.detectors, piiDetector{kind: PIIKind(p.Name), re: re})
+	}
+	for _, d := range builtinDetectors {
+		if len(policy.Kinds) == 0 || slices.Contains(policy.Kinds, d.kind) {
+			r.detectors = append(r.detectors, d)
+		}
+	}
+	return r, nil
+}
+
+// Find returns the non-overlapping personal data in text, in order.
+func (r *Redactor) Find(text string) []PIIMatch {
+	var matches []PIIMatch
+	overlaps := func(start, end int) bool {
+		return slices.ContainsFunc(matches, func(m PIIMatch) bool {
+			return start < m.End && m.Start < end
+		})
+	}
+	for _, d := range r.detectors {
+		for _, loc := range d.re.FindAllStringIndex(text, -1) {
+			if d.valid != nil && !d.valid(text[loc[0]:loc[1]]) {
+				continue
+			}
+			if !overlaps(loc[0], loc[1]) {
+				matches = append(matches, PIIMatch{Kind: d.kind, Start: loc[0], End: loc[1]})
+			}
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool { return matches[i].Start < matches[j].Start })
+	return matches
+}
+
+// Mask replaces the personal data in text with its kind.
+func (r *Redactor) Mask(text string) string {
+	return r.replace(text, func(m PIIMatch, _ string) string {
+		return "[" + strings.ToUpper(string(m.Kind)) + "]"
+	})
+}
+
+func (r *Redactor) replace(text string, with func(m PIIMatch, original string) string) string {
+	matches := r.Find(text)
+	if len(matches) == 0 {
+		return text
+	}
+	var out strings.Builder
+	last := 0
+	for _, m := range matches {
+		out.WriteString(text[last:m.Start])
+		out.WriteString(with(m, text[m.Start:m.End]))
+		last = m.End
+	}
+	out.WriteString(text[last:])
+	return out.String()
+}
+
+// Redact applies the policy to the message contents of a chat completion request.
+// It fails with ErrPIIDetected if the policy blocks the personal data found.
+// The returned vault restores tokenized data, it is empty for other actions.
+func (r *Redactor) Redact(req json.RawMessage) (json.RawMessage, *PIIVault, error) {
+	vault := &PIIVault{originals: make(map[string]string)}
+	tokens := make(map[string]string)
+	counts := make(map[PIIKind]int)
+
+	redact := func(text string) (string, error) {
+		var blocked []PIIKind
+		redacted := r.replace(text, func(m PIIMatch, original string) string {
+			switch r.action {
+			case PIIBlock:
+				blocked = append(blocked, m.Kind)
+				return original
+			case PIITokenize:
+				token, ok := tokens[original]
+				if !ok {
+					counts[m.Kind]++
+					token = fmt.Sprintf("[%s_%d]", strings.ToUpper(string(m.Kind)), counts[m.Kind])
+					tokens[original] = token
+					vault.originals[token] = original
+				}
+				return token
+			default:
+				return "[" + strings.ToUpper(string(m.Kind)) + "]"
+			}
+		})
+		if len(blocked) > 0 {
+			return "", fmt.Errorf("%w: %v", ErrPIIDetected, slices.Compact(blocked))
+		}
+		return redacted, nil
+	}
+
+	var err error
+	for i, msg := range gjson.GetBytes(req, "messages").Array() {
+		content := msg.Get("content")
+		if content.Type == gjson.String {
+			if req, err = redactField(req, fmt.Sprintf("messages.%d.content", i), content.String(), redact); err != nil {
+				return nil, nil, err
+			}
+			continue
+		}
+		for j, part := range content.Array() {
+			if part.Get("type").String() != "text" {
+				continue
+			}
+			if req, err = redactField(req, fmt.Sprintf("messages.%d.content.%d.text", i, j), part.Get("text").String(), redact); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+	return req, vault, nil
+}
+
+func redactField(req json.RawMessage, path, text string, redact func(string) (string, error)) (json.RawMessage, error) {
+	redacted, err := redact(text)
+	if err != nil {
+		return nil, err
+	}
+	if redacted == text {
+		return req, nil
+	}
+	req, err = sjson.SetBytes(req, path, redacted)
+	if err != nil {
+		return nil, fmt.Errorf("failed to redact %s: %w", path, err)
+	}
+	return req, nil
+}
+
+// PIIVault holds the originals of tokenized personal data.
+type PIIVault struct {
+	originals map[string]string
+}
+
+// Empty reports whether nothing was tokenized.
+func (v *PIIVault) Empty() bool {
+	return len(v.originals) == 0
+}
+
+// Restore replaces the tokens in text with the originals.
+func (v *PIIVault) Restore(text string) string {
+	if v.Empty() || !strings.Contains(text, "[") {
+		return text
+	}
+	pairs := make([]string, 0, 2*len(v.originals))
+	for token, original := range v.originals {
+		pairs = append(pairs, token, original)
+	}
+	return strings.NewReplacer(pairs...).Replace(text)
+}
+
+// pending returns the length of the suffix of text that could be the start of a token.
+func (v *PIIVault) pending(text string) int {
+	i := strings.LastIndexByte(text, '[')
+	if i < 0 || strings.IndexByte(text[i:], ']') >= 0 {
+		return 0
+	}
+	suffix := text[i:]
+	for token := range v.originals {
+		if strings.HasPrefix(token, suffix) {
+			return len(suffix)
+		}
+	}
+	return 0
+}
+
+type (
+	redactorContextKey  struct{}
+	redactionContextKey struct{}
+)
+
+// redaction is where the redactor of a request is kept once it is known, with the logger
+// masking personal data in its records.
+type redaction struct {
+	out      io.Writer
+	redactor atomic.Pointer[Redactor]
+	logger   atomic.Pointer[zerolog.Logger]
+}
+
+// WithRedactor attaches the redactor of a project to ctx for RedactingSink and Logger.
+// It also applies to the contexts ctx was derived from since WithRedaction.
+func WithRedactor(ctx context.Context, r *Redactor) context.Context {
+	if slot, ok := ctx.Value(redactionContextKey{}).(*redaction); ok {
+		logger := log.Logger.Output(redactingWriter{w: slot.out, r: r})
+		slot.logger.Store(&logger)
+		slot.redactor.Store(r)
+	}
+	return context.WithValue(ctx, redactorContextKey{}, r)
+}
+
+// WithRedaction prepares ctx for a request whose redactor is only known later on, so
+// that what is logged with ctx once the request is over is redacted too. Masked records
+// are written to out, which should be the output of the global logger.
+func WithRedaction(ctx context.Context, out io.Writer) context.Context {
+	return context.WithValue(ctx, redactionContextKey{}, &redaction{out: out})
+}
+
+func redactorFrom(ctx context.Context) (*Redactor, bool) {
+	if r, ok := ctx.Value(redactorContextKey{}).(*Redactor); ok {
+		return r, true
+	}
+	if slot, ok := ctx.Value(redactionContextKey{}).(*redaction); ok {
+		if r := slot.redactor.Load(); r != nil {
+			return r, true
+		}
+	}
+	return nil, false
+}
+
+// Logger returns the logger for records about the request of ctx. Personal data in
+// them is masked once a redactor was attached to a context prepared with WithRedaction.
+func Logger(ctx context.Context) *zerolog.Logger {
+	if slot, ok := ctx.Value(redactionContextKey{}).(*redaction); ok {
+		if logger := slot.logger.Load(); logger != nil {
+			return logger
+		}
+	}
+	return &log.Logger
+}
+
+// redactingWriter masks personal data in the JSON records written to w.
+type redactingWriter struct {
+	w io.Writer
+	r *Redactor
+}
+
+func (w redactingWriter) Write(p []byte) (int, error) {
+	if _, err := w.w.Write(maskStrings(w.r, p)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// RedactingSink masks personal data in the string fields of records with the
+// redactor attached to the context before passing them on to Sink.
+type RedactingSink struct {
+	Sink LogSink
+}
+
+func (s RedactingSink) Write(ctx context.Context, event string, record any) error {
+	r, ok := redactorFrom(ctx)
+	if !ok {
+		return s.Sink.Write(ctx, event, record)
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to marshal record: %w", err)
+	}
+	return s.Sink.Write(ctx, event, json.RawMessage(maskStrings(r, data)))
+}
+
+// maskStrings masks every string value of a JSON document.
+func maskStrings(r *Redactor, data []byte) []byte {
+	var paths []string
+	var walk func(prefix string, v gjson.Result)
+	walk = func(prefix string, v gjson.Result) {
+		switch {
+		case v.IsObject() || v.IsArray():
+			i := 0
+			v.ForEach(func(key, value gjson.Result) bool {
+				k := key.String()
+				if v.IsArray() {
+					k = fmt.Sprint(i)
+				}
+				i++
+				walk(join(prefix, escapePath(k)), value)
+				return true
+			})
+		case v.Type == gjson.String && len(r.Find(v.String())) > 0:
+			paths = append(paths, prefix)
+		}
+	}
+	walk("", gjson.ParseBytes(data))
+	for _, path := range paths {
+		if masked, err := sjson.SetBytes(data, path, r.Mask(gjson.GetBytes(data, path).String())); err == nil {
+			data = masked
+		}
+	}
+	return data
+}
+
+func join(prefix, key string) string {
+	if prefix == "" {
+		return key
+	}
+	return prefix + "." + key
+}
+
+var pathEscaper = strings.NewReplacer(".", `\.`, "*", `\*`, "?", `\?`, "|", `\|`, "#", `\#`, "@", `\@`)
+
+func escapePath(key string) string {
+	return pathEscaper.Replace(key)
+}
+
+// luhn validates credit card numbers.
+func luhn(s string) bool {
+	var sum, n int
+	for i := len(s) - 1; i >= 0; i-- {
+		c := s[i]
+		if c < '0' || c > '9' {
+			continue
+		}
+		d := int(c - '0')
+		if n%2 == 1 {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		n++
+	}
+	return n >= 13 && sum%10 == 0
+}
+
+// validIBAN checks the length and the mod 97 checksum of an IBAN.
+func validIBAN(s string) bool {
+	s = strings.ReplaceAll(s, " ", "")
+	if len(s) < 15 || len(s) > 34 {
+		return false
+	}
+	var digits strings.Builder
+	for _, c := range s[4:] + s[:4] {
+		if c >= 'A' && c <= 'Z' {
+			fmt.Fprint(&digits, int(c-'A'+10))
+		} else {
+			digits.WriteRune(c)
+		}
+	}
+	n, ok := new(big.Int).SetString(digits.String(), 10)
+	return ok && new(big.Int).Mod(n, big.NewInt(97)).Int64() == 1
+}
+
+// validPhone requires international numbers to have at least 7 digits and others 9.
+func validPhone(s string) bool {
+	digits := 0
+	for _, c := range s {
+		if c >= '0' && c <= '9' {
+			digits++
+		}
+	}
+	if strings.HasPrefix(s, "+") {
+		return digits >= 7 && digits <= 15
+	}
+	return digits >= 9 && digits <= 15
+}
@@ -0,0 +1,164 @@
+package core_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"magicrouter/core"
+	"magicrouter/mocks"
+	"magicrouter/sse"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/tidwall/gjson"
+)
+
+func TestRedactor_Mask(t *testing.T) {
+	r, err := core.NewRedactor(core.PIIPolicy{
+		Action: core.PIIMask,
+		Custom: []core.PIIPattern{{Name: "employee_id", Pattern: `EMP-\d{4}`}},
+	})
+	assert.NoError(t, err)
+
+	tests := []struct {
+		text string
+		want string
+	}{
+		{"mail jane.doe@example.com now", "mail [EMAIL] now"},
+		{"card 4111 1111 1111 1111 please", "card [CREDIT_CARD] please"},
+		{"not a card 4111 1111 1111 1112", "not a card 4111 1111 1111 1112"},
+		{"iban DE89 3704 0044 0532 0130 00", "iban [IBAN]"},
+		{"call +1 (415) 555-2671", "call [PHONE]"},
+		{"call 415-555-2671 or 0044 20 7946 0958", "call [PHONE] or [PHONE]"},
+		{"I am EMP-1234", "I am [EMPLOYEE_ID]"},
+		{"in 2024 we sold 12 units", "in 2024 we sold 12 units"},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, r.Mask(tt.text), tt.text)
+	}
+}
+
+func TestRedactor_Redact(t *testing.T) {
+	req := json.RawMessage(`{"messages": [
+		{"role": "system", "content": "be nice"},
+		{"role": "user", "content": [{"type": "text", "text": "write to jane@example.com and jane@example.com"}, {"type": "image_url", "image_url": {"url": "x"}}]}
+	]}`)
+
+	t.Run("mask", func(t *testing.T) {
+		r, _ := core.NewRedactor(core.PIIPolicy{Action: core.PIIMask})
+		redacted, vault, err := r.Redact(req)
+		assert.NoError(t, err)
+		assert.True(t, vault.Empty())
+		assert.Contains(t, string(redacted), `"write to [EMAIL] and [EMAIL]"`)
+	})
+
+	t.Run("tokenize", func(t *testing.T) {
+		r, _ := core.NewRedactor(core.PIIPolicy{Action: core.PIITokenize})
+		redacted, vault, err := r.Redact(req)
+		assert.NoError(t, err)
+		assert.Contains(t, string(redacted), `"write to [EMAIL_1] and [EMAIL_1]"`)
+		assert.Equal(t, "reply to jane@example.com", vault.Restore("reply to [EMAIL_1]"))
+	})
+
+	t.Run("block", func(t *testing.T) {
+		r, _ := core.NewRedactor(core.PIIPolicy{Action: core.PIIBlock, Kinds: []core.PIIKind{core.PIIEmail}})
+		_, _, err := r.Redact(req)
+		assert.ErrorIs(t, err, core.ErrPIIDetected)
+	})
+
+	t.Run("kinds", func(t *testing.T) {
+		r, _ := core.NewRedactor(core.PIIPolicy{Action: core.PIIBlock, Kinds: []core.PIIKind{core.PIIPhone}})
+		_, _, err := r.Redact(req)
+		assert.NoError(t, err)
+	})
+}
+
+func TestPIIVault_RestoreResponse(t *testing.T) {
+	r, _ := core.NewRedactor(core.PIIPolicy{Action: core.PIITokenize})
+	_, vault, err := r.Redact(json.RawMessage(`{"messages": [{"role": "user", "content": "I'm jo@example.com"}]}`))
+	assert.NoError(t, err)
+
+	t.Run("json", func(t *testing.T) {
+		resp := textResponse(`{"choices": [{"message": {"content": "Hi [EMAIL_1]!"}}]}`)
+		resp.Header = http.Header{}
+		assert.NoError(t, vault.RestoreResponse(resp))
+		body, _ := io.ReadAll(resp.Body)
+		assert.JSONEq(t, `{"choices": [{"message": {"content": "Hi jo@example.com!"}}]}`, string(body))
+	})
+
+	t.Run("stream", func(t *testing.T) {
+		resp := streamResponse(
+			`{"choices": [{"index": 0, "delta": {"content": "Hi [EMA"}}]}`,
+			`{"choices": [{"index": 0, "delta": {"content": "IL_1] and [x]"}}]}`,
+			`{"choices": [{"index": 0, "delta": {"content": " [EM"}, "finish_reason": "stop"}]}`,
+			`[DONE]`,
+		)
+		assert.NoError(t, vault.RestoreResponse(resp))
+		body, _ := io.ReadAll(resp.Body)
+		assert.Equal(t, `data: {"choices": [{"index": 0, "delta": {"content": "Hi "}}]}
+
+data: {"choices": [{"index": 0, "delta": {"content": "jo@example.com and [x]"}}]}
+
+data: {"choices": [{"index": 0, "delta": {"content": " [EM"}, "finish_reason": "stop"}]}
+
+data: [DONE]
+
+`, string(body))
+	})
+
+	t.Run("stream tool calls", func(t *testing.T) {
+		resp := streamResponse(
+			`{"choices": [{"index": 0, "delta": {"tool_calls": [{"index": 0, "id": "call_1", "function": {"name": "send", "arguments": ""}}]}}]}`,
+			`{"choices": [{"index": 0, "delta": {"tool_calls": [{"index": 0, "function": {"arguments": "{\"to\": \"[EMAIL"}}]}}]}`,
+			`{"choices": [{"index": 0, "delta": {"tool_calls": [{"index": 0, "function": {"arguments": "_1]\"}"}}]}}]}`,
+			`{"choices": [{"index": 0, "delta": {"tool_calls": [{"index": 0, "function": {"arguments": " [EM"}}]}}]}`,
+			`{"choices": [{"index": 0, "delta": {}, "finish_reason": "tool_calls"}]}`,
+			`[DONE]`,
+		)
+		assert.NoError(t, vault.RestoreResponse(resp))
+		var args strings.Builder
+		events := sse.NewReader(resp.Body)
+		for {
+			ev, err := events.Next()
+			if err != nil {
+				break
+			}
+			for _, call := range gjson.GetBytes(ev.Data, "choices.0.delta.tool_calls").Array() {
+				args.WriteString(call.Get("function.arguments").String())
+			}
+		}
+		assert.Equal(t, `{"to": "jo@example.com"} [EM`, args.String())
+	})
+}
+
+func TestRedactingSink(t *testing.T) {
+	r, _ := core.NewRedactor(core.PIIPolicy{Action: core.PIITokenize})
+	sink := mocks.NewLogSink(t)
+	sink.On("Write", mock.Anything, "shadow_comparison", json.RawMessage(`{"primary":{"output":"Hi [EMAIL]"},"project_id":"project1"}`)).
+		Return(nil).
+		Once()
+
+	ctx := core.WithRedactor(context.Background(), r)
+	err := core.RedactingSink{Sink: sink}.Write(ctx, "shadow_comparison", map[string]any{
+		"project_id": "project1",
+		"primary":    map[string]string{"output": "Hi jane@example.com"},
+	})
+	assert.NoError(t, err)
+}
+
+func TestLogger(t *testing.T) {
+	var out bytes.Buffer
+	r, _ := core.NewRedactor(core.PIIPolicy{Action: core.PIIBlock})
+	ctx := core.WithRedaction(context.Background(), &out)
+	core.WithRedactor(ctx, r)
+
+	// The redactor was attached to a derived context, records logged with ctx are masked too.
+	core.Logger(ctx).Error().Str("reason", "mentions jane@example.com").Msg("request failed")
+	assert.Contains(t, out.String(), `"reason":"mentions [EMAIL]"`)
+	assert.NotContains(t, out.String(), "jane@example.com")
+}
@@ -0,0 +1,79 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Price is the cost of a model in USD per million tokens.
+type Price struct {
+	Input float64 `json:"input"`
+	// CachedInput is the price of prompt tokens served from the provider's cache.
+	// Defaults to Input when zero.
+	CachedInput float64 `json:"cached_input"`
+	Output      float64 `json:"output"`
+}
+
+func (p Price) IsZero() bool {
+	return p == Price{}
+}
+
+// Cost returns the cost of usage in USD.
+func (p Price) Cost(usage Usage) float64 {
+	cached := usage.PromptTokensDetails.CachedTokens
+	cachedPrice := p.CachedInput
+	if cachedPrice == 0 {
+		cachedPrice = p.Input
+	}
+	return (float64(usage.PromptTokens-cached)*p.Input +
+		float64(cached)*cachedPrice +
+		float64(usage.CompletionTokens)*p.Output) / 1e6
+}
+
+// PricingCatalog holds model prices keyed by provider and then model.
+type PricingCatalog map[string]map[string]Price
+
+// ReadPricingCatalog decodes a JSON pricing catalog, e.g.
+//
+//	{"openai": {"gpt-4o": {"input": 2.5, "cached_input": 1.25, "output": 10}}}
+func ReadPricingCatalog(r io.Reader) (PricingCatalog, error) {
+	var catalog PricingCatalog
+	if err := json.NewDecoder(r).Decode(&catalog); err != nil {
+		return nil, fmt.Errorf("failed to decode pricing catalog: %w", err)
+	}
+	return catalog, nil
+}
+
+// Price returns the price of a route. A price set on the route takes precedence,
+// otherwise the catalog is searched for the model or, failing that, the longest
+// model prefix so dated snapshots such as gpt-4o-2024-08-06 match gpt-4o.
+func (c PricingCatalog) Price(route Route) (Price, bool) {
+	if !route.Price.IsZero() {
+		return route.Price, true
+	}
+	models := c[route.Provider]
+	if price, ok := models[route.Model]; ok {
+		return price, true
+	}
+	var (
+		best  Price
+		found string
+	)
+	for model, price := range models {
+		if strings.HasPrefix(route.Model, model) && len(model) > len(found) {
+			best, found = price, model
+		}
+	}
+	return best, found != ""
+}
+
+// Cost returns the cost of usage on route in USD and whether the route has a known price.
+func (c PricingCatalog) Cost(route Route, usage Usage) (float64, bool) {
+	price, ok := c.Price(route)
+	if !ok {
+		return 0, false
+	}
+	return price.Cost(usage), true
+}
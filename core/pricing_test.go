@@ -0,0 +1,73 @@
+package core_test
+
+import (
+	"strings"
+	"testing"
+
+	"magicrouter/core"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrice_Cost(t *testing.T) {
+	usage := core.Usage{PromptTokens: 1000, CompletionTokens: 500}
+	usage.PromptTokensDetails.CachedTokens = 400
+
+	t.Run("cached input price", func(t *testing.T) {
+		price := core.Price{Input: 2, CachedInput: 1, Output: 10}
+		assert.InDelta(t, (600*2+400*1+500*10)/1e6, price.Cost(usage), 1e-12)
+	})
+
+	t.Run("cached input defaults to input price", func(t *testing.T) {
+		price := core.Price{Input: 2, Output: 10}
+		assert.InDelta(t, (1000*2+500*10)/1e6, price.Cost(usage), 1e-12)
+	})
+}
+
+func TestPricingCatalog_Price(t *testing.T) {
+	catalog, err := core.ReadPricingCatalog(strings.NewReader(`{
+		"openai": {
+			"gpt-4": {"input": 30, "output": 60},
+			"gpt-4o": {"input": 2.5, "cached_input": 1.25, "output": 10}
+		}
+	}`))
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name  string
+		route core.Route
+		price core.Price
+		ok    bool
+	}{
+		{
+			name:  "exact match",
+			route: core.Route{Provider: "openai", Model: "gpt-4"},
+			price: core.Price{Input: 30, Output: 60},
+			ok:    true,
+		},
+		{
+			name:  "longest prefix match",
+			route: core.Route{Provider: "openai", Model: "gpt-4o-2024-08-06"},
+			price: core.Price{Input: 2.5, CachedInput: 1.25, Output: 10},
+			ok:    true,
+		},
+		{
+			name:  "route override",
+			route: core.Route{Provider: "openai", Model: "gpt-4", Price: core.Price{Input: 1, Output: 2}},
+			price: core.Price{Input: 1, Output: 2},
+			ok:    true,
+		},
+		{
+			name:  "unknown provider",
+			route: core.Route{Provider: "azure", Model: "gpt-4"},
+			ok:    false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			price, ok := catalog.Price(tt.route)
+			assert.Equal(t, tt.ok, ok)
+			assert.Equal(t, tt.price, price)
+		})
+	}
+}
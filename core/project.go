@@ -1,10 +1,81 @@
 package core
 
+import "context"
+
+type RoutingMode string
+
+const (
+	// RoutingPriority attempts routes strictly by priority.
+	RoutingPriority RoutingMode = "priority"
+	// RoutingLatency orders routes of the same priority by observed latency.
+	RoutingLatency RoutingMode = "latency"
+	// RoutingCost attempts the cheapest routes meeting the requested quality first.
+	RoutingCost RoutingMode = "cost"
+)
+
+// VirtualModel is a model name clients can request which is served by its own routes.
+type VirtualModel struct {
+	Routes  []Route     `json:"routes"`
+	Routing RoutingMode `json:"routing,omitempty"`
+}
+
 type ProjectConfig struct {
-	ID     string  `json:"id"`
-	Routes []Route `json:"routes"`
+	ID      string      `json:"id"`
+	Routes  []Route     `json:"routes"`
+	Routing RoutingMode `json:"routing,omitempty"`
+	// Models maps virtual model names to their routes. Requests for any other
+	// model are served by Routes.
+	Models map[string]VirtualModel `json:"models,omitempty"`
+	// Hedging races a backup route when the first one is slow. Disabled when nil.
+	Hedging *HedgeConfig `json:"hedging,omitempty"`
+	// Shadow mirrors some requests to a candidate route for comparison. Disabled when nil.
+	Shadow *ShadowConfig `json:"shadow,omitempty"`
+	// StreamFailover continues streams that break midway on the next route.
+	StreamFailover bool `json:"stream_failover,omitempty"`
+	// Experiments split traffic between route chains. The first one matching the model applies.
+	Experiments []Experiment `json:"experiments,omitempty"`
+	// Dedup coalesces concurrent identical requests. Disabled when nil.
+	Dedup *DedupConfig `json:"dedup,omitempty"`
+	// PII detects personal data in messages before they are sent to providers and
+	// in log records. Disabled when nil.
+	PII *PIIPolicy `json:"pii,omitempty"`
+	// Guardrails check requests and responses in order.
+	Guardrails []GuardrailConfig `json:"guardrails,omitempty"`
+	// StructuredOutput retries requests with a JSON response format whose output is invalid.
+	// Disabled when nil.
+	StructuredOutput *StructuredOutputConfig `json:"structured_output,omitempty"`
+	// Transform rewrites requests before they are routed. Disabled when nil.
+	Transform *TransformConfig `json:"transform,omitempty"`
+	// Concurrency caps the requests of the project in flight. Unlimited when nil.
+	Concurrency *ConcurrencyLimit `json:"concurrency,omitempty"`
+	// Async configures asynchronous completion jobs, which run with the defaults when nil.
+	Async *AsyncConfig `json:"async,omitempty"`
+}
+
+// Model returns the routes and routing mode serving the requested model.
+func (c *ProjectConfig) Model(name string) VirtualModel {
+	if model, ok := c.Models[name]; ok {
+		return model
+	}
+	return VirtualModel{Routes: c.Routes, Routing: c.Routing}
 }
 
 type ProjectStore interface {
 	GetConfig(projectID string) (*ProjectConfig, error)
 }
+
+type projectContextKey struct{}
+
+// WithProject tells routing which project requests belong to. Route IDs are only unique
+// within a project, so what is kept per route across requests is scoped by it.
+func WithProject(ctx context.Context, projectID string) context.Context {
+	return context.WithValue(ctx, projectContextKey{}, projectID)
+}
+
+// scopedRouteID returns the ID of route unique across the projects of a server.
+func scopedRouteID(ctx context.Context, routeID string) string {
+	if project, _ := ctx.Value(projectContextKey{}).(string); project != "" {
+		return project + "/" + routeID
+	}
+	return routeID
+}
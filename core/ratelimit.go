@@ -0,0 +1,174 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// RateLimitError is returned by providers for rate limited requests along with the
+// rate limit headers of the response. It matches ErrProviderRateLimited.
+type RateLimitError struct {
+	Header http.Header
+}
+
+func (e *RateLimitError) Error() string {
+	return ErrProviderRateLimited.Error()
+}
+
+func (e *RateLimitError) Is(target error) bool {
+	return target == ErrProviderRateLimited
+}
+
+// errAboutToBeThrottled is returned for routes that are skipped because their remaining quota is too low.
+var errAboutToBeThrottled = fmt.Errorf("%w: remaining quota too low", ErrProviderRateLimited)
+
+// RateLimitState is the remaining quota a provider reported for a route or key.
+// Remaining counts are -1 when unknown.
+type RateLimitState struct {
+	RemainingRequests int64     `json:"remaining_requests"`
+	RemainingTokens   int64     `json:"remaining_tokens"`
+	ResetRequests     time.Time `json:"reset_requests"`
+	ResetTokens       time.Time `json:"reset_tokens"`
+}
+
+// ParseRateLimitHeaders reads OpenAI style x-ratelimit-* headers, reporting false if there are none.
+func ParseRateLimitHeaders(h http.Header, now time.Time) (RateLimitState, bool) {
+	state := RateLimitState{RemainingRequests: -1, RemainingTokens: -1}
+	remaining := func(name string) int64 {
+		n, err := strconv.ParseInt(h.Get(name), 10, 64)
+		if err != nil {
+			return -1
+		}
+		return n
+	}
+	// Resets are durations such as "1s" or "6m0s".
+	reset := func(name string) time.Time {
+		d, err := time.ParseDuration(h.Get(name))
+		if err != nil {
+			return time.Time{}
+		}
+		return now.Add(d)
+	}
+	state.RemainingRequests = remaining("x-ratelimit-remaining-requests")
+	state.RemainingTokens = remaining("x-ratelimit-remaining-tokens")
+	state.ResetRequests = reset("x-ratelimit-reset-requests")
+	state.ResetTokens = reset("x-ratelimit-reset-tokens")
+	return state, state.RemainingRequests >= 0 || state.RemainingTokens >= 0
+}
+
+// Throttled reports whether a request needing tokens would likely be rate limited at now.
+func (s RateLimitState) Throttled(tokens int, now time.Time) bool {
+	if s.RemainingRequests == 0 && now.Before(s.ResetRequests) {
+		return true
+	}
+	return s.RemainingTokens >= 0 && int64(tokens) > s.RemainingTokens && now.Before(s.ResetTokens)
+}
+
+// Expires is when the state no longer applies, once both quotas were reset.
+func (s RateLimitState) Expires() time.Time {
+	if s.ResetTokens.After(s.ResetRequests) {
+		return s.ResetTokens
+	}
+	return s.ResetRequests
+}
+
+// RateLimitStore shares the rate limit state of routes and keys across replicas.
+type RateLimitStore interface {
+	// GetRateLimit returns the state of id, nil if unknown or expired.
+	GetRateLimit(ctx context.Context, id string) (*RateLimitState, error)
+	// SetRateLimit keeps the state of id until it expires.
+	SetRateLimit(ctx context.Context, id string, state RateLimitState) error
+}
+
+// RateLimitTracker records the rate limit headers of responses so that routes and keys
+// about to be throttled are skipped instead of failing with a 429.
+type RateLimitTracker struct {
+	store RateLimitStore
+	now   func() time.Time
+}
+
+func NewRateLimitTracker(store RateLimitStore) *RateLimitTracker {
+	return &RateLimitTracker{store: store, now: time.Now}
+}
+
+type rateLimitContextKey struct{}
+
+// WithRateLimits makes attempts record and respect the rate limits tracked by tracker.
+func WithRateLimits(ctx context.Context, tracker *RateLimitTracker) context.Context {
+	return context.WithValue(ctx, rateLimitContextKey{}, tracker)
+}
+
+func rateLimitsFrom(ctx context.Context) *RateLimitTracker {
+	tracker, _ := ctx.Value(rateLimitContextKey{}).(*RateLimitTracker)
+	return tracker
+}
+
+// routeRateLimitID is scoped by project, routes of different projects can share an ID.
+func routeRateLimitID(ctx context.Context, routeID string) string {
+	return "route:" + scopedRouteID(ctx, routeID)
+}
+
+func keyRateLimitID(keyID string) string {
+	return "key:" + keyID
+}
+
+// throttled reports whether a request needing tokens should skip id.
+func (t *RateLimitTracker) throttled(ctx context.Context, id string, tokens int) bool {
+	if t == nil {
+		return false
+	}
+	state, err := t.store.GetRateLimit(ctx, id)
+	if err != nil {
+		log.Err(err).Msg("failed to get rate limit state")
+		return false
+	}
+	return state != nil && state.Throttled(tokens, t.now())
+}
+
+// observe records the rate limit headers of the outcome of an attempt with id.
+func (t *RateLimitTracker) observe(ctx context.Context, id string, resp *http.Response, err error) {
+	if t == nil {
+		return
+	}
+	var header http.Header
+	var rateLimitErr *RateLimitError
+	switch {
+	case errors.As(err, &rateLimitErr):
+		header = rateLimitErr.Header
+	case err == nil:
+		header = resp.Header
+	default:
+		return
+	}
+	now := t.now()
+	state, ok := ParseRateLimitHeaders(header, now)
+	if rateLimitErr != nil {
+		// The quota is exhausted whatever the headers say, at least until it resets.
+		state.RemainingRequests = 0
+		if !state.ResetRequests.After(now) {
+			state.ResetRequests = now.Add(retryAfter(header))
+		}
+		ok = true
+	}
+	if !ok || !state.Expires().After(now) {
+		return
+	}
+	if err := t.store.SetRateLimit(ctx, id, state); err != nil {
+		log.Err(err).Msg("failed to set rate limit state")
+	}
+}
+
+// retryAfter reads the Retry-After header in seconds, one second if it has none.
+func retryAfter(h http.Header) time.Duration {
+	seconds, err := strconv.Atoi(h.Get("Retry-After"))
+	if err != nil || seconds <= 0 {
+		return time.Second
+	}
+	return time.Duration(seconds) * time.Second
+}
@@ -0,0 +1,141 @@
+package core_test
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"magicrouter/core"
+	"magicrouter/inmem"
+	"magicrouter/mocks"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestParseRateLimitHeaders(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	h := http.Header{}
+	h.Set("x-ratelimit-remaining-requests", "59")
+	h.Set("x-ratelimit-remaining-tokens", "149984")
+	h.Set("x-ratelimit-reset-requests", "1s")
+	h.Set("x-ratelimit-reset-tokens", "6m0s")
+
+	state, ok := core.ParseRateLimitHeaders(h, now)
+	assert.True(t, ok)
+	assert.Equal(t, core.RateLimitState{
+		RemainingRequests: 59,
+		RemainingTokens:   149984,
+		ResetRequests:     now.Add(time.Second),
+		ResetTokens:       now.Add(6 * time.Minute),
+	}, state)
+	assert.False(t, state.Throttled(1000, now))
+	assert.True(t, state.Throttled(200000, now))
+	assert.False(t, state.Throttled(200000, now.Add(7*time.Minute)))
+
+	_, ok = core.ParseRateLimitHeaders(http.Header{}, now)
+	assert.False(t, ok)
+}
+
+func TestFallbackChatService_RateLimits(t *testing.T) {
+	routes := []core.Route{
+		{ID: "route1", Priority: 1, Provider: "openai", Model: "gpt-4o"},
+		{ID: "route2", Priority: 2, Provider: "openai", Model: "gpt-4o-mini"},
+	}
+	req := json.RawMessage(`{"messages": [{"role": "user", "content": "Hi"}], "max_tokens": 100}`)
+	response := func(remainingRequests, remainingTokens string) *http.Response {
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header: http.Header{
+				"X-Ratelimit-Remaining-Requests": []string{remainingRequests},
+				"X-Ratelimit-Remaining-Tokens":   []string{remainingTokens},
+				"X-Ratelimit-Reset-Requests":     []string{"1m"},
+				"X-Ratelimit-Reset-Tokens":       []string{"1m"},
+			},
+			Body: io.NopCloser(strings.NewReader(`{}`)),
+		}
+	}
+
+	t.Run("skips routes without enough quota left", func(t *testing.T) {
+		ctx := core.WithRateLimits(context.Background(), core.NewRateLimitTracker(inmem.NewRateLimitStore()))
+		mockService := mocks.NewChatService(t)
+		mockService.On("ChatCompletion", mock.Anything, req, "gpt-4o", "").
+			Return(response("10", "50"), nil).Once()
+		mockService.On("ChatCompletion", mock.Anything, req, "gpt-4o-mini", "").
+			Return(response("0", "1000"), nil).Once()
+		svc := core.NewFallbackChatService(routes, core.ChatServices{"openai": mockService}, core.NoOpBreaker{})
+
+		resp, err := svc.ChatCompletion(ctx, req)
+		assert.NoError(t, err)
+		assert.Equal(t, "route1", resp.Route.ID)
+		// route1 has fewer tokens left than the request needs.
+		resp, err = svc.ChatCompletion(ctx, req)
+		assert.NoError(t, err)
+		assert.Equal(t, "route2", resp.Route.ID)
+		// route2 has no requests left.
+		_, err = svc.ChatCompletion(ctx, req)
+		var fallbackErr core.FallbackError
+		assert.ErrorAs(t, err, &fallbackErr)
+		assert.True(t, fallbackErr.All(core.ErrProviderRateLimited))
+	})
+
+	t.Run("routes of other projects aren't skipped", func(t *testing.T) {
+		routes := []core.Route{{ID: "primary", Provider: "openai", Model: "gpt-4o"}}
+		ctx := core.WithRateLimits(context.Background(), core.NewRateLimitTracker(inmem.NewRateLimitStore()))
+		mockService := mocks.NewChatService(t)
+		mockService.On("ChatCompletion", mock.Anything, req, "gpt-4o", "").
+			Return(response("0", "1000"), nil).Twice()
+		svc := core.NewFallbackChatService(routes, core.ChatServices{"openai": mockService}, core.NoOpBreaker{})
+
+		_, err := svc.ChatCompletion(core.WithProject(ctx, "project1"), req)
+		assert.NoError(t, err)
+		_, err = svc.ChatCompletion(core.WithProject(ctx, "project2"), req)
+		assert.NoError(t, err)
+		_, err = svc.ChatCompletion(core.WithProject(ctx, "project1"), req)
+		var fallbackErr core.FallbackError
+		assert.ErrorAs(t, err, &fallbackErr)
+		assert.True(t, fallbackErr.All(core.ErrProviderRateLimited))
+	})
+
+	t.Run("rate limited keys are skipped until they reset", func(t *testing.T) {
+		routes := []core.Route{{ID: "route1", Provider: "openai", Model: "gpt-4o", Keys: []core.ProviderKey{
+			{ID: "a", Token: "sk-a"}, {ID: "b", Token: "sk-b"},
+		}}}
+		ctx := core.WithRateLimits(context.Background(), core.NewRateLimitTracker(inmem.NewRateLimitStore()))
+		ctx = core.WithKeyPool(ctx, core.NewKeyPool(nil, core.NoOpBreaker{}, core.KeyPoolConfig{}))
+		mockService := mocks.NewChatService(t)
+		mockService.On("ChatCompletion", mock.Anything, req, "gpt-4o", "sk-a").
+			Return(nil, &core.RateLimitError{Header: http.Header{"Retry-After": []string{"30"}}}).Once()
+		mockService.On("ChatCompletion", mock.Anything, req, "gpt-4o", "sk-b").
+			Return(response("5", "1000"), nil).Twice()
+		svc := core.NewFallbackChatService(routes, core.ChatServices{"openai": mockService}, core.NoOpBreaker{})
+
+		for i := 0; i < 2; i++ {
+			_, err := svc.ChatCompletion(ctx, req)
+			assert.NoError(t, err)
+		}
+	})
+
+	t.Run("route keys are left alone without a key pool", func(t *testing.T) {
+		routes := []core.Route{{ID: "route1", Provider: "openai", Model: "gpt-4o", Keys: []core.ProviderKey{
+			{ID: "a", Token: "sk-a"}, {ID: "b", Token: "sk-b"},
+		}}}
+		ctx := core.WithRateLimits(context.Background(), core.NewRateLimitTracker(inmem.NewRateLimitStore()))
+		mockService := mocks.NewChatService(t)
+		mockService.On("ChatCompletion", mock.Anything, req, "gpt-4o", "sk-a").
+			Return(nil, &core.RateLimitError{Header: http.Header{"Retry-After": []string{"30"}}}).Once()
+		mockService.On("ChatCompletion", mock.Anything, req, "gpt-4o", "sk-b").
+			Return(response("5", "1000"), nil).Twice()
+		svc := core.NewFallbackChatService(routes, core.ChatServices{"openai": mockService}, core.NoOpBreaker{})
+
+		for i := 0; i < 2; i++ {
+			_, err := svc.ChatCompletion(ctx, req)
+			assert.NoError(t, err)
+		}
+		assert.Equal(t, []core.ProviderKey{{ID: "a", Token: "sk-a"}, {ID: "b", Token: "sk-b"}}, routes[0].Keys)
+	})
+}
@@ -0,0 +1,159 @@
+package core
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+
+	"magicrouter/sse"
+
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+// RestoreResponse replaces the tokens in the messages of resp with the originals.
+// Streams are restored as they are read.
+func (v *PIIVault) RestoreResponse(resp *http.Response) error {
+	if v.Empty() {
+		return nil
+	}
+	if isEventStream(resp) {
+		resp.Body = &restoringStream{vault: v, body: resp.Body, events: sse.NewReader(resp.Body), pending: make(map[deltaField]string)}
+		return nil
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return fmt.Errorf("failed to read response body: %w", err)
+	}
+	for i, choice := range gjson.GetBytes(body, "choices").Array() {
+		paths := []string{fmt.Sprintf("choices.%d.message.content", i)}
+		for j := range choice.Get("message.tool_calls").Array() {
+			paths = append(paths, fmt.Sprintf("choices.%d.message.tool_calls.%d.function.arguments", i, j))
+		}
+		if body, err = v.restoreFields(body, paths...); err != nil {
+			return err
+		}
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.Header.Del("Content-Length")
+	return nil
+}
+
+func (v *PIIVault) restoreFields(data []byte, paths ...string) ([]byte, error) {
+	for _, path := range paths {
+		field := gjson.GetBytes(data, path)
+		if field.Type != gjson.String {
+			continue
+		}
+		restored := v.Restore(field.String())
+		if restored == field.String() {
+			continue
+		}
+		var err error
+		if data, err = sjson.SetBytes(data, path, restored); err != nil {
+			return nil, fmt.Errorf("failed to restore %s: %w", path, err)
+		}
+	}
+	return data, nil
+}
+
+// restoringStream restores tokens in the content and tool call argument deltas of an event
+// stream. Deltas ending with what could be the start of a token are held back until it's complete.
+type restoringStream struct {
+	vault   *PIIVault
+	body    io.ReadCloser
+	events  *sse.Reader
+	pending map[deltaField]string
+	out     bytes.Buffer
+	err     error
+}
+
+// deltaField identifies a streamed field across chunks: the content of a choice when
+// call is -1, the arguments of one of its tool calls otherwise.
+type deltaField struct {
+	choice, call int64
+}
+
+func (s *restoringStream) Read(p []byte) (int, error) {
+	for s.out.Len() == 0 && s.err == nil {
+		s.next()
+	}
+	if s.out.Len() > 0 {
+		return s.out.Read(p)
+	}
+	return 0, s.err
+}
+
+func (s *restoringStream) Close() error {
+	return s.body.Close()
+}
+
+func (s *restoringStream) next() {
+	ev, err := s.events.Next()
+	if err != nil {
+		s.err = err
+		return
+	}
+	if !bytes.Equal(ev.Data, sse.Done) {
+		if ev.Data, err = s.restoreChunk(ev.Data); err != nil {
+			s.err = fmt.Errorf("failed to restore chunk: %w", err)
+			return
+		}
+	}
+	sse.WriteEvent(&s.out, ev)
+}
+
+func (s *restoringStream) restoreChunk(data []byte) ([]byte, error) {
+	var err error
+	for i, choice := range gjson.GetBytes(data, "choices").Array() {
+		index := choice.Get("index").Int()
+		final := choice.Get("finish_reason").String() != ""
+		path := fmt.Sprintf("choices.%d.delta.content", i)
+		if data, err = s.restore(data, deltaField{index, -1}, path, choice.Get("delta.content"), final); err != nil {
+			return nil, err
+		}
+
+		streamed := make(map[int64]bool)
+		for j, call := range choice.Get("delta.tool_calls").Array() {
+			field := deltaField{index, call.Get("index").Int()}
+			streamed[field.call] = true
+			path := fmt.Sprintf("choices.%d.delta.tool_calls.%d.function.arguments", i, j)
+			if data, err = s.restore(data, field, path, call.Get("function.arguments"), final); err != nil {
+				return nil, err
+			}
+		}
+		if !final {
+			continue
+		}
+		// Arguments held back when the choice finishes are sent with its last chunk.
+		for field, text := range s.pending {
+			if field.choice != index || field.call < 0 || streamed[field.call] || text == "" {
+				continue
+			}
+			delete(s.pending, field)
+			call := map[string]any{"index": field.call, "function": map[string]string{"arguments": s.vault.Restore(text)}}
+			if data, err = sjson.SetBytes(data, fmt.Sprintf("choices.%d.delta.tool_calls.-1", i), call); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return data, nil
+}
+
+// restore replaces the tokens in value, the field at path of data, prefixed with what
+// was held back of the field in previous chunks.
+func (s *restoringStream) restore(data []byte, field deltaField, path string, value gjson.Result, final bool) ([]byte, error) {
+	text := s.pending[field] + value.String()
+	held := 0
+	if !final {
+		held = s.vault.pending(text)
+	}
+	s.pending[field] = text[len(text)-held:]
+	if !value.Exists() && text == "" {
+		return data, nil
+	}
+	return sjson.SetBytes(data, path, s.vault.Restore(text[:len(text)-held]))
+}
@@ -3,10 +3,13 @@ package core
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"slices"
 	"sort"
 	"strings"
+	"time"
 
 	"github.com/rs/zerolog/log"
 )
@@ -15,46 +18,184 @@ type FallbackError map[string]error
 
 func (e FallbackError) Error() string {
 	var msg strings.Builder
+	routes := make([]string, 0, len(e))
+	for route := range e {
+		routes = append(routes, route)
+	}
+	sort.Strings(routes)
+
 	msg.WriteString("all routes failed: ")
-	for route, err := range e {
-		msg.WriteString(fmt.Sprintf("%s: %s, ", route, err.Error()))
+	for _, route := range routes {
+		msg.WriteString(fmt.Sprintf("%s: %s, ", route, e[route].Error()))
 	}
 	return msg.String()
 }
 
+// All reports whether every route failed with target.
+func (e FallbackError) All(target error) bool {
+	if len(e) == 0 {
+		return false
+	}
+	for _, err := range e {
+		if !errors.Is(err, target) {
+			return false
+		}
+	}
+	return true
+}
+
 type Route struct {
 	ID            string
 	Priority      int
 	Provider      string
 	Model         string
 	ProviderToken string
+	// Keys are used instead of ProviderToken, see KeyPool.
+	Keys         []ProviderKey
+	KeySelection KeySelection
+	// Concurrency caps the requests in flight on this route. Unlimited when nil.
+	Concurrency *ConcurrencyLimit
+	// Price is used to compute the cost of completions served by this route.
+	Price Price
+	// Quality is the quality tier of the model, higher is better.
+	// Requests can ask for a minimum tier with cost routing.
+	Quality int
+	// ContextWindow is the maximum number of prompt and output tokens of the model.
+	// Requests that don't fit are not sent to the route. Zero means unknown.
+	ContextWindow int
+	// MaxOutputTokens is the maximum number of tokens the model can generate. Zero means unknown.
+	MaxOutputTokens int
+	// Capabilities the model supports. Nil means the route supports every capability.
+	Capabilities []Capability
+	// SynthesizeStreams lets routes without CapabilityStreaming serve streaming requests,
+	// the stream is synthesized from a regular response.
+	SynthesizeStreams bool
+	// StreamOnly is set for routes that only respond with streams,
+	// they are aggregated for non-streaming requests.
+	StreamOnly bool
+	// Params override request parameters for this route, e.g. {"temperature": 0}.
+	// A null value removes the parameter.
+	Params map[string]json.RawMessage
+}
+
+// Fits reports whether a request with promptTokens and asking for up to maxTokens
+// (zero if unset) fits in the route's context window.
+func (r Route) Fits(promptTokens, maxTokens int) bool {
+	if r.MaxOutputTokens > 0 && maxTokens > r.MaxOutputTokens {
+		return false
+	}
+	if r.ContextWindow > 0 && promptTokens+maxTokens > r.ContextWindow {
+		return false
+	}
+	return true
+}
+
+// Completion is a successful response along with the route that served it.
+type Completion struct {
+	*http.Response
+	Route Route
+	// failover continues the stream on other routes if it breaks, nil if disabled.
+	failover *failoverStream
+}
+
+// FinalRoute is the route that finished the response. It differs from Route when the
+// stream failed over, which is only known once the body was read.
+func (c *Completion) FinalRoute() Route {
+	if c.failover != nil {
+		return c.failover.route
+	}
+	return c.Route
+}
+
+// BrokenSegments are the parts of the stream served by routes that broke before it was done,
+// in order. Their usage has to be accounted for on top of the usage the stream reports.
+func (c *Completion) BrokenSegments() []StreamSegment {
+	if c.failover != nil {
+		return c.failover.segments
+	}
+	return nil
 }
 
 type FallbackChatService struct {
 	routes   []Route
 	services ChatServices
 	breaker  BreakerService
+	strategy RoutingStrategy
+	required []Capability
+	hedge    *hedging
+	// streamFailover continues broken streams on the next route.
+	streamFailover bool
+	structured     *StructuredOutputConfig
+}
+
+type FallbackOption func(*FallbackChatService)
+
+// WithStrategy reorders routes for each request, routes are attempted by priority otherwise.
+func WithStrategy(strategy RoutingStrategy) FallbackOption {
+	return func(s *FallbackChatService) {
+		s.strategy = strategy
+	}
 }
 
-func NewFallbackChatService(routes []Route, services ChatServices, breaker BreakerService) *FallbackChatService {
-	sort.Slice(routes, func(i, j int) bool {
+// WithCapabilities only considers routes that support caps, see RequiredCapabilities.
+func WithCapabilities(caps []Capability) FallbackOption {
+	return func(s *FallbackChatService) {
+		s.required = caps
+	}
+}
+
+func NewFallbackChatService(routes []Route, services ChatServices, breaker BreakerService, opts ...FallbackOption) *FallbackChatService {
+	// Routes usually come from a shared project config, sort a copy.
+	routes = slices.Clone(routes)
+	sort.SliceStable(routes, func(i, j int) bool {
 		return routes[i].Priority < routes[j].Priority // ascending
 	})
-	return &FallbackChatService{
+	s := &FallbackChatService{
 		routes:   routes,
 		services: services,
 		breaker:  breaker,
 	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
 }
 
-func (s *FallbackChatService) ChatCompletion(ctx context.Context, req json.RawMessage) (*http.Response, error) {
-	fallbackErr := make(FallbackError)
-	for _, route := range s.routes {
-		state, err := s.breaker.GetState(ctx, route.ID)
+func (s *FallbackChatService) ChatCompletion(ctx context.Context, req json.RawMessage) (*Completion, error) {
+	if s.structured != nil {
+		schema, err := responseSchema(req)
 		if err != nil {
-			log.Err(err).Msg("failed to get breaker state")
+			// Clients mustn't be told that output was validated when it couldn't be.
+			return nil, err
 		}
-		if err == nil && !state.ShouldAttempt() {
+		if schema != nil {
+			return s.validated(ctx, req, schema)
+		}
+	}
+
+	routes := s.routes
+	if s.strategy != nil {
+		routes = s.strategy.Order(ctx, req, routes)
+	}
+	if len(routes) == 0 && len(s.routes) > 0 && minQuality(ctx) > 0 {
+		return nil, fmt.Errorf("%w of %d", ErrQualityUnavailable, minQuality(ctx))
+	}
+	routes, err := capable(s.required, routes)
+	if err != nil {
+		return nil, err
+	}
+	routes, err = fitting(req, routes)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.hedge != nil {
+		return s.hedged(ctx, req, routes)
+	}
+
+	fallbackErr := make(FallbackError)
+	for i, route := range routes {
+		if !s.shouldAttempt(ctx, route) {
 			continue
 		}
 
@@ -63,15 +204,67 @@ func (s *FallbackChatService) ChatCompletion(ctx context.Context, req json.RawMe
 			return nil, fmt.Errorf("unknown provider: %s", route.Provider)
 		}
 
-		resp, err := svc.ChatCompletion(ctx, req, route.Model, route.ProviderToken)
+		start := time.Now()
+		resp, err := callRoute(ctx, svc, req, route)
 		if err != nil {
 			fallbackErr[route.ID] = err
 			s.breaker.ReportFailure(ctx, route.ID)
+			s.observeFailure(ctx, route, start)
 			continue
 		}
 		s.breaker.ReportSuccess(ctx, route.ID)
-		return resp, nil
+		return s.complete(ctx, req, route, start, resp, routes[i+1:]), nil
 	}
 
 	return nil, fallbackErr
 }
+
+// complete wraps the response of a successful attempt. remaining are the routes
+// that weren't attempted, which streams can fail over to.
+func (s *FallbackChatService) complete(ctx context.Context, req json.RawMessage, route Route, start time.Time, resp *http.Response, remaining []Route) *Completion {
+	if observer, ok := s.strategy.(ResponseObserver); ok {
+		observer.Observe(route, start, resp)
+	}
+	completion := &Completion{Response: resp, Route: route}
+	if s.streamFailover && isEventStream(resp) {
+		completion.failover = newFailoverStream(ctx, s, req, route, resp.Body, remaining)
+		resp.Body = completion.failover
+	}
+	return completion
+}
+
+// observeFailure tells the strategy about an attempt that failed without a response,
+// unless the request was given up on.
+func (s *FallbackChatService) observeFailure(ctx context.Context, route Route, start time.Time) {
+	if observer, ok := s.strategy.(ResponseObserver); ok && ctx.Err() == nil {
+		observer.ObserveFailure(route, start)
+	}
+}
+
+// fitting returns the routes whose context window fits req. It fails with
+// ErrContextLengthExceeded when none do.
+func fitting(req json.RawMessage, routes []Route) ([]Route, error) {
+	if !slices.ContainsFunc(routes, func(r Route) bool { return r.ContextWindow > 0 || r.MaxOutputTokens > 0 }) {
+		return routes, nil
+	}
+	prompt := EstimatePromptTokens(req)
+	maxTokens := MaxOutputTokens(req, 0)
+	fits := make([]Route, 0, len(routes))
+	for _, route := range routes {
+		if route.Fits(prompt, maxTokens) {
+			fits = append(fits, route)
+		}
+	}
+	if len(fits) == 0 && len(routes) > 0 {
+		return nil, fmt.Errorf("%w: request needs ~%d prompt and %d output tokens", ErrContextLengthExceeded, prompt, maxTokens)
+	}
+	return fits, nil
+}
+
+func (s *FallbackChatService) shouldAttempt(ctx context.Context, route Route) bool {
+	state, err := s.breaker.GetState(ctx, route.ID)
+	if err != nil {
+		log.Err(err).Msg("failed to get breaker state")
+	}
+	return err != nil || state.ShouldAttempt()
+}
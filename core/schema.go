@@ -0,0 +1,445 @@
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// ErrUnsupportedSchema is returned for schemas that are invalid or use keywords Schema
+// doesn't implement, so output couldn't be validated against them.
+var ErrUnsupportedSchema = errors.New("unsupported response schema")
+
+// Schema validates JSON documents against the subset of JSON Schema supported by
+// structured outputs: types, properties, required, additionalProperties, items, enum,
+// const, anyOf/oneOf/allOf, numeric and length bounds, pattern and local $refs.
+type Schema struct {
+	root     map[string]any
+	patterns map[string]*regexp.Regexp
+}
+
+// SchemaError lists the places where a document doesn't match a schema.
+type SchemaError []string
+
+func (e SchemaError) Error() string {
+	return strings.Join(e, "; ")
+}
+
+// maxSchemaErrors caps the number of errors reported, repair prompts stay short.
+const maxSchemaErrors = 10
+
+// schemaKeywords are the keywords validate implements, and annotations that don't
+// constrain documents.
+var schemaKeywords = map[string]bool{
+	"type": true, "enum": true, "const": true, "$ref": true,
+	"allOf": true, "anyOf": true, "oneOf": true,
+	"properties": true, "required": true, "additionalProperties": true,
+	"items": true, "minItems": true, "maxItems": true,
+	"minLength": true, "maxLength": true, "pattern": true,
+	"minimum": true, "maximum": true, "exclusiveMinimum": true, "exclusiveMaximum": true,
+	"$defs": true, "definitions": true,
+	"$schema": true, "$id": true, "$comment": true,
+	"title": true, "description": true, "default": true, "examples": true,
+}
+
+// CompileSchema fails with ErrUnsupportedSchema when raw isn't a schema or uses
+// keywords that aren't supported.
+func CompileSchema(raw json.RawMessage) (*Schema, error) {
+	root, err := decodeJSON(raw)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrUnsupportedSchema, err)
+	}
+	obj, ok := root.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("%w: not an object", ErrUnsupportedSchema)
+	}
+	s := &Schema{root: obj, patterns: make(map[string]*regexp.Regexp)}
+	if err := s.check(obj, "#"); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrUnsupportedSchema, err)
+	}
+	return s, nil
+}
+
+// check makes sure that validate understands all of schema, path locates it in the root.
+func (s *Schema) check(schema map[string]any, path string) error {
+	for keyword, value := range schema {
+		if !schemaKeywords[keyword] {
+			return fmt.Errorf("%s: keyword %s isn't supported", path, keyword)
+		}
+		at := path + "/" + keyword
+		switch keyword {
+		case "properties", "$defs", "definitions":
+			subs, ok := value.(map[string]any)
+			if !ok {
+				return fmt.Errorf("%s: expected an object", at)
+			}
+			for name, sub := range subs {
+				if err := s.checkSub(sub, at+"/"+name); err != nil {
+					return err
+				}
+			}
+		case "allOf", "anyOf", "oneOf":
+			subs, ok := value.([]any)
+			if !ok {
+				return fmt.Errorf("%s: expected an array", at)
+			}
+			for i, sub := range subs {
+				if err := s.checkSub(sub, fmt.Sprintf("%s/%d", at, i)); err != nil {
+					return err
+				}
+			}
+		case "items":
+			// Tuples, i.e. arrays of schemas, aren't supported.
+			if err := s.checkSub(value, at); err != nil {
+				return err
+			}
+		case "additionalProperties":
+			if _, ok := value.(bool); !ok {
+				if err := s.checkSub(value, at); err != nil {
+					return err
+				}
+			}
+		case "$ref":
+			ref, ok := value.(string)
+			if !ok {
+				return fmt.Errorf("%s: expected a string", at)
+			}
+			if _, err := s.resolve(ref); err != nil {
+				return fmt.Errorf("%s: %v", at, err)
+			}
+		case "pattern":
+			pattern, ok := value.(string)
+			if !ok {
+				return fmt.Errorf("%s: expected a string", at)
+			}
+			if _, err := s.pattern(pattern); err != nil {
+				return fmt.Errorf("%s: %v", at, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (s *Schema) checkSub(v any, path string) error {
+	sub, ok := v.(map[string]any)
+	if !ok {
+		return fmt.Errorf("%s: expected a schema", path)
+	}
+	return s.check(sub, path)
+}
+
+func decodeJSON(data []byte) (any, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	if dec.More() {
+		return nil, errors.New("unexpected data after JSON value")
+	}
+	return v, nil
+}
+
+// Validate returns a SchemaError if doc isn't valid JSON or doesn't match the schema.
+func (s *Schema) Validate(doc []byte) error {
+	v, err := decodeJSON(doc)
+	if err != nil {
+		return SchemaError{fmt.Sprintf("invalid JSON: %s", err)}
+	}
+	var errs SchemaError
+	s.validate(s.root, v, "$", &errs, 0)
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// maxSchemaDepth guards against recursive $refs.
+const maxSchemaDepth = 64
+
+func (s *Schema) validate(schema map[string]any, v any, path string, errs *SchemaError, depth int) {
+	if len(*errs) >= maxSchemaErrors {
+		return
+	}
+	if depth > maxSchemaDepth {
+		*errs = append(*errs, path+": schema nesting too deep")
+		return
+	}
+	fail := func(format string, args ...any) {
+		if len(*errs) < maxSchemaErrors {
+			*errs = append(*errs, path+": "+fmt.Sprintf(format, args...))
+		}
+	}
+
+	if ref, ok := schema["$ref"].(string); ok {
+		target, err := s.resolve(ref)
+		if err != nil {
+			fail("%s", err)
+			return
+		}
+		s.validate(target, v, path, errs, depth+1)
+	}
+
+	if t, ok := schema["type"]; ok && !matchesType(t, v) {
+		fail("expected %s, got %s", typeNames(t), jsonType(v))
+		return
+	}
+	if enum, ok := schema["enum"].([]any); ok {
+		found := false
+		for _, e := range enum {
+			if jsonEqual(e, v) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			fail("value is not one of the allowed values")
+		}
+	}
+	if c, ok := schema["const"]; ok && !jsonEqual(c, v) {
+		fail("value must be %v", c)
+	}
+
+	for _, sub := range schemaList(schema["allOf"]) {
+		s.validate(sub, v, path, errs, depth+1)
+	}
+	if subs := schemaList(schema["anyOf"]); len(subs) > 0 && s.matching(subs, v, depth) == 0 {
+		fail("value matches none of anyOf")
+	}
+	if subs := schemaList(schema["oneOf"]); len(subs) > 0 {
+		if n := s.matching(subs, v, depth); n != 1 {
+			fail("value matches %d of oneOf, expected exactly 1", n)
+		}
+	}
+
+	switch v := v.(type) {
+	case map[string]any:
+		s.validateObject(schema, v, path, errs, depth, fail)
+	case []any:
+		if min, ok := number(schema["minItems"]); ok && float64(len(v)) < min {
+			fail("expected at least %v items", min)
+		}
+		if max, ok := number(schema["maxItems"]); ok && float64(len(v)) > max {
+			fail("expected at most %v items", max)
+		}
+		if items, ok := schema["items"].(map[string]any); ok {
+			for i, item := range v {
+				s.validate(items, item, fmt.Sprintf("%s[%d]", path, i), errs, depth+1)
+			}
+		}
+	case string:
+		n := float64(utf8.RuneCountInString(v))
+		if min, ok := number(schema["minLength"]); ok && n < min {
+			fail("expected at least %v characters", min)
+		}
+		if max, ok := number(schema["maxLength"]); ok && n > max {
+			fail("expected at most %v characters", max)
+		}
+		if pattern, ok := schema["pattern"].(string); ok {
+			re, err := s.pattern(pattern)
+			if err != nil {
+				fail("invalid pattern in schema: %s", err)
+			} else if !re.MatchString(v) {
+				fail("value does not match pattern %s", pattern)
+			}
+		}
+	case json.Number:
+		f, _ := v.Float64()
+		if min, ok := number(schema["minimum"]); ok && f < min {
+			fail("expected at least %v", min)
+		}
+		if max, ok := number(schema["maximum"]); ok && f > max {
+			fail("expected at most %v", max)
+		}
+		if min, ok := number(schema["exclusiveMinimum"]); ok && f <= min {
+			fail("expected more than %v", min)
+		}
+		if max, ok := number(schema["exclusiveMaximum"]); ok && f >= max {
+			fail("expected less than %v", max)
+		}
+	}
+}
+
+func (s *Schema) validateObject(schema map[string]any, v map[string]any, path string, errs *SchemaError, depth int, fail func(string, ...any)) {
+	if required, ok := schema["required"].([]any); ok {
+		for _, r := range required {
+			if name, ok := r.(string); ok {
+				if _, ok := v[name]; !ok {
+					fail("missing required property %q", name)
+				}
+			}
+		}
+	}
+	properties, _ := schema["properties"].(map[string]any)
+	// Validate in a stable order so that errors are deterministic.
+	keys := make([]string, 0, len(v))
+	for k := range v {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		propPath := path + "." + k
+		if prop, ok := properties[k].(map[string]any); ok {
+			s.validate(prop, v[k], propPath, errs, depth+1)
+			continue
+		}
+		switch additional := schema["additionalProperties"].(type) {
+		case bool:
+			if !additional {
+				fail("unexpected property %q", k)
+			}
+		case map[string]any:
+			s.validate(additional, v[k], propPath, errs, depth+1)
+		}
+	}
+}
+
+// matching counts the schemas v is valid against.
+func (s *Schema) matching(schemas []map[string]any, v any, depth int) int {
+	n := 0
+	for _, sub := range schemas {
+		var errs SchemaError
+		s.validate(sub, v, "$", &errs, depth+1)
+		if len(errs) == 0 {
+			n++
+		}
+	}
+	return n
+}
+
+// resolve looks up local references such as "#/$defs/item".
+func (s *Schema) resolve(ref string) (map[string]any, error) {
+	if !strings.HasPrefix(ref, "#") {
+		return nil, fmt.Errorf("unsupported $ref %s", ref)
+	}
+	var node any = s.root
+	for _, part := range strings.Split(strings.TrimPrefix(ref, "#"), "/") {
+		if part == "" {
+			continue
+		}
+		part = strings.NewReplacer("~1", "/", "~0", "~").Replace(part)
+		obj, ok := node.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("unresolvable $ref %s", ref)
+		}
+		node = obj[part]
+	}
+	target, ok := node.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("unresolvable $ref %s", ref)
+	}
+	return target, nil
+}
+
+func (s *Schema) pattern(pattern string) (*regexp.Regexp, error) {
+	if re, ok := s.patterns[pattern]; ok {
+		return re, nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	s.patterns[pattern] = re
+	return re, nil
+}
+
+func schemaList(v any) []map[string]any {
+	list, _ := v.([]any)
+	schemas := make([]map[string]any, 0, len(list))
+	for _, item := range list {
+		if schema, ok := item.(map[string]any); ok {
+			schemas = append(schemas, schema)
+		}
+	}
+	return schemas
+}
+
+func number(v any) (float64, bool) {
+	n, ok := v.(json.Number)
+	if !ok {
+		return 0, false
+	}
+	f, err := n.Float64()
+	return f, err == nil
+}
+
+func matchesType(t any, v any) bool {
+	switch t := t.(type) {
+	case string:
+		return isType(t, v)
+	case []any:
+		for _, name := range t {
+			if name, ok := name.(string); ok && isType(name, v) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+func isType(name string, v any) bool {
+	switch name {
+	case "integer":
+		n, ok := v.(json.Number)
+		if !ok {
+			return false
+		}
+		f, err := n.Float64()
+		return err == nil && f == math.Trunc(f)
+	case "number":
+		_, ok := v.(json.Number)
+		return ok
+	default:
+		return jsonType(v) == name
+	}
+}
+
+func jsonType(v any) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case json.Number:
+		return "number"
+	case string:
+		return "string"
+	case []any:
+		return "array"
+	case map[string]any:
+		return "object"
+	}
+	return "unknown"
+}
+
+func typeNames(t any) string {
+	if list, ok := t.([]any); ok {
+		names := make([]string, 0, len(list))
+		for _, name := range list {
+			names = append(names, fmt.Sprint(name))
+		}
+		return strings.Join(names, " or ")
+	}
+	return fmt.Sprint(t)
+}
+
+// jsonEqual compares decoded JSON values, numbers by value.
+func jsonEqual(a, b any) bool {
+	an, aok := a.(json.Number)
+	bn, bok := b.(json.Number)
+	if aok && bok {
+		af, _ := an.Float64()
+		bf, _ := bn.Float64()
+		return af == bf
+	}
+	return reflect.DeepEqual(a, b)
+}
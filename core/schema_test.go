@@ -0,0 +1,113 @@
+package core_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"magicrouter/core"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSchema_Validate(t *testing.T) {
+	schema, err := core.CompileSchema(json.RawMessage(`{
+		"type": "object",
+		"properties": {
+			"name": {"type": "string", "minLength": 1},
+			"age": {"type": "integer", "minimum": 0},
+			"tags": {"type": "array", "items": {"$ref": "#/$defs/tag"}, "maxItems": 2},
+			"role": {"enum": ["admin", "user"]},
+			"nickname": {"type": ["string", "null"]}
+		},
+		"required": ["name", "age"],
+		"additionalProperties": false,
+		"$defs": {
+			"tag": {"type": "string", "pattern": "^[a-z]+$"}
+		}
+	}`))
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name string
+		doc  string
+		errs []string
+	}{
+		{
+			name: "valid",
+			doc:  `{"name": "jane", "age": 30, "tags": ["a", "b"], "role": "admin", "nickname": null}`,
+		},
+		{
+			name: "invalid json",
+			doc:  "```json\n{\"name\": \"jane\"}\n```",
+			errs: []string{"invalid JSON: invalid character '`' looking for beginning of value"},
+		},
+		{
+			name: "missing and unexpected properties",
+			doc:  `{"name": "jane", "email": "jane@example.com"}`,
+			errs: []string{`$: missing required property "age"`, `$: unexpected property "email"`},
+		},
+		{
+			name: "wrong types and bounds",
+			doc:  `{"name": "", "age": 1.5, "tags": ["a", "B", "c"], "role": "root", "nickname": 1}`,
+			errs: []string{
+				"$.age: expected integer, got number",
+				"$.name: expected at least 1 characters",
+				"$.nickname: expected string or null, got number",
+				"$.role: value is not one of the allowed values",
+				"$.tags: expected at most 2 items",
+				"$.tags[1]: value does not match pattern ^[a-z]+$",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := schema.Validate([]byte(tt.doc))
+			if tt.errs == nil {
+				assert.NoError(t, err)
+				return
+			}
+			assert.Equal(t, core.SchemaError(tt.errs), err)
+		})
+	}
+}
+
+func TestSchema_Combinators(t *testing.T) {
+	schema, err := core.CompileSchema(json.RawMessage(`{
+		"anyOf": [{"type": "string"}, {"type": "number"}],
+		"oneOf": [{"type": "integer"}, {"type": "number"}]
+	}`))
+	assert.NoError(t, err)
+	assert.NoError(t, schema.Validate([]byte(`1.5`)))
+	assert.Error(t, schema.Validate([]byte(`1`)), "matches both oneOf schemas")
+	assert.Error(t, schema.Validate([]byte(`"x"`)), "matches no oneOf schema")
+	assert.Error(t, schema.Validate([]byte(`true`)))
+}
+
+func TestCompileSchema_Unsupported(t *testing.T) {
+	tests := []struct {
+		name   string
+		schema string
+	}{
+		{name: "not an object", schema: `[]`},
+		{name: "unsupported keyword", schema: `{"type": "string", "format": "date-time"}`},
+		{name: "nested unsupported keyword", schema: `{"properties": {"tags": {"items": {"uniqueItems": true}}}}`},
+		{name: "tuple items", schema: `{"items": [{"type": "string"}]}`},
+		{name: "remote ref", schema: `{"$ref": "https://example.com/schema.json"}`},
+		{name: "unresolved ref", schema: `{"$ref": "#/$defs/missing"}`},
+		{name: "invalid pattern", schema: `{"pattern": "("}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := core.CompileSchema(json.RawMessage(tt.schema))
+			assert.ErrorIs(t, err, core.ErrUnsupportedSchema)
+		})
+	}
+
+	_, err := core.CompileSchema(json.RawMessage(`{
+		"title": "person", "description": "a person",
+		"$defs": {"name": {"type": "string", "pattern": "^[a-z]+$"}},
+		"properties": {"name": {"$ref": "#/$defs/name"}},
+		"additionalProperties": false
+	}`))
+	assert.NoError(t, err)
+}
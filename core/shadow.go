@@ -0,0 +1,166 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+// shadowTimeout bounds how long a shadow request may run, it isn't tied to the client.
+const shadowTimeout = 5 * time.Minute
+
+// ShadowConfig mirrors a percentage of a project's requests to a candidate route.
+type ShadowConfig struct {
+	Route Route `json:"route"`
+	// Percent of requests (0-100) that are mirrored.
+	Percent float64 `json:"percent"`
+}
+
+// ShadowResult describes the response of one side of a shadowed request.
+type ShadowResult struct {
+	RouteID    string  `json:"route_id"`
+	Model      string  `json:"model"`
+	StatusCode int     `json:"status_code,omitempty"`
+	LatencyMS  int64   `json:"latency_ms"`
+	Usage      Usage   `json:"usage"`
+	Cost       float64 `json:"cost"`
+	Output     string  `json:"output"`
+	Error      string  `json:"error,omitempty"`
+}
+
+// ShadowComparison is written to the log sink for each shadowed request.
+type ShadowComparison struct {
+	ProjectID string       `json:"project_id"`
+	Primary   ShadowResult `json:"primary"`
+	Shadow    ShadowResult `json:"shadow"`
+}
+
+// Shadower mirrors requests to shadow routes in the background. Shadow requests
+// have their own concurrency limit and are dropped when it is reached, so they
+// can't starve real traffic.
+type Shadower struct {
+	services ChatServices
+	sink     LogSink
+	pricing  PricingCatalog
+	slots    chan struct{}
+	rand     func() float64
+}
+
+func NewShadower(services ChatServices, sink LogSink, pricing PricingCatalog, maxConcurrent int) *Shadower {
+	return &Shadower{
+		services: services,
+		sink:     sink,
+		pricing:  pricing,
+		slots:    make(chan struct{}, maxConcurrent),
+		rand:     rand.Float64,
+	}
+}
+
+// ShadowRun is an in-flight shadow request.
+type ShadowRun struct {
+	primary chan ShadowResult
+}
+
+// Finish hands over the result of the primary request so that it can be compared.
+// It must be called once for every run returned by Mirror.
+func (r *ShadowRun) Finish(primary ShadowResult) {
+	r.primary <- primary
+}
+
+// Mirror starts sending req to the shadow route unless the request isn't sampled
+// or the concurrency limit is reached, in which case it returns nil.
+func (s *Shadower) Mirror(ctx context.Context, projectID string, cfg ShadowConfig, req json.RawMessage) *ShadowRun {
+	if s.rand()*100 >= cfg.Percent {
+		return nil
+	}
+	select {
+	case s.slots <- struct{}{}:
+	default:
+		log.Warn().Str("project_id", projectID).Msg("shadow concurrency limit reached")
+		return nil
+	}
+
+	run := &ShadowRun{primary: make(chan ShadowResult, 1)}
+	go func() {
+		defer func() { <-s.slots }()
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), shadowTimeout)
+		defer cancel()
+
+		shadow := s.send(ctx, cfg.Route, req)
+		var primary ShadowResult
+		select {
+		case primary = <-run.primary:
+		case <-ctx.Done():
+			return
+		}
+		err := s.sink.Write(ctx, "shadow_comparison", ShadowComparison{
+			ProjectID: projectID,
+			Primary:   primary,
+			Shadow:    shadow,
+		})
+		if err != nil {
+			log.Err(err).Msg("failed to write shadow comparison")
+		}
+	}()
+	return run
+}
+
+func (s *Shadower) send(ctx context.Context, route Route, req json.RawMessage) ShadowResult {
+	result := ShadowResult{RouteID: route.ID, Model: route.Model}
+	start := time.Now()
+	body, err := s.do(ctx, route, req, &result)
+	result.LatencyMS = time.Since(start).Milliseconds()
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	result.Output = CompletionText(body)
+	if usage, ok := ParseUsage(body); ok {
+		result.Usage = usage
+		result.Cost, _ = s.pricing.Cost(route, usage)
+	}
+	return result
+}
+
+func (s *Shadower) do(ctx context.Context, route Route, req json.RawMessage, result *ShadowResult) ([]byte, error) {
+	svc, ok := s.services[route.Provider]
+	if !ok {
+		return nil, fmt.Errorf("unknown provider: %s", route.Provider)
+	}
+	// Shadow responses are compared as a whole, there's no client to stream to.
+	req, err := sjson.SetBytes(req, "stream", false)
+	if err != nil {
+		return nil, fmt.Errorf("failed to disable streaming: %w", err)
+	}
+	req, err = sjson.DeleteBytes(req, "stream_options")
+	if err != nil {
+		return nil, fmt.Errorf("failed to remove stream options: %w", err)
+	}
+	resp, err := callRoute(ctx, svc, req, route)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	result.StatusCode = resp.StatusCode
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response body: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("provider responded with status %d: %s", resp.StatusCode, body)
+	}
+	return body, nil
+}
+
+// CompletionText returns the content of the first choice of a chat completion response.
+func CompletionText(body []byte) string {
+	return gjson.GetBytes(body, "choices.0.message.content").String()
+}
@@ -0,0 +1,82 @@
+package core_test
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"magicrouter/core"
+	"magicrouter/mocks"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestShadower_Mirror(t *testing.T) {
+	cfg := core.ShadowConfig{
+		Route:   core.Route{ID: "shadow", Provider: "openai", Model: "candidate"},
+		Percent: 100,
+	}
+	pricing := core.PricingCatalog{"openai": {"candidate": {Input: 1, Output: 2}}}
+	req := json.RawMessage(`{"stream": true, "stream_options": {"include_usage": true}}`)
+
+	t.Run("records both responses", func(t *testing.T) {
+		mockService := mocks.NewChatService(t)
+		mockService.
+			On("ChatCompletion", mock.Anything, json.RawMessage(`{"stream": false}`), "candidate", "").
+			Return(textResponse(`{"choices": [{"message": {"content": "shadow says hi"}}], "usage": {"prompt_tokens": 10, "completion_tokens": 5}}`), nil).
+			Once()
+		written := make(chan core.ShadowComparison, 1)
+		sink := mocks.NewLogSink(t)
+		sink.On("Write", mock.Anything, "shadow_comparison", mock.Anything).
+			Run(func(args mock.Arguments) { written <- args.Get(2).(core.ShadowComparison) }).
+			Return(nil).
+			Once()
+
+		shadower := core.NewShadower(core.ChatServices{"openai": mockService}, sink, pricing, 1)
+		run := shadower.Mirror(context.Background(), "project1", cfg, req)
+		assert.NotNil(t, run)
+		run.Finish(core.ShadowResult{RouteID: "route1", Output: "primary says hi"})
+
+		select {
+		case comparison := <-written:
+			assert.Equal(t, "project1", comparison.ProjectID)
+			assert.Equal(t, "primary says hi", comparison.Primary.Output)
+			assert.Equal(t, "shadow", comparison.Shadow.RouteID)
+			assert.Equal(t, "shadow says hi", comparison.Shadow.Output)
+			assert.Equal(t, 10, comparison.Shadow.Usage.PromptTokens)
+			assert.InDelta(t, 20/1e6, comparison.Shadow.Cost, 1e-12)
+		case <-time.After(time.Second):
+			t.Fatal("shadow comparison not written")
+		}
+	})
+
+	t.Run("not sampled", func(t *testing.T) {
+		shadower := core.NewShadower(nil, mocks.NewLogSink(t), pricing, 1)
+		cfg := cfg
+		cfg.Percent = 0
+		assert.Nil(t, shadower.Mirror(context.Background(), "project1", cfg, req))
+	})
+
+	t.Run("concurrency limit", func(t *testing.T) {
+		mockService := mocks.NewChatService(t)
+		mockService.
+			On("ChatCompletion", mock.Anything, mock.Anything, "candidate", "").
+			Return(textResponse(`{}`), nil).
+			Once()
+		done := make(chan struct{})
+		sink := mocks.NewLogSink(t)
+		sink.On("Write", mock.Anything, "shadow_comparison", mock.Anything).
+			Run(func(mock.Arguments) { close(done) }).
+			Return(nil).
+			Once()
+
+		shadower := core.NewShadower(core.ChatServices{"openai": mockService}, sink, pricing, 1)
+		run := shadower.Mirror(context.Background(), "project1", cfg, req)
+		assert.NotNil(t, run)
+		assert.Nil(t, shadower.Mirror(context.Background(), "project1", cfg, req))
+		run.Finish(core.ShadowResult{})
+		<-done
+	})
+}
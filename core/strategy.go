@@ -0,0 +1,36 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// RoutingStrategy decides the order in which routes are attempted.
+type RoutingStrategy interface {
+	// Order returns the routes to attempt, in order. routes are sorted by priority.
+	Order(ctx context.Context, req json.RawMessage, routes []Route) []Route
+}
+
+// ResponseObserver is implemented by strategies that learn from the responses of routes.
+type ResponseObserver interface {
+	// Observe is called with each response, whatever its status. It may wrap resp.Body.
+	Observe(route Route, start time.Time, resp *http.Response)
+	// ObserveFailure is called when an attempt fails without a response.
+	ObserveFailure(route Route, start time.Time)
+}
+
+// tiers returns the bounds of each run of routes with the same priority.
+func tiers(routes []Route) [][2]int {
+	var bounds [][2]int
+	for start := 0; start < len(routes); {
+		end := start + 1
+		for end < len(routes) && routes[end].Priority == routes[start].Priority {
+			end++
+		}
+		bounds = append(bounds, [2]int{start, end})
+		start = end
+	}
+	return bounds
+}
@@ -0,0 +1,152 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+var ErrInvalidStructuredOutput = errors.New("no route returned output matching the response format")
+
+// repairPrompt asks a route to fix output that didn't match the requested schema.
+const repairPrompt = "Your previous response did not match the required JSON schema: %s. Respond again with only JSON that matches the schema."
+
+// StructuredOutputConfig validates the output of non-streaming requests with a JSON
+// response format and retries those whose output is invalid.
+type StructuredOutputConfig struct {
+	// MaxRetries is the number of attempts made after invalid output.
+	MaxRetries int `json:"max_retries"`
+	// RetrySameRoute retries on the route that returned invalid output instead of the next one.
+	RetrySameRoute bool `json:"retry_same_route,omitempty"`
+	// RepairPrompt adds the invalid output and the validation error to retried requests.
+	RepairPrompt bool `json:"repair_prompt,omitempty"`
+}
+
+// WithStructuredOutput validates the output of requests with a JSON response format, see StructuredOutputConfig.
+func WithStructuredOutput(cfg StructuredOutputConfig) FallbackOption {
+	return func(s *FallbackChatService) {
+		s.structured = &cfg
+	}
+}
+
+// responseSchema returns the schema the output of req must match, nil if it has none.
+func responseSchema(req json.RawMessage) (*Schema, error) {
+	if gjson.GetBytes(req, "stream").Bool() {
+		return nil, nil
+	}
+	switch gjson.GetBytes(req, "response_format.type").String() {
+	case "json_schema":
+		schema := gjson.GetBytes(req, "response_format.json_schema.schema")
+		if !schema.Exists() {
+			return nil, nil
+		}
+		return CompileSchema(json.RawMessage(schema.Raw))
+	case "json_object":
+		return CompileSchema(json.RawMessage(`{"type": "object"}`))
+	}
+	return nil, nil
+}
+
+// validated attempts routes until one returns output matching schema or the retries run out.
+func (s *FallbackChatService) validated(ctx context.Context, req json.RawMessage, schema *Schema) (*Completion, error) {
+	// Attempts are plain fallbacks over the routes that haven't returned invalid output.
+	inner := *s
+	inner.structured = nil
+	attemptReq := req
+	var failures []string
+	for attempt := 0; ; attempt++ {
+		completion, err := inner.ChatCompletion(ctx, attemptReq)
+		if err != nil {
+			if len(failures) > 0 {
+				return nil, fmt.Errorf("%w: %v", ErrInvalidStructuredOutput, err)
+			}
+			return nil, err
+		}
+		if completion.StatusCode != http.StatusOK {
+			return completion, nil
+		}
+		body, err := io.ReadAll(completion.Body)
+		completion.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read response body: %w", err)
+		}
+		completion.Body = io.NopCloser(bytes.NewReader(body))
+
+		output, verr := validateOutput(schema, body)
+		if verr == nil {
+			return completion, nil
+		}
+		// The invalid output was paid for even though it's discarded.
+		recordDiscardedUsage(ctx, completion.Route, body)
+		failures = append(failures, fmt.Sprintf("%s: %s", completion.Route.ID, verr))
+		Logger(ctx).Warn().
+			Str("route_id", completion.Route.ID).
+			Int("attempt", attempt).
+			Str("error", verr.Error()).
+			Msg("structured_output_invalid")
+		if attempt >= s.structured.MaxRetries {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidStructuredOutput, failures)
+		}
+
+		if !s.structured.RetrySameRoute {
+			inner.routes = slices.DeleteFunc(slices.Clone(inner.routes), func(r Route) bool {
+				return r.ID == completion.Route.ID
+			})
+			if len(inner.routes) == 0 {
+				return nil, fmt.Errorf("%w: %v", ErrInvalidStructuredOutput, failures)
+			}
+		}
+		if s.structured.RepairPrompt {
+			if attemptReq, err = repairRequest(req, output, verr); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+// validateOutput validates the content of every choice of a chat completion body and
+// returns the first invalid one. Refusals are valid, they aren't going to improve, and so
+// are tool calls, whose output isn't the content.
+func validateOutput(schema *Schema, body []byte) (string, error) {
+	choices := gjson.GetBytes(body, "choices").Array()
+	if len(choices) == 0 {
+		return "", errors.New("response has no choices")
+	}
+	for _, choice := range choices {
+		if choice.Get("message.refusal").String() != "" || len(choice.Get("message.tool_calls").Array()) > 0 {
+			continue
+		}
+		content := choice.Get("message.content").String()
+		if err := schema.Validate([]byte(content)); err != nil {
+			return content, err
+		}
+	}
+	return "", nil
+}
+
+// repairRequest appends the invalid output and a prompt to fix it to req.
+func repairRequest(req json.RawMessage, output string, verr error) (json.RawMessage, error) {
+	req, err := sjson.SetBytes(req, "messages.-1", map[string]string{
+		"role":    "assistant",
+		"content": output,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to append invalid output: %w", err)
+	}
+	req, err = sjson.SetBytes(req, "messages.-1", map[string]string{
+		"role":    "user",
+		"content": fmt.Sprintf(repairPrompt, verr),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to append repair prompt: %w", err)
+	}
+	return req, nil
+}
@@ -0,0 +1,125 @@
+package core_test
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"testing"
+
+	"magicrouter/core"
+	"magicrouter/mocks"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/tidwall/gjson"
+)
+
+func completionResponse(content string) string {
+	body, _ := json.Marshal(map[string]any{
+		"id":      "chatcmpl-1",
+		"object":  "chat.completion",
+		"choices": []any{map[string]any{"index": 0, "message": map[string]any{"role": "assistant", "content": content}, "finish_reason": "stop"}},
+	})
+	return string(body)
+}
+
+func TestFallbackChatService_StructuredOutput(t *testing.T) {
+	routes := []core.Route{
+		{ID: "route1", Priority: 1, Provider: "openai", Model: "sloppy"},
+		{ID: "route2", Priority: 2, Provider: "openai", Model: "strict"},
+	}
+	req := json.RawMessage(`{"messages": [{"role": "user", "content": "Hi"}], "response_format": {"type": "json_schema", "json_schema": {"name": "answer", "schema": {"type": "object", "properties": {"answer": {"type": "string"}}, "required": ["answer"]}}}}`)
+	messages := func(n int) any {
+		return mock.MatchedBy(func(req json.RawMessage) bool {
+			return len(gjson.GetBytes(req, "messages").Array()) == n
+		})
+	}
+
+	t.Run("retries invalid output on the next route with a repair prompt", func(t *testing.T) {
+		mockService := mocks.NewChatService(t)
+		mockService.On("ChatCompletion", mock.Anything, messages(1), "sloppy", "").
+			Return(textResponse(completionResponse(`{"reply": "Hello"}`)), nil).Once()
+		mockService.On("ChatCompletion", mock.Anything, mock.MatchedBy(func(req json.RawMessage) bool {
+			msgs := gjson.GetBytes(req, "messages").Array()
+			return len(msgs) == 3 &&
+				msgs[1].Get("content").String() == `{"reply": "Hello"}` &&
+				msgs[2].Get("role").String() == "user"
+		}), "strict", "").
+			Return(textResponse(completionResponse(`{"answer": "Hello"}`)), nil).Once()
+
+		svc := core.NewFallbackChatService(routes, core.ChatServices{"openai": mockService}, core.NoOpBreaker{},
+			core.WithStructuredOutput(core.StructuredOutputConfig{MaxRetries: 1, RepairPrompt: true}))
+		resp, err := svc.ChatCompletion(context.Background(), req)
+		assert.NoError(t, err)
+		assert.Equal(t, "route2", resp.Route.ID)
+
+		body, err := io.ReadAll(resp.Body)
+		assert.NoError(t, err)
+		assert.Equal(t, `{"answer": "Hello"}`, gjson.GetBytes(body, "choices.0.message.content").String())
+	})
+
+	t.Run("retries on the same route", func(t *testing.T) {
+		mockService := mocks.NewChatService(t)
+		mockService.On("ChatCompletion", mock.Anything, messages(1), "sloppy", "").
+			Return(textResponse(completionResponse(`not json`)), nil).Once()
+		mockService.On("ChatCompletion", mock.Anything, messages(1), "sloppy", "").
+			Return(textResponse(completionResponse(`{"answer": "Hello"}`)), nil).Once()
+
+		svc := core.NewFallbackChatService(routes, core.ChatServices{"openai": mockService}, core.NoOpBreaker{},
+			core.WithStructuredOutput(core.StructuredOutputConfig{MaxRetries: 1, RetrySameRoute: true}))
+		resp, err := svc.ChatCompletion(context.Background(), req)
+		assert.NoError(t, err)
+		assert.Equal(t, "route1", resp.Route.ID)
+	})
+
+	t.Run("fails when retries run out", func(t *testing.T) {
+		mockService := mocks.NewChatService(t)
+		mockService.On("ChatCompletion", mock.Anything, messages(1), "sloppy", "").
+			Return(textResponse(`{"choices": [{"message": {"content": "{}"}}], "usage": {"prompt_tokens": 10, "completion_tokens": 2}}`), nil).Once()
+
+		var billed []string
+		ctx := core.WithUsageRecorder(context.Background(), func(route core.Route, usage core.Usage) {
+			billed = append(billed, route.ID)
+			assert.Equal(t, 10, usage.PromptTokens)
+		})
+		svc := core.NewFallbackChatService(routes, core.ChatServices{"openai": mockService}, core.NoOpBreaker{},
+			core.WithStructuredOutput(core.StructuredOutputConfig{MaxRetries: 0}))
+		_, err := svc.ChatCompletion(ctx, req)
+		assert.ErrorIs(t, err, core.ErrInvalidStructuredOutput)
+		// The invalid output is billed although it's discarded.
+		assert.Equal(t, []string{"route1"}, billed)
+	})
+
+	t.Run("accepts tool calls", func(t *testing.T) {
+		mockService := mocks.NewChatService(t)
+		mockService.On("ChatCompletion", mock.Anything, mock.Anything, "sloppy", "").
+			Return(textResponse(`{"choices": [{"message": {"content": null, "tool_calls": [{"id": "call_1", "type": "function", "function": {"name": "lookup", "arguments": "{}"}}]}}]}`), nil).Once()
+
+		svc := core.NewFallbackChatService(routes, core.ChatServices{"openai": mockService}, core.NoOpBreaker{},
+			core.WithStructuredOutput(core.StructuredOutputConfig{MaxRetries: 1}))
+		resp, err := svc.ChatCompletion(context.Background(), json.RawMessage(`{"messages": [{"role": "user", "content": "Hi"}], "response_format": {"type": "json_object"}}`))
+		assert.NoError(t, err)
+		assert.Equal(t, "route1", resp.Route.ID)
+	})
+
+	t.Run("ignores requests without a response format", func(t *testing.T) {
+		mockService := mocks.NewChatService(t)
+		mockService.On("ChatCompletion", mock.Anything, mock.Anything, "sloppy", "").
+			Return(textResponse(completionResponse(`plain text`)), nil).Once()
+
+		svc := core.NewFallbackChatService(routes, core.ChatServices{"openai": mockService}, core.NoOpBreaker{},
+			core.WithStructuredOutput(core.StructuredOutputConfig{MaxRetries: 1}))
+		resp, err := svc.ChatCompletion(context.Background(), json.RawMessage(`{"messages": [{"role": "user", "content": "Hi"}]}`))
+		assert.NoError(t, err)
+		assert.Equal(t, "route1", resp.Route.ID)
+	})
+
+	t.Run("rejects schemas it can't validate", func(t *testing.T) {
+		mockService := mocks.NewChatService(t)
+
+		svc := core.NewFallbackChatService(routes, core.ChatServices{"openai": mockService}, core.NoOpBreaker{},
+			core.WithStructuredOutput(core.StructuredOutputConfig{MaxRetries: 1}))
+		_, err := svc.ChatCompletion(context.Background(), json.RawMessage(`{"messages": [{"role": "user", "content": "Hi"}], "response_format": {"type": "json_schema", "json_schema": {"name": "date", "schema": {"type": "string", "format": "date"}}}}`))
+		assert.ErrorIs(t, err, core.ErrUnsupportedSchema)
+	})
+}
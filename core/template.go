@@ -0,0 +1,70 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+var (
+	ErrTemplateNotFound        = errors.New("prompt template not found")
+	ErrTemplateVariableMissing = errors.New("prompt template variable missing")
+)
+
+// TemplateMessage is a chat message whose content may reference {{variables}}.
+type TemplateMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+// PromptTemplate is one version of a named prompt template.
+type PromptTemplate struct {
+	ID        string            `json:"id"`
+	Version   int               `json:"version"`
+	Messages  []TemplateMessage `json:"messages"`
+	CreatedAt time.Time         `json:"created_at"`
+}
+
+// templateVariable matches {{name}}, spaces inside the braces are allowed.
+var templateVariable = regexp.MustCompile(`{{\s*([A-Za-z0-9_.-]+)\s*}}`)
+
+// Render substitutes vars in the template's messages. Every referenced variable must be set.
+func (t *PromptTemplate) Render(vars map[string]string) ([]TemplateMessage, error) {
+	var missing []string
+	messages := make([]TemplateMessage, len(t.Messages))
+	for i, msg := range t.Messages {
+		content := templateVariable.ReplaceAllStringFunc(msg.Content, func(ref string) string {
+			name := templateVariable.FindStringSubmatch(ref)[1]
+			value, ok := vars[name]
+			if !ok {
+				missing = append(missing, name)
+			}
+			return value
+		})
+		messages[i] = TemplateMessage{Role: msg.Role, Content: content}
+	}
+	if len(missing) > 0 {
+		slices.Sort(missing)
+		missing = slices.Compact(missing)
+		return nil, fmt.Errorf("%w: %s", ErrTemplateVariableMissing, strings.Join(missing, ", "))
+	}
+	return messages, nil
+}
+
+// TemplateStore keeps the versions of each project's prompt templates. Versions are
+// numbered from 1 and immutable, requests use the active version unless they pin one.
+type TemplateStore interface {
+	// GetTemplate returns version of the template, the active version if zero.
+	GetTemplate(ctx context.Context, projectID, id string, version int) (*PromptTemplate, error)
+	// ListTemplateVersions returns every version of the template, oldest first, and the active version.
+	ListTemplateVersions(ctx context.Context, projectID, id string) ([]PromptTemplate, int, error)
+	// CreateTemplateVersion stores messages as the next version. The first version
+	// becomes active, later ones have to be promoted.
+	CreateTemplateVersion(ctx context.Context, projectID, id string, messages []TemplateMessage) (*PromptTemplate, error)
+	// PromoteTemplateVersion makes version the active one.
+	PromoteTemplateVersion(ctx context.Context, projectID, id string, version int) error
+}
@@ -0,0 +1,31 @@
+package core_test
+
+import (
+	"testing"
+
+	"magicrouter/core"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPromptTemplate_Render(t *testing.T) {
+	tmpl := core.PromptTemplate{
+		ID:      "support",
+		Version: 2,
+		Messages: []core.TemplateMessage{
+			{Role: "system", Content: "You help customers of {{company}}."},
+			{Role: "user", Content: "My name is {{ name }}, I have a question about {{product}} from {{company}}."},
+		},
+	}
+
+	messages, err := tmpl.Render(map[string]string{"company": "Acme", "name": "Jo", "product": "anvils"})
+	assert.NoError(t, err)
+	assert.Equal(t, []core.TemplateMessage{
+		{Role: "system", Content: "You help customers of Acme."},
+		{Role: "user", Content: "My name is Jo, I have a question about anvils from Acme."},
+	}, messages)
+
+	_, err = tmpl.Render(map[string]string{"name": "Jo"})
+	assert.ErrorIs(t, err, core.ErrTemplateVariableMissing)
+	assert.EqualError(t, err, "prompt template variable missing: company, product")
+}
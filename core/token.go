@@ -1,5 +1,14 @@
 package core
 
+// Token is an API token (virtual key) handed out to a client of a project.
+type Token struct {
+	ID        string  `json:"id"`
+	ProjectID string  `json:"project_id"`
+	Budget    *Budget `json:"budget,omitempty"`
+	// Priority orders requests waiting for a concurrency slot, higher first.
+	Priority int `json:"priority,omitempty"`
+}
+
 type TokenResolver interface {
-	Resolve(apiToken string) (projectID string, err error)
+	Resolve(apiToken string) (*Token, error)
 }
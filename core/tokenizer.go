@@ -0,0 +1,76 @@
+package core
+
+import (
+	"encoding/json"
+	"regexp"
+	"unicode/utf8"
+
+	"github.com/tidwall/gjson"
+)
+
+// pretokenize splits text the way OpenAI's BPE tokenizers do before merging, minus the lookaheads.
+var pretokenize = regexp.MustCompile(`(?i:'s|'t|'re|'ve|'m|'ll|'d)| ?\p{L}+| ?\p{N}{1,3}| ?[^\s\p{L}\p{N}]+|\s+`)
+
+const (
+	// defaultOutputTokens is assumed for requests that don't set max_tokens.
+	defaultOutputTokens = 256
+	// tokensPerMessage is the overhead of the role and delimiters of each message.
+	tokensPerMessage = 3
+	// tokensPerReply primes the assistant's reply.
+	tokensPerReply = 3
+)
+
+// CountTokens approximates the number of tokens of text without needing the model's vocabulary.
+// It is tuned to slightly overestimate English text so that windows aren't overrun.
+func CountTokens(text string) int {
+	tokens := 0
+	for _, piece := range pretokenize.FindAllString(text, -1) {
+		runes := utf8.RuneCountInString(piece)
+		if runes != len(piece) {
+			// Non latin scripts take about a token per character.
+			tokens += runes
+			continue
+		}
+		// Common words are a single token, long and rare ones are split every ~6 characters.
+		tokens += 1 + (len(piece)-1)/6
+	}
+	return tokens
+}
+
+// EstimatePromptTokens estimates the number of prompt tokens of a chat completion request,
+// counting the text of messages, tool calls and tool definitions.
+func EstimatePromptTokens(req json.RawMessage) int {
+	tokens := tokensPerReply
+	for _, msg := range gjson.GetBytes(req, "messages").Array() {
+		tokens += tokensPerMessage
+		if name := msg.Get("name"); name.Exists() {
+			tokens += CountTokens(name.String())
+		}
+		content := msg.Get("content")
+		if content.IsArray() {
+			for _, part := range content.Array() {
+				tokens += CountTokens(part.Get("text").String())
+			}
+		} else {
+			tokens += CountTokens(content.String())
+		}
+		for _, call := range msg.Get("tool_calls").Array() {
+			tokens += CountTokens(call.Get("function.name").String())
+			tokens += CountTokens(call.Get("function.arguments").String())
+		}
+	}
+	if tools := gjson.GetBytes(req, "tools"); tools.Exists() {
+		tokens += CountTokens(tools.Raw)
+	}
+	return tokens
+}
+
+// MaxOutputTokens returns the output token limit requested, or def if none is set.
+func MaxOutputTokens(req json.RawMessage, def int) int {
+	for _, field := range []string{"max_completion_tokens", "max_tokens"} {
+		if v := gjson.GetBytes(req, field); v.Exists() {
+			return int(v.Int())
+		}
+	}
+	return def
+}
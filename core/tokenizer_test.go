@@ -0,0 +1,75 @@
+package core_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+
+	"magicrouter/core"
+	"magicrouter/mocks"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestCountTokens(t *testing.T) {
+	tests := []struct {
+		text   string
+		tokens int
+	}{
+		{"", 0},
+		{"Hello, world!", 4},
+		{"I'm here", 3},
+		{"12345678", 3},
+		{"internationalization", 4},
+		{"こんにちは", 5},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.tokens, core.CountTokens(tt.text), tt.text)
+	}
+}
+
+func TestEstimatePromptTokens(t *testing.T) {
+	req := json.RawMessage(`{"messages": [
+		{"role": "system", "content": "Hello, world!"},
+		{"role": "user", "content": [{"type": "text", "text": "Hello, world!"}, {"type": "image_url", "image_url": {"url": "https://example.com"}}]}
+	]}`)
+	// 2 messages * (3 overhead + 4) + 3 reply priming
+	assert.Equal(t, 17, core.EstimatePromptTokens(req))
+}
+
+func TestFallbackChatService_ContextWindow(t *testing.T) {
+	// ~1000 prompt tokens
+	req, _ := json.Marshal(map[string]any{
+		"messages":   []map[string]string{{"role": "user", "content": strings.Repeat("hello ", 1000)}},
+		"max_tokens": 500,
+	})
+	routes := []core.Route{
+		{ID: "small", Priority: 1, Provider: "openai", Model: "small", ContextWindow: 1024},
+		{ID: "short", Priority: 2, Provider: "openai", Model: "short", MaxOutputTokens: 256},
+		{ID: "large", Priority: 3, Provider: "openai", Model: "large", ContextWindow: 8192},
+	}
+
+	t.Run("skips routes that don't fit", func(t *testing.T) {
+		mockService := mocks.NewChatService(t)
+		mockService.
+			On("ChatCompletion", mock.Anything, mock.Anything, "large", "").
+			Return(&http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil).
+			Once()
+		svc := core.NewFallbackChatService(routes, core.ChatServices{"openai": mockService}, core.NoOpBreaker{})
+		resp, err := svc.ChatCompletion(context.Background(), req)
+		assert.NoError(t, err)
+		assert.Equal(t, "large", resp.Route.ID)
+	})
+
+	t.Run("no route fits", func(t *testing.T) {
+		mockService := mocks.NewChatService(t)
+		svc := core.NewFallbackChatService(routes[:2], core.ChatServices{"openai": mockService}, core.NoOpBreaker{})
+		resp, err := svc.ChatCompletion(context.Background(), req)
+		assert.True(t, errors.Is(err, core.ErrContextLengthExceeded))
+		assert.Nil(t, resp)
+	})
+}
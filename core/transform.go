@@ -0,0 +1,153 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+// protectedParams can't be stripped, nor can their fields, the router relies on them.
+var protectedParams = []string{"model", "messages", "stream", "stream_options"}
+
+// protected reports whether param is or is part of a protected parameter.
+func protected(param string) bool {
+	return slices.ContainsFunc(protectedParams, func(p string) bool {
+		return param == p || strings.HasPrefix(param, p+".")
+	})
+}
+
+// TransformConfig rewrites requests before they are routed.
+type TransformConfig struct {
+	// SystemPrepend is inserted as a system message before the request's messages.
+	SystemPrepend string `json:"system_prepend,omitempty"`
+	// SystemAppend is added as a system message after the request's messages.
+	SystemAppend string `json:"system_append,omitempty"`
+	// Defaults sets parameters the request doesn't, e.g. {"temperature": 0.7}.
+	Defaults map[string]json.RawMessage `json:"defaults,omitempty"`
+	// MaxTokens clamps max_tokens and max_completion_tokens. Zero means no limit.
+	MaxTokens int `json:"max_tokens,omitempty"`
+	// MaxN clamps the number of choices. Zero means no limit.
+	MaxN int `json:"max_n,omitempty"`
+	// Strip removes parameters clients aren't allowed to set, e.g. "logit_bias".
+	// Stripped parameters can be given a fixed value with Defaults.
+	Strip []string `json:"strip,omitempty"`
+}
+
+// Apply strips disallowed parameters, sets defaults, clamps limits and adds the system messages.
+func (c TransformConfig) Apply(req json.RawMessage) (json.RawMessage, error) {
+	var err error
+	for _, param := range c.Strip {
+		if protected(param) {
+			continue
+		}
+		if req, err = sjson.DeleteBytes(req, param); err != nil {
+			return nil, fmt.Errorf("failed to strip %s: %w", param, err)
+		}
+	}
+
+	// Set defaults in a stable order so that identical requests stay identical.
+	params := make([]string, 0, len(c.Defaults))
+	for param := range c.Defaults {
+		params = append(params, param)
+	}
+	sort.Strings(params)
+	for _, param := range params {
+		if gjson.GetBytes(req, param).Exists() {
+			continue
+		}
+		if req, err = setParam(req, param, c.Defaults[param]); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, param := range []string{"max_tokens", "max_completion_tokens"} {
+		if req, err = clamp(req, param, c.MaxTokens); err != nil {
+			return nil, err
+		}
+	}
+	if req, err = clamp(req, "n", c.MaxN); err != nil {
+		return nil, err
+	}
+
+	// Requests without messages are left for the provider to reject.
+	field := gjson.GetBytes(req, "messages")
+	if c.SystemPrepend == "" && c.SystemAppend == "" || !field.IsArray() {
+		return req, nil
+	}
+	var messages []json.RawMessage
+	if err := json.Unmarshal([]byte(field.Raw), &messages); err != nil {
+		return nil, fmt.Errorf("failed to decode messages: %w", err)
+	}
+	system := func(content string) json.RawMessage {
+		msg, _ := json.Marshal(struct {
+			Role    string `json:"role"`
+			Content string `json:"content"`
+		}{"system", content})
+		return msg
+	}
+	if c.SystemPrepend != "" {
+		messages = append([]json.RawMessage{system(c.SystemPrepend)}, messages...)
+	}
+	if c.SystemAppend != "" {
+		messages = append(messages, system(c.SystemAppend))
+	}
+	raw, err := json.Marshal(messages)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode messages: %w", err)
+	}
+	req, err = sjson.SetRawBytes(req, "messages", raw)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set messages: %w", err)
+	}
+	return req, nil
+}
+
+// clamp lowers param to limit if it is above it. Zero means no limit.
+func clamp(req json.RawMessage, param string, limit int) (json.RawMessage, error) {
+	if limit <= 0 || gjson.GetBytes(req, param).Int() <= int64(limit) {
+		return req, nil
+	}
+	req, err := sjson.SetBytes(req, param, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to clamp %s: %w", param, err)
+	}
+	return req, nil
+}
+
+// overrideParams sets the route's parameters on req, null values remove the parameter.
+func overrideParams(req json.RawMessage, params map[string]json.RawMessage) (json.RawMessage, error) {
+	names := make([]string, 0, len(params))
+	for name := range params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var err error
+	for _, name := range names {
+		if string(params[name]) == "null" {
+			if req, err = sjson.DeleteBytes(req, name); err != nil {
+				return nil, fmt.Errorf("failed to remove %s: %w", name, err)
+			}
+			continue
+		}
+		if req, err = setParam(req, name, params[name]); err != nil {
+			return nil, err
+		}
+	}
+	return req, nil
+}
+
+func setParam(req json.RawMessage, param string, value json.RawMessage) (json.RawMessage, error) {
+	if !json.Valid(value) {
+		return nil, fmt.Errorf("invalid value for %s: %s", param, value)
+	}
+	req, err := sjson.SetRawBytes(req, param, value)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set %s: %w", param, err)
+	}
+	return req, nil
+}
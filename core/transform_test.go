@@ -0,0 +1,94 @@
+package core_test
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"magicrouter/core"
+	"magicrouter/mocks"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/tidwall/gjson"
+)
+
+func TestTransformConfig_Apply(t *testing.T) {
+	cfg := core.TransformConfig{
+		SystemPrepend: "You are a support agent.",
+		SystemAppend:  "Answer in English.",
+		Defaults: map[string]json.RawMessage{
+			"temperature": json.RawMessage(`0.2`),
+			"max_tokens":  json.RawMessage(`256`),
+			"user":        json.RawMessage(`"anonymous"`),
+		},
+		MaxTokens: 1024,
+		MaxN:      2,
+		Strip:     []string{"logit_bias", "user", "stream", "stream_options.include_usage"},
+	}
+
+	tests := []struct {
+		name string
+		req  string
+		want string
+	}{
+		{
+			name: "sets defaults and system messages",
+			req:  `{"model": "gpt-4", "messages": [{"role": "user", "content": "Hi"}]}`,
+			want: `{"model": "gpt-4", "messages": [{"role":"system","content":"You are a support agent."},{"role":"user","content":"Hi"},{"role":"system","content":"Answer in English."}],"max_tokens":256,"temperature":0.2,"user":"anonymous"}`,
+		},
+		{
+			name: "keeps parameters within limits",
+			req:  `{"model": "gpt-4", "messages": [], "temperature": 1, "max_tokens": 512, "n": 2}`,
+			want: `{"model": "gpt-4", "messages": [{"role":"system","content":"You are a support agent."},{"role":"system","content":"Answer in English."}], "temperature": 1, "max_tokens": 512, "n": 2,"user":"anonymous"}`,
+		},
+		{
+			name: "clamps and strips parameters",
+			req:  `{"model": "gpt-4", "messages": [], "max_tokens": 4096, "n": 5, "logit_bias": {"50256": -100}, "user": "u1", "stream": true}`,
+			want: `{"model": "gpt-4", "messages": [{"role":"system","content":"You are a support agent."},{"role":"system","content":"Answer in English."}], "max_tokens": 1024, "n": 2, "stream": true,"temperature":0.2,"user":"anonymous"}`,
+		},
+		{
+			name: "clamps max_completion_tokens and keeps fields of protected parameters",
+			req:  `{"model": "o1", "messages": [], "max_completion_tokens": 4096, "stream": true, "stream_options": {"include_usage": true}}`,
+			want: `{"model": "o1", "messages": [{"role":"system","content":"You are a support agent."},{"role":"system","content":"Answer in English."}], "max_completion_tokens": 1024, "stream": true, "stream_options": {"include_usage": true},"max_tokens":256,"temperature":0.2,"user":"anonymous"}`,
+		},
+		{
+			name: "leaves requests without messages to the provider",
+			req:  `{"model": "gpt-4", "prompt": "Hi"}`,
+			want: `{"model": "gpt-4", "prompt": "Hi","max_tokens":256,"temperature":0.2,"user":"anonymous"}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := cfg.Apply(json.RawMessage(tt.req))
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, string(got))
+		})
+	}
+
+	t.Run("rejects invalid defaults", func(t *testing.T) {
+		cfg := core.TransformConfig{Defaults: map[string]json.RawMessage{"temperature": json.RawMessage(`zero`)}}
+		_, err := cfg.Apply(json.RawMessage(`{"messages": []}`))
+		assert.Error(t, err)
+	})
+}
+
+func TestFallbackChatService_RouteParams(t *testing.T) {
+	routes := []core.Route{
+		{ID: "route1", Provider: "openai", Model: "o1", Params: map[string]json.RawMessage{
+			"temperature":           json.RawMessage(`null`),
+			"max_completion_tokens": json.RawMessage(`100`),
+		}},
+	}
+
+	mockService := mocks.NewChatService(t)
+	mockService.On("ChatCompletion", mock.Anything, mock.MatchedBy(func(req json.RawMessage) bool {
+		return !gjson.GetBytes(req, "temperature").Exists() && gjson.GetBytes(req, "max_completion_tokens").Int() == 100
+	}), "o1", "").
+		Return(textResponse(completionResponse("Hi")), nil)
+
+	svc := core.NewFallbackChatService(routes, core.ChatServices{"openai": mockService}, core.NoOpBreaker{})
+	resp, err := svc.ChatCompletion(context.Background(), json.RawMessage(`{"messages": [], "temperature": 0.7}`))
+	assert.NoError(t, err)
+	assert.Equal(t, "route1", resp.Route.ID)
+}
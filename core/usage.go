@@ -0,0 +1,47 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+)
+
+// Usage is the token usage reported by a provider for a completion.
+type Usage struct {
+	PromptTokens        int `json:"prompt_tokens"`
+	CompletionTokens    int `json:"completion_tokens"`
+	TotalTokens         int `json:"total_tokens"`
+	PromptTokensDetails struct {
+		CachedTokens int `json:"cached_tokens"`
+	} `json:"prompt_tokens_details"`
+}
+
+// ParseUsage extracts the usage object from a chat completion response body
+// or stream chunk. It reports false when there is no usage.
+func ParseUsage(body []byte) (Usage, bool) {
+	var resp struct {
+		Usage *Usage `json:"usage"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil || resp.Usage == nil {
+		return Usage{}, false
+	}
+	return *resp.Usage, true
+}
+
+type usageRecorderContextKey struct{}
+
+// WithUsageRecorder attaches record to ctx. It is called with the usage of responses
+// that were paid for but discarded, such as structured outputs that failed validation.
+func WithUsageRecorder(ctx context.Context, record func(route Route, usage Usage)) context.Context {
+	return context.WithValue(ctx, usageRecorderContextKey{}, record)
+}
+
+// recordDiscardedUsage passes the usage of a discarded response to the recorder of ctx.
+func recordDiscardedUsage(ctx context.Context, route Route, body []byte) {
+	record, ok := ctx.Value(usageRecorderContextKey{}).(func(Route, Usage))
+	if !ok {
+		return
+	}
+	if usage, ok := ParseUsage(body); ok {
+		record(route, usage)
+	}
+}
@@ -0,0 +1,61 @@
+package inmem
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"magicrouter/core"
+)
+
+type breakerRecord struct {
+	failures    int
+	lastFailure time.Time
+}
+
+// BreakerService keeps breakers in memory, each replica opens its own.
+// Breakers never open if MaxFailures is zero.
+type BreakerService struct {
+	mu       sync.Mutex
+	cfg      core.BreakerConfig
+	breakers map[string]breakerRecord
+	now      func() time.Time
+}
+
+func NewBreakerService(cfg core.BreakerConfig) *BreakerService {
+	return &BreakerService{
+		cfg:      cfg,
+		breakers: make(map[string]breakerRecord),
+		now:      time.Now,
+	}
+}
+
+func (b *BreakerService) GetState(ctx context.Context, breakerID string) (core.BreakerState, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	record := b.breakers[breakerID]
+	if b.cfg.MaxFailures <= 0 || record.failures < b.cfg.MaxFailures {
+		return core.BreakerStateClosed, nil
+	}
+	if b.now().Sub(record.lastFailure) > b.cfg.ResetTimeout {
+		return core.BreakerStateHalfOpen, nil
+	}
+	return core.BreakerStateOpen, nil
+}
+
+func (b *BreakerService) ReportFailure(ctx context.Context, breakerID string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	record := b.breakers[breakerID]
+	record.failures++
+	record.lastFailure = b.now()
+	b.breakers[breakerID] = record
+	return nil
+}
+
+func (b *BreakerService) ReportSuccess(ctx context.Context, breakerID string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.breakers, breakerID)
+	return nil
+}
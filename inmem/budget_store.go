@@ -0,0 +1,46 @@
+package inmem
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"magicrouter/core"
+)
+
+// BudgetStore keeps spend counters in memory. Counters of expired windows are never evicted,
+// so it is only meant for development and tests.
+type BudgetStore struct {
+	mu    sync.Mutex
+	spend map[string]float64
+}
+
+func NewBudgetStore() *BudgetStore {
+	return &BudgetStore{spend: make(map[string]float64)}
+}
+
+func budgetKey(tokenID string, w core.BudgetWindow) string {
+	return fmt.Sprintf("%s:%s:%d", tokenID, w.Period, w.Start.Unix())
+}
+
+func (s *BudgetStore) GetSpend(ctx context.Context, tokenID string, windows []core.BudgetWindow) (core.Spend, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	spend := make(core.Spend, len(windows))
+	for _, w := range windows {
+		spend[w.Period] = s.spend[budgetKey(tokenID, w)]
+	}
+	return spend, nil
+}
+
+func (s *BudgetStore) AddSpend(ctx context.Context, tokenID string, amount float64, windows []core.BudgetWindow) (core.Spend, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	spend := make(core.Spend, len(windows))
+	for _, w := range windows {
+		key := budgetKey(tokenID, w)
+		s.spend[key] += amount
+		spend[w.Period] = s.spend[key]
+	}
+	return spend, nil
+}
@@ -0,0 +1,96 @@
+package inmem
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"magicrouter/core"
+)
+
+type flight struct {
+	done chan struct{}
+	resp *core.CachedResponse
+}
+
+// FlightStore coordinates requests in flight within a single replica.
+type FlightStore struct {
+	mu      sync.Mutex
+	flights map[string]*flight
+}
+
+func NewFlightStore() *FlightStore {
+	return &FlightStore{flights: make(map[string]*flight)}
+}
+
+func (s *FlightStore) Acquire(ctx context.Context, key string, ttl time.Duration) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if f, ok := s.flights[key]; ok && !isDone(f) {
+		return false, nil
+	}
+	f := &flight{done: make(chan struct{})}
+	s.flights[key] = f
+	time.AfterFunc(ttl, func() {
+		s.release(key, f, nil)
+	})
+	return true, nil
+}
+
+func (s *FlightStore) Complete(ctx context.Context, key string, resp core.CachedResponse) error {
+	s.end(key, &resp)
+	return nil
+}
+
+func (s *FlightStore) Abandon(ctx context.Context, key string) error {
+	s.end(key, nil)
+	return nil
+}
+
+func (s *FlightStore) end(key string, resp *core.CachedResponse) {
+	s.mu.Lock()
+	f := s.flights[key]
+	s.mu.Unlock()
+	if f != nil {
+		s.release(key, f, resp)
+	}
+}
+
+func (s *FlightStore) Wait(ctx context.Context, key string) (*core.CachedResponse, error) {
+	s.mu.Lock()
+	f, ok := s.flights[key]
+	s.mu.Unlock()
+	if !ok {
+		return nil, nil
+	}
+	select {
+	case <-f.done:
+		return f.resp, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// release ends f with resp, which is nil when the flight was abandoned.
+// Done flights are kept until they expire for followers that are just about to wait.
+func (s *FlightStore) release(key string, f *flight, resp *core.CachedResponse) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if isDone(f) {
+		if s.flights[key] == f {
+			delete(s.flights, key)
+		}
+		return
+	}
+	f.resp = resp
+	close(f.done)
+}
+
+func isDone(f *flight) bool {
+	select {
+	case <-f.done:
+		return true
+	default:
+		return false
+	}
+}
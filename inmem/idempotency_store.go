@@ -0,0 +1,86 @@
+package inmem
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"magicrouter/core"
+)
+
+type idempotencyEntry struct {
+	record  core.IdempotencyRecord
+	expires time.Time
+}
+
+// IdempotencyStore keeps idempotency keys in memory, they aren't shared across replicas.
+// Expired keys are evicted lazily.
+type IdempotencyStore struct {
+	mu      sync.Mutex
+	entries map[string]idempotencyEntry
+	now     func() time.Time
+}
+
+func NewIdempotencyStore() *IdempotencyStore {
+	return &IdempotencyStore{
+		entries: make(map[string]idempotencyEntry),
+		now:     time.Now,
+	}
+}
+
+func (s *IdempotencyStore) Begin(ctx context.Context, key, hash, owner string, lease time.Duration) (*core.IdempotencyRecord, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if record := s.get(key); record != nil {
+		return record, false, nil
+	}
+	s.entries[key] = idempotencyEntry{
+		record:  core.IdempotencyRecord{RequestHash: hash, Owner: owner},
+		expires: s.now().Add(lease),
+	}
+	return nil, true, nil
+}
+
+func (s *IdempotencyStore) Finish(ctx context.Context, key, owner string, record core.IdempotencyRecord, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.owns(key, owner) {
+		return core.ErrIdempotencyLeaseLost
+	}
+	s.entries[key] = idempotencyEntry{record: record, expires: s.now().Add(ttl)}
+	return nil
+}
+
+func (s *IdempotencyStore) Release(ctx context.Context, key, owner string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.owns(key, owner) {
+		return core.ErrIdempotencyLeaseLost
+	}
+	delete(s.entries, key)
+	return nil
+}
+
+func (s *IdempotencyStore) Get(ctx context.Context, key string) (*core.IdempotencyRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.get(key), nil
+}
+
+func (s *IdempotencyStore) get(key string) *core.IdempotencyRecord {
+	entry, ok := s.entries[key]
+	if !ok {
+		return nil
+	}
+	if !s.now().Before(entry.expires) {
+		delete(s.entries, key)
+		return nil
+	}
+	return &entry.record
+}
+
+// owns reports whether owner still holds the claim on key.
+func (s *IdempotencyStore) owns(key, owner string) bool {
+	record := s.get(key)
+	return record != nil && record.Response == nil && record.Owner == owner
+}
@@ -0,0 +1,104 @@
+package inmem
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"magicrouter/core"
+)
+
+// jobSweepInterval is how often Dequeue evicts expired jobs.
+const jobSweepInterval = time.Minute
+
+type jobEntry struct {
+	job     core.Job
+	expires time.Time
+}
+
+// JobQueue keeps jobs in memory, they are lost on restart and only run by this replica.
+// Jobs are evicted once they weren't updated for the TTL, like in Redis.
+type JobQueue struct {
+	mu        sync.Mutex
+	jobs      map[string]jobEntry
+	queued    chan string
+	ttl       time.Duration
+	now       func() time.Time
+	lastSweep time.Time
+}
+
+// NewJobQueue holds up to size queued jobs, Enqueue blocks beyond that. Jobs are kept
+// for ttl after their last update.
+func NewJobQueue(size int, ttl time.Duration) *JobQueue {
+	return &JobQueue{
+		jobs:   make(map[string]jobEntry),
+		queued: make(chan string, size),
+		ttl:    ttl,
+		now:    time.Now,
+	}
+}
+
+func (q *JobQueue) Enqueue(ctx context.Context, job *core.Job) error {
+	if err := q.UpdateJob(ctx, job); err != nil {
+		return err
+	}
+	select {
+	case q.queued <- job.ID:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (q *JobQueue) Dequeue(ctx context.Context, timeout time.Duration) (*core.Job, error) {
+	q.sweep()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case id := <-q.queued:
+			job, err := q.GetJob(ctx, id)
+			if job != nil || err != nil {
+				return job, err
+			}
+			// The job expired while queued.
+		case <-timer.C:
+			return nil, nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (q *JobQueue) UpdateJob(ctx context.Context, job *core.Job) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.jobs[job.ID] = jobEntry{job: *job, expires: q.now().Add(q.ttl)}
+	return nil
+}
+
+func (q *JobQueue) GetJob(ctx context.Context, id string) (*core.Job, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	entry, ok := q.jobs[id]
+	if !ok || !q.now().Before(entry.expires) {
+		return nil, nil
+	}
+	return &entry.job, nil
+}
+
+// sweep evicts expired jobs, at most once per jobSweepInterval.
+func (q *JobQueue) sweep() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	now := q.now()
+	if now.Sub(q.lastSweep) < jobSweepInterval {
+		return
+	}
+	q.lastSweep = now
+	for id, entry := range q.jobs {
+		if !now.Before(entry.expires) {
+			delete(q.jobs, id)
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package inmem
+
+import (
+	"context"
+	"maps"
+	"sync"
+)
+
+// KeyStore keeps disabled provider keys in memory, they aren't shared across replicas.
+type KeyStore struct {
+	mu       sync.Mutex
+	disabled map[string]string
+}
+
+func NewKeyStore() *KeyStore {
+	return &KeyStore{disabled: make(map[string]string)}
+}
+
+func (s *KeyStore) DisabledKeys(ctx context.Context) (map[string]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return maps.Clone(s.disabled), nil
+}
+
+func (s *KeyStore) DisableKey(ctx context.Context, keyID, reason string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.disabled[keyID] = reason
+	return nil
+}
+
+func (s *KeyStore) EnableKey(ctx context.Context, keyID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.disabled, keyID)
+	return nil
+}
@@ -0,0 +1,56 @@
+package inmem
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"magicrouter/core"
+)
+
+// LatencyStore keeps route latency averages in memory, they aren't shared across replicas.
+type LatencyStore struct {
+	alpha float64
+
+	mu    sync.Mutex
+	stats map[string]core.LatencyStats
+}
+
+// NewLatencyStore creates a LatencyStore. alpha (0-1) is the weight given to new samples.
+func NewLatencyStore(alpha float64) *LatencyStore {
+	return &LatencyStore{
+		alpha: alpha,
+		stats: make(map[string]core.LatencyStats),
+	}
+}
+
+func (s *LatencyStore) GetLatency(ctx context.Context, routeIDs []string) (map[string]core.LatencyStats, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats := make(map[string]core.LatencyStats, len(routeIDs))
+	for _, id := range routeIDs {
+		if st, ok := s.stats[id]; ok {
+			stats[id] = st
+		}
+	}
+	return stats, nil
+}
+
+func (s *LatencyStore) ObserveLatency(ctx context.Context, routeID string, latency, ttft time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st, ok := s.stats[routeID]
+	if !ok {
+		s.stats[routeID] = core.LatencyStats{Latency: latency, TTFT: ttft, Samples: 1}
+		return nil
+	}
+	st.Latency = ewma(st.Latency, latency, s.alpha)
+	st.TTFT = ewma(st.TTFT, ttft, s.alpha)
+	st.Samples++
+	s.stats[routeID] = st
+	return nil
+}
+
+func ewma(avg, sample time.Duration, alpha float64) time.Duration {
+	return time.Duration(alpha*float64(sample) + (1-alpha)*float64(avg))
+}
@@ -0,0 +1,45 @@
+package inmem
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"magicrouter/core"
+)
+
+// RateLimitStore keeps the rate limit state of routes and keys in memory, it isn't
+// shared across replicas. Expired states are evicted lazily.
+type RateLimitStore struct {
+	mu     sync.Mutex
+	states map[string]core.RateLimitState
+	now    func() time.Time
+}
+
+func NewRateLimitStore() *RateLimitStore {
+	return &RateLimitStore{
+		states: make(map[string]core.RateLimitState),
+		now:    time.Now,
+	}
+}
+
+func (s *RateLimitStore) GetRateLimit(ctx context.Context, id string) (*core.RateLimitState, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	state, ok := s.states[id]
+	if !ok {
+		return nil, nil
+	}
+	if !state.Expires().After(s.now()) {
+		delete(s.states, id)
+		return nil, nil
+	}
+	return &state, nil
+}
+
+func (s *RateLimitStore) SetRateLimit(ctx context.Context, id string, state core.RateLimitState) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.states[id] = state
+	return nil
+}
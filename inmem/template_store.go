@@ -0,0 +1,90 @@
+package inmem
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"time"
+
+	"magicrouter/core"
+)
+
+type templateEntry struct {
+	versions []core.PromptTemplate
+	active   int
+}
+
+// TemplateStore keeps prompt templates in memory, they aren't shared across replicas.
+type TemplateStore struct {
+	mu        sync.Mutex
+	templates map[string]*templateEntry
+	now       func() time.Time
+}
+
+func NewTemplateStore() *TemplateStore {
+	return &TemplateStore{
+		templates: make(map[string]*templateEntry),
+		now:       time.Now,
+	}
+}
+
+func templateKey(projectID, id string) string {
+	return projectID + ":" + id
+}
+
+func (s *TemplateStore) GetTemplate(ctx context.Context, projectID, id string, version int) (*core.PromptTemplate, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, ok := s.templates[templateKey(projectID, id)]
+	if !ok {
+		return nil, core.ErrTemplateNotFound
+	}
+	if version == 0 {
+		version = entry.active
+	}
+	if version < 1 || version > len(entry.versions) {
+		return nil, core.ErrTemplateNotFound
+	}
+	tmpl := entry.versions[version-1]
+	return &tmpl, nil
+}
+
+func (s *TemplateStore) ListTemplateVersions(ctx context.Context, projectID, id string) ([]core.PromptTemplate, int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, ok := s.templates[templateKey(projectID, id)]
+	if !ok {
+		return nil, 0, core.ErrTemplateNotFound
+	}
+	return slices.Clone(entry.versions), entry.active, nil
+}
+
+func (s *TemplateStore) CreateTemplateVersion(ctx context.Context, projectID, id string, messages []core.TemplateMessage) (*core.PromptTemplate, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := templateKey(projectID, id)
+	entry, ok := s.templates[key]
+	if !ok {
+		entry = &templateEntry{active: 1}
+		s.templates[key] = entry
+	}
+	tmpl := core.PromptTemplate{
+		ID:        id,
+		Version:   len(entry.versions) + 1,
+		Messages:  slices.Clone(messages),
+		CreatedAt: s.now().UTC(),
+	}
+	entry.versions = append(entry.versions, tmpl)
+	return &tmpl, nil
+}
+
+func (s *TemplateStore) PromoteTemplateVersion(ctx context.Context, projectID, id string, version int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, ok := s.templates[templateKey(projectID, id)]
+	if !ok || version < 1 || version > len(entry.versions) {
+		return core.ErrTemplateNotFound
+	}
+	entry.active = version
+	return nil
+}
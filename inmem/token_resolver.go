@@ -1,13 +1,17 @@
 package inmem
 
-import "errors"
+import (
+	"errors"
 
-type TokenStore map[string]string
+	"magicrouter/core"
+)
 
-func (s TokenStore) Resolve(apiToken string) (string, error) {
-	projectID, ok := s[apiToken]
+type TokenStore map[string]*core.Token
+
+func (s TokenStore) Resolve(apiToken string) (*core.Token, error) {
+	token, ok := s[apiToken]
 	if !ok {
-		return "", errors.New("project id not found")
+		return nil, errors.New("token not found")
 	}
-	return projectID, nil
+	return token, nil
 }
@@ -0,0 +1,27 @@
+// Package metrics exposes counters through expvar. They are served to admins at /admin/v1/debug/vars.
+package metrics
+
+import "expvar"
+
+var (
+	// Requests counts completed requests by route.
+	Requests = expvar.NewMap("requests")
+	// Cost is the spend in USD by route.
+	Cost = expvar.NewMap("cost_usd")
+	// PromptTokens counts prompt tokens by route.
+	PromptTokens = expvar.NewMap("prompt_tokens")
+	// CompletionTokens counts completion tokens by route.
+	CompletionTokens = expvar.NewMap("completion_tokens")
+	// Hedges counts hedged attempts by the route started.
+	Hedges = expvar.NewMap("hedges")
+	// HedgeWins counts the routes that won a hedged request.
+	HedgeWins = expvar.NewMap("hedge_wins")
+	// Coalesced counts requests served with the response of an identical request by project.
+	Coalesced = expvar.NewMap("coalesced")
+	// Queued counts requests that waited for a concurrency slot by project or route.
+	Queued = expvar.NewMap("queued")
+	// QueueWaitMS is the total time requests waited for a concurrency slot by project or route.
+	QueueWaitMS = expvar.NewMap("queue_wait_ms")
+	// QueueRejected counts requests rejected because the queue was full or they waited too long.
+	QueueRejected = expvar.NewMap("queue_rejected")
+)
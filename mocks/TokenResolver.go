@@ -2,7 +2,11 @@
 
 package mocks
 
-import mock "github.com/stretchr/testify/mock"
+import (
+	core "magicrouter/core"
+
+	mock "github.com/stretchr/testify/mock"
+)
 
 // TokenResolver is an autogenerated mock type for the TokenResolver type
 type TokenResolver struct {
@@ -10,18 +14,20 @@ type TokenResolver struct {
 }
 
 // Resolve provides a mock function with given fields: apiToken
-func (_m *TokenResolver) Resolve(apiToken string) (string, error) {
+func (_m *TokenResolver) Resolve(apiToken string) (*core.Token, error) {
 	ret := _m.Called(apiToken)
 
-	var r0 string
+	var r0 *core.Token
 	var r1 error
-	if rf, ok := ret.Get(0).(func(string) (string, error)); ok {
+	if rf, ok := ret.Get(0).(func(string) (*core.Token, error)); ok {
 		return rf(apiToken)
 	}
-	if rf, ok := ret.Get(0).(func(string) string); ok {
+	if rf, ok := ret.Get(0).(func(string) *core.Token); ok {
 		r0 = rf(apiToken)
 	} else {
-		r0 = ret.Get(0).(string)
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*core.Token)
+		}
 	}
 
 	if rf, ok := ret.Get(1).(func(string) error); ok {
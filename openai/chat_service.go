@@ -52,7 +52,9 @@ func (s *ChatService) ChatCompletion(ctx context.Context, req json.RawMessage, m
 		return nil, fmt.Errorf("failed to send request: %w", err)
 	}
 	if response.StatusCode == http.StatusTooManyRequests {
-		return nil, core.ErrProviderRateLimited
+		response.Body.Close()
+		// The rate limit headers tell when the route can be used again.
+		return nil, &core.RateLimitError{Header: response.Header}
 	}
 
 	return response, nil
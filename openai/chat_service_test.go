@@ -4,6 +4,7 @@ import (
 	"context"
 	"io"
 	"net/http"
+	"net/http/httptest"
 	"testing"
 	"time"
 
@@ -13,9 +14,10 @@ import (
 	"github.com/stretchr/testify/assert"
 )
 
-func runTestServer(t *testing.T) {
+func runTestServer(t *testing.T) string {
 	r := chi.NewRouter()
 	r.Post("/too-many-requests", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("x-ratelimit-remaining-requests", "0")
 		w.WriteHeader(http.StatusTooManyRequests)
 	})
 	r.Post("/ok", func(w http.ResponseWriter, r *http.Request) {
@@ -24,15 +26,14 @@ func runTestServer(t *testing.T) {
 	r.Post("/timeout", func(w http.ResponseWriter, r *http.Request) {
 		time.Sleep(1 * time.Second)
 	})
-	go func() {
-		err := http.ListenAndServe(":9252", r)
-		assert.NoError(t, err)
-	}()
+	srv := httptest.NewServer(r)
+	t.Cleanup(srv.Close)
+	return srv.URL
 }
 
 func TestChatService_ChatCompletion(t *testing.T) {
 	t.Parallel()
-	runTestServer(t)
+	url := runTestServer(t)
 
 	tests := []struct {
 		name     string
@@ -41,17 +42,17 @@ func TestChatService_ChatCompletion(t *testing.T) {
 	}{
 		{
 			name:     "no error",
-			endpoint: "http://localhost:9252/ok",
+			endpoint: url + "/ok",
 			err:      nil,
 		},
 		{
 			name:     "timeout",
-			endpoint: "http://localhost:9252/timeout",
+			endpoint: url + "/timeout",
 			err:      core.ErrProviderTimeout,
 		},
 		{
 			name:     "rate limited",
-			endpoint: "http://localhost:9252/too-many-requests",
+			endpoint: url + "/too-many-requests",
 			err:      core.ErrProviderRateLimited,
 		},
 	}
@@ -65,7 +66,11 @@ func TestChatService_ChatCompletion(t *testing.T) {
 				endpoint: tt.endpoint,
 			}
 			_, err := svc.ChatCompletion(context.Background(), []byte(`{}`), "model", "token")
-			assert.Equal(t, tt.err, err)
+			if tt.err == nil {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorIs(t, err, tt.err)
+			}
 		})
 	}
 }
@@ -15,6 +15,10 @@ type BreakerService struct {
 	cfg    core.BreakerConfig
 }
 
+func NewBreakerService(client *redis.Client, cfg core.BreakerConfig) *BreakerService {
+	return &BreakerService{client: client, cfg: cfg}
+}
+
 // BreakerRecord is the data structure stored in Redis.
 type BreakerRecord struct {
 	// Failures is the number of failures since the last reset.
@@ -0,0 +1,77 @@
+package redis
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"magicrouter/core"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// BudgetStore keeps a spend counter per token and budget window.
+type BudgetStore struct {
+	client *redis.Client
+}
+
+func NewBudgetStore(client *redis.Client) *BudgetStore {
+	return &BudgetStore{client: client}
+}
+
+func budgetKey(tokenID string, w core.BudgetWindow) string {
+	if w.Start.IsZero() {
+		return fmt.Sprintf("budget:%s:%s", tokenID, w.Period)
+	}
+	return fmt.Sprintf("budget:%s:%s:%d", tokenID, w.Period, w.Start.Unix())
+}
+
+func (s *BudgetStore) GetSpend(ctx context.Context, tokenID string, windows []core.BudgetWindow) (core.Spend, error) {
+	cmds := make([]*redis.StringCmd, len(windows))
+	_, err := s.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, w := range windows {
+			cmds[i] = pipe.Get(ctx, budgetKey(tokenID, w))
+		}
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		return nil, fmt.Errorf("failed to get spend from redis: %w", err)
+	}
+	spend := make(core.Spend, len(windows))
+	for i, w := range windows {
+		amount, err := cmds[i].Float64()
+		if err != nil && err != redis.Nil {
+			return nil, fmt.Errorf("failed to parse spend: %w", err)
+		}
+		spend[w.Period] = amount
+	}
+	return spend, nil
+}
+
+func (s *BudgetStore) AddSpend(ctx context.Context, tokenID string, amount float64, windows []core.BudgetWindow) (core.Spend, error) {
+	cmds := make([]*redis.FloatCmd, len(windows))
+	_, err := s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, w := range windows {
+			key := budgetKey(tokenID, w)
+			cmds[i] = pipe.IncrByFloat(ctx, key, amount)
+			if !w.End.IsZero() {
+				// Keep the counter around for a bit after it resets for reporting.
+				pipe.ExpireAt(ctx, key, w.End.Add(24*time.Hour))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to increment spend in redis: %w", err)
+	}
+	spend := make(core.Spend, len(windows))
+	for i, w := range windows {
+		spend[w.Period] = cmds[i].Val()
+	}
+	return spend, nil
+}
+
+// Ping implements core.HealthChecker.
+func (s *BudgetStore) Ping(ctx context.Context) error {
+	return s.client.Ping(ctx).Err()
+}
@@ -0,0 +1,119 @@
+package redis
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"magicrouter/core"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// FlightStore coordinates requests in flight across replicas. The leader holds a lock
+// key, its response is stored next to it and announced on a channel.
+type FlightStore struct {
+	client *redis.Client
+	// resultTTL is how long responses are kept for followers that are about to wait.
+	resultTTL time.Duration
+	// pollInterval is how often followers check that the leader still holds the lock.
+	pollInterval time.Duration
+}
+
+func NewFlightStore(client *redis.Client) *FlightStore {
+	return &FlightStore{
+		client:       client,
+		resultTTL:    10 * time.Second,
+		pollInterval: time.Second,
+	}
+}
+
+func flightLockKey(key string) string   { return "flight:" + key + ":lock" }
+func flightResultKey(key string) string { return "flight:" + key + ":result" }
+func flightChannel(key string) string   { return "flight:" + key }
+
+func (s *FlightStore) Acquire(ctx context.Context, key string, ttl time.Duration) (bool, error) {
+	ok, err := s.client.SetNX(ctx, flightLockKey(key), "1", ttl).Result()
+	if err != nil {
+		return false, fmt.Errorf("failed to acquire flight lock: %w", err)
+	}
+	if ok {
+		// A response left by the previous leader isn't for this flight.
+		s.client.Del(ctx, flightResultKey(key))
+	}
+	return ok, nil
+}
+
+func (s *FlightStore) Complete(ctx context.Context, key string, resp core.CachedResponse) error {
+	data, err := json.Marshal(resp)
+	if err != nil {
+		return fmt.Errorf("failed to marshal response: %w", err)
+	}
+	_, err = s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, flightResultKey(key), data, s.resultTTL)
+		pipe.Del(ctx, flightLockKey(key))
+		pipe.Publish(ctx, flightChannel(key), "done")
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to complete flight: %w", err)
+	}
+	return nil
+}
+
+func (s *FlightStore) Abandon(ctx context.Context, key string) error {
+	_, err := s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, flightLockKey(key))
+		pipe.Publish(ctx, flightChannel(key), "abandoned")
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to abandon flight: %w", err)
+	}
+	return nil
+}
+
+func (s *FlightStore) Wait(ctx context.Context, key string) (*core.CachedResponse, error) {
+	sub := s.client.Subscribe(ctx, flightChannel(key))
+	defer sub.Close()
+	// Make sure the subscription is active before checking for a response,
+	// otherwise one published in between would be missed.
+	if _, err := sub.Receive(ctx); err != nil {
+		return nil, fmt.Errorf("failed to subscribe to flight: %w", err)
+	}
+	messages := sub.Channel()
+	ticker := time.NewTicker(s.pollInterval)
+	defer ticker.Stop()
+	for {
+		data, err := s.client.Get(ctx, flightResultKey(key)).Bytes()
+		if err == nil {
+			var resp core.CachedResponse
+			if err := json.Unmarshal(data, &resp); err != nil {
+				return nil, fmt.Errorf("failed to unmarshal response: %w", err)
+			}
+			return &resp, nil
+		}
+		if err != redis.Nil {
+			return nil, fmt.Errorf("failed to get flight response: %w", err)
+		}
+		held, err := s.client.Exists(ctx, flightLockKey(key)).Result()
+		if err != nil {
+			return nil, fmt.Errorf("failed to check flight lock: %w", err)
+		}
+		if held == 0 {
+			return nil, nil
+		}
+
+		select {
+		case <-messages:
+		case <-ticker.C:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (s *FlightStore) Ping(ctx context.Context) error {
+	return s.client.Ping(ctx).Err()
+}
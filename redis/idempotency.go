@@ -0,0 +1,109 @@
+package redis
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"magicrouter/core"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ownedScript runs ARGV[2] on KEYS[1] only while the request ARGV[1] still holds it, so
+// that a request whose lease expired can't overwrite the outcome of the retry that took over.
+// It returns 0 when the key is held by another request or already has a response.
+var ownedScript = redis.NewScript(`
+local data = redis.call("GET", KEYS[1])
+if not data then
+	return 0
+end
+local record = cjson.decode(data)
+if record.owner ~= ARGV[1] or record.response ~= nil then
+	return 0
+end
+if ARGV[2] == "set" then
+	redis.call("SET", KEYS[1], ARGV[3], "PX", ARGV[4])
+else
+	redis.call("DEL", KEYS[1])
+end
+return 1
+`)
+
+// IdempotencyStore keeps idempotency keys in Redis so that retries can hit any replica.
+type IdempotencyStore struct {
+	client *redis.Client
+}
+
+func NewIdempotencyStore(client *redis.Client) *IdempotencyStore {
+	return &IdempotencyStore{client: client}
+}
+
+func idempotencyKey(key string) string {
+	return "idempotency:" + key
+}
+
+func (s *IdempotencyStore) Begin(ctx context.Context, key, hash, owner string, lease time.Duration) (*core.IdempotencyRecord, bool, error) {
+	data, err := json.Marshal(core.IdempotencyRecord{RequestHash: hash, Owner: owner})
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to marshal idempotency record: %w", err)
+	}
+	ok, err := s.client.SetNX(ctx, idempotencyKey(key), data, lease).Result()
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to claim idempotency key: %w", err)
+	}
+	if ok {
+		return nil, true, nil
+	}
+	record, err := s.Get(ctx, key)
+	if err != nil {
+		return nil, false, err
+	}
+	if record == nil {
+		// The key expired or was released in between, try again.
+		return s.Begin(ctx, key, hash, owner, lease)
+	}
+	return record, false, nil
+}
+
+func (s *IdempotencyStore) Finish(ctx context.Context, key, owner string, record core.IdempotencyRecord, ttl time.Duration) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to marshal idempotency record: %w", err)
+	}
+	ok, err := ownedScript.Run(ctx, s.client, []string{idempotencyKey(key)}, owner, "set", data, ttl.Milliseconds()).Bool()
+	if err != nil {
+		return fmt.Errorf("failed to store idempotency record: %w", err)
+	}
+	if !ok {
+		return core.ErrIdempotencyLeaseLost
+	}
+	return nil
+}
+
+func (s *IdempotencyStore) Release(ctx context.Context, key, owner string) error {
+	ok, err := ownedScript.Run(ctx, s.client, []string{idempotencyKey(key)}, owner, "del").Bool()
+	if err != nil {
+		return fmt.Errorf("failed to release idempotency key: %w", err)
+	}
+	if !ok {
+		return core.ErrIdempotencyLeaseLost
+	}
+	return nil
+}
+
+func (s *IdempotencyStore) Get(ctx context.Context, key string) (*core.IdempotencyRecord, error) {
+	data, err := s.client.Get(ctx, idempotencyKey(key)).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get idempotency record: %w", err)
+	}
+	var record core.IdempotencyRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal idempotency record: %w", err)
+	}
+	return &record, nil
+}
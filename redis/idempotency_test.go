@@ -0,0 +1,47 @@
+package redis
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"magicrouter/core"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIdempotencyStore_LeaseLost(t *testing.T) {
+	t.Parallel()
+	if os.Getenv("REDIS_ADDR") == "" {
+		t.Skip("redis not available")
+	}
+	client := redis.NewClient(&redis.Options{
+		Addr: os.Getenv("REDIS_ADDR"),
+	})
+	store := NewIdempotencyStore(client)
+	ctx := context.Background()
+	key := "test-lease-" + time.Now().Format(time.RFC3339Nano)
+
+	_, claimed, err := store.Begin(ctx, key, "hash", "first", 50*time.Millisecond)
+	assert.NoError(t, err)
+	assert.True(t, claimed)
+
+	// The lease of the first request expires and a retry takes over.
+	time.Sleep(100 * time.Millisecond)
+	_, claimed, err = store.Begin(ctx, key, "hash", "retry", time.Minute)
+	assert.NoError(t, err)
+	assert.True(t, claimed)
+
+	resp := &core.CachedResponse{StatusCode: 200}
+	err = store.Finish(ctx, key, "first", core.IdempotencyRecord{RequestHash: "hash", Response: resp}, time.Minute)
+	assert.ErrorIs(t, err, core.ErrIdempotencyLeaseLost)
+	assert.ErrorIs(t, store.Release(ctx, key, "first"), core.ErrIdempotencyLeaseLost)
+
+	assert.NoError(t, store.Finish(ctx, key, "retry", core.IdempotencyRecord{RequestHash: "hash", Response: resp}, time.Minute))
+	record, err := store.Get(ctx, key)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, record.Response.StatusCode)
+	assert.Empty(t, record.Owner)
+}
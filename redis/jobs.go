@@ -0,0 +1,178 @@
+package redis
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"magicrouter/core"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// jobQueueKey is the list of queued job IDs, pushed on the left and popped on the right.
+	jobQueueKey = "jobs:queue"
+	// jobProcessingKey is the list of IDs of dequeued jobs that aren't done yet.
+	jobProcessingKey = "jobs:processing"
+	// jobLeasesKey holds when the lease of each dequeued job expires, in milliseconds.
+	jobLeasesKey = "jobs:leases"
+)
+
+// defaultJobLease outlasts an attempt and the backoff before the next one, as the lease is
+// renewed whenever an attempt starts.
+const defaultJobLease = 15 * time.Minute
+
+// requeueScript puts up to ARGV[2] jobs whose lease expired back in the queue, their
+// worker is gone. Jobs moved to the processing list by a worker that died before leasing
+// them get a lease of ARGV[1] milliseconds, the processing list is only scanned for them
+// when it holds more jobs than there are leases.
+var requeueScript = redis.NewScript(`
+local time = redis.call("TIME")
+local now = time[1] * 1000 + math.floor(time[2] / 1000)
+for _, id in ipairs(redis.call("ZRANGEBYSCORE", KEYS[3], "-inf", now, "LIMIT", 0, tonumber(ARGV[2]))) do
+	redis.call("LREM", KEYS[2], 0, id)
+	redis.call("ZREM", KEYS[3], id)
+	redis.call("RPUSH", KEYS[1], id)
+end
+if redis.call("LLEN", KEYS[2]) > redis.call("ZCARD", KEYS[3]) then
+	for _, id in ipairs(redis.call("LRANGE", KEYS[2], 0, -1)) do
+		redis.call("ZADD", KEYS[3], "NX", now + tonumber(ARGV[1]), id)
+	end
+end
+return 0
+`)
+
+// maxRequeuedJobs bounds the work of a single requeue, the rest is left to the next one.
+const maxRequeuedJobs = 100
+
+// leaseScript leases job ARGV[2] for ARGV[1] milliseconds from now. With ARGV[3] set to
+// "XX", only an existing lease is renewed.
+var leaseScript = redis.NewScript(`
+local time = redis.call("TIME")
+local expires = time[1] * 1000 + math.floor(time[2] / 1000) + tonumber(ARGV[1])
+if ARGV[3] == "XX" then
+	return redis.call("ZADD", KEYS[1], "XX", expires, ARGV[2])
+end
+return redis.call("ZADD", KEYS[1], expires, ARGV[2])
+`)
+
+// JobQueue keeps jobs in Redis so that any replica can run them and clients can poll any replica.
+// Dequeued jobs are leased until they are done, jobs of workers that crashed or didn't
+// requeue them on shutdown are queued again once their lease expires.
+type JobQueue struct {
+	client *redis.Client
+	// ttl is how long jobs are kept after their last update.
+	ttl time.Duration
+	// lease is how long a job is left to its worker without being updated.
+	lease time.Duration
+}
+
+func NewJobQueue(client *redis.Client, ttl time.Duration) *JobQueue {
+	return &JobQueue{client: client, ttl: ttl, lease: defaultJobLease}
+}
+
+func jobKey(id string) string {
+	return "job:" + id
+}
+
+func (q *JobQueue) Enqueue(ctx context.Context, job *core.Job) error {
+	data, err := json.Marshal(job)
+	if err != nil {
+		return fmt.Errorf("failed to marshal job: %w", err)
+	}
+	pipe := q.client.TxPipeline()
+	pipe.Set(ctx, jobKey(job.ID), data, q.ttl)
+	// Jobs are requeued by their worker on shutdown.
+	pipe.LRem(ctx, jobProcessingKey, 0, job.ID)
+	pipe.ZRem(ctx, jobLeasesKey, job.ID)
+	pipe.LPush(ctx, jobQueueKey, job.ID)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("failed to enqueue job: %w", err)
+	}
+	return nil
+}
+
+func (q *JobQueue) Dequeue(ctx context.Context, timeout time.Duration) (*core.Job, error) {
+	keys := []string{jobQueueKey, jobProcessingKey, jobLeasesKey}
+	if err := requeueScript.Run(ctx, q.client, keys, q.lease.Milliseconds(), maxRequeuedJobs).Err(); err != nil {
+		return nil, fmt.Errorf("failed to requeue expired jobs: %w", err)
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		// A zero timeout would block forever.
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			return nil, nil
+		}
+		id, err := q.client.BLMove(ctx, jobQueueKey, jobProcessingKey, "RIGHT", "LEFT", wait).Result()
+		if err == redis.Nil {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to dequeue job: %w", err)
+		}
+		if err := leaseScript.Run(ctx, q.client, []string{jobLeasesKey}, q.lease.Milliseconds(), id, "").Err(); err != nil {
+			return nil, fmt.Errorf("failed to lease job: %w", err)
+		}
+		job, err := q.GetJob(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		if job != nil {
+			return job, nil
+		}
+		// The job expired while queued.
+		if err := q.release(ctx, id); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// release drops the lease of job id, which won't be requeued anymore.
+func (q *JobQueue) release(ctx context.Context, id string) error {
+	pipe := q.client.TxPipeline()
+	pipe.LRem(ctx, jobProcessingKey, 0, id)
+	pipe.ZRem(ctx, jobLeasesKey, id)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("failed to release job: %w", err)
+	}
+	return nil
+}
+
+func (q *JobQueue) UpdateJob(ctx context.Context, job *core.Job) error {
+	data, err := json.Marshal(job)
+	if err != nil {
+		return fmt.Errorf("failed to marshal job: %w", err)
+	}
+	if err := q.client.Set(ctx, jobKey(job.ID), data, q.ttl).Err(); err != nil {
+		return fmt.Errorf("failed to update job: %w", err)
+	}
+	if job.Done() {
+		return q.release(ctx, job.ID)
+	}
+	if job.Status == core.JobRunning {
+		// The worker is still at it.
+		err := leaseScript.Run(ctx, q.client, []string{jobLeasesKey}, q.lease.Milliseconds(), job.ID, "XX").Err()
+		if err != nil {
+			return fmt.Errorf("failed to renew job lease: %w", err)
+		}
+	}
+	return nil
+}
+
+func (q *JobQueue) GetJob(ctx context.Context, id string) (*core.Job, error) {
+	data, err := q.client.Get(ctx, jobKey(id)).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get job: %w", err)
+	}
+	var job core.Job
+	if err := json.Unmarshal(data, &job); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal job: %w", err)
+	}
+	return &job, nil
+}
@@ -0,0 +1,50 @@
+package redis
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"magicrouter/core"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJobQueue_ExpiredLease(t *testing.T) {
+	if os.Getenv("REDIS_ADDR") == "" {
+		t.Skip("redis not available")
+	}
+	client := redis.NewClient(&redis.Options{
+		Addr: os.Getenv("REDIS_ADDR"),
+	})
+	queue := NewJobQueue(client, time.Minute)
+	queue.lease = 50 * time.Millisecond
+	ctx := context.Background()
+	t.Cleanup(func() {
+		client.Del(ctx, jobQueueKey, jobProcessingKey, jobLeasesKey)
+	})
+
+	job := &core.Job{ID: "job_lease_" + time.Now().Format(time.RFC3339Nano), Status: core.JobQueued}
+	assert.NoError(t, queue.Enqueue(ctx, job))
+	got, err := queue.Dequeue(ctx, time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, job.ID, got.ID)
+
+	// The worker crashes while running the job, which is handed to another one.
+	got.Status = core.JobRunning
+	assert.NoError(t, queue.UpdateJob(ctx, got))
+	time.Sleep(100 * time.Millisecond)
+	got, err = queue.Dequeue(ctx, time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, job.ID, got.ID)
+
+	// Done jobs aren't requeued.
+	got.Status = core.JobSucceeded
+	assert.NoError(t, queue.UpdateJob(ctx, got))
+	time.Sleep(100 * time.Millisecond)
+	got, err = queue.Dequeue(ctx, 100*time.Millisecond)
+	assert.NoError(t, err)
+	assert.Nil(t, got)
+}
@@ -0,0 +1,42 @@
+package redis
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// disabledKeysKey is a hash of the disabled provider keys to the reason they were disabled.
+const disabledKeysKey = "provider_keys:disabled"
+
+// KeyStore keeps disabled provider keys in Redis so that disabling a key applies to every replica.
+type KeyStore struct {
+	client *redis.Client
+}
+
+func NewKeyStore(client *redis.Client) *KeyStore {
+	return &KeyStore{client: client}
+}
+
+func (s *KeyStore) DisabledKeys(ctx context.Context) (map[string]string, error) {
+	disabled, err := s.client.HGetAll(ctx, disabledKeysKey).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get disabled keys: %w", err)
+	}
+	return disabled, nil
+}
+
+func (s *KeyStore) DisableKey(ctx context.Context, keyID, reason string) error {
+	if err := s.client.HSet(ctx, disabledKeysKey, keyID, reason).Err(); err != nil {
+		return fmt.Errorf("failed to disable key: %w", err)
+	}
+	return nil
+}
+
+func (s *KeyStore) EnableKey(ctx context.Context, keyID string) error {
+	if err := s.client.HDel(ctx, disabledKeysKey, keyID).Err(); err != nil {
+		return fmt.Errorf("failed to enable key: %w", err)
+	}
+	return nil
+}
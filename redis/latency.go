@@ -0,0 +1,95 @@
+package redis
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"magicrouter/core"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// observeLatencyScript updates the moving averages atomically so that replicas
+// reporting at the same time don't overwrite each other.
+var observeLatencyScript = redis.NewScript(`
+local alpha = tonumber(ARGV[1])
+local latency = tonumber(ARGV[2])
+local ttft = tonumber(ARGV[3])
+local samples = tonumber(redis.call("HGET", KEYS[1], "samples") or "0")
+if samples > 0 then
+	latency = alpha * latency + (1 - alpha) * tonumber(redis.call("HGET", KEYS[1], "latency"))
+	ttft = alpha * ttft + (1 - alpha) * tonumber(redis.call("HGET", KEYS[1], "ttft"))
+end
+redis.call("HSET", KEYS[1], "latency", latency, "ttft", ttft, "samples", samples + 1)
+redis.call("EXPIRE", KEYS[1], ARGV[4])
+return samples + 1
+`)
+
+// LatencyStore keeps route latency averages in Redis so that they are shared across replicas.
+type LatencyStore struct {
+	client *redis.Client
+	alpha  float64
+	ttl    time.Duration
+}
+
+// NewLatencyStore creates a LatencyStore. alpha (0-1) is the weight given to new samples,
+// stats of routes that haven't been used for ttl are forgotten.
+func NewLatencyStore(client *redis.Client, alpha float64, ttl time.Duration) *LatencyStore {
+	return &LatencyStore{
+		client: client,
+		alpha:  alpha,
+		ttl:    ttl,
+	}
+}
+
+// LatencyRecord is the data structure stored in Redis. Durations are in nanoseconds.
+type LatencyRecord struct {
+	Latency float64 `redis:"latency"`
+	TTFT    float64 `redis:"ttft"`
+	Samples int64   `redis:"samples"`
+}
+
+func latencyKey(routeID string) string {
+	return "latency:" + routeID
+}
+
+func (s *LatencyStore) GetLatency(ctx context.Context, routeIDs []string) (map[string]core.LatencyStats, error) {
+	cmds := make([]*redis.MapStringStringCmd, len(routeIDs))
+	_, err := s.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, id := range routeIDs {
+			cmds[i] = pipe.HGetAll(ctx, latencyKey(id))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get latency from redis: %w", err)
+	}
+
+	stats := make(map[string]core.LatencyStats, len(routeIDs))
+	for i, id := range routeIDs {
+		var record LatencyRecord
+		if err := cmds[i].Scan(&record); err != nil {
+			return nil, fmt.Errorf("failed to scan latency record: %w", err)
+		}
+		if record.Samples == 0 {
+			continue
+		}
+		stats[id] = core.LatencyStats{
+			Latency: time.Duration(record.Latency),
+			TTFT:    time.Duration(record.TTFT),
+			Samples: record.Samples,
+		}
+	}
+	return stats, nil
+}
+
+func (s *LatencyStore) ObserveLatency(ctx context.Context, routeID string, latency, ttft time.Duration) error {
+	err := observeLatencyScript.Run(ctx, s.client, []string{latencyKey(routeID)},
+		s.alpha, int64(latency), int64(ttft), int64(s.ttl.Seconds()),
+	).Err()
+	if err != nil {
+		return fmt.Errorf("failed to observe latency in redis: %w", err)
+	}
+	return nil
+}
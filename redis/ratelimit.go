@@ -0,0 +1,56 @@
+package redis
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"magicrouter/core"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// RateLimitStore shares the rate limit state of routes and keys across replicas, so that
+// all of them stop sending requests to a route once one learns it is about to be throttled.
+type RateLimitStore struct {
+	client *redis.Client
+}
+
+func NewRateLimitStore(client *redis.Client) *RateLimitStore {
+	return &RateLimitStore{client: client}
+}
+
+func rateLimitKey(id string) string {
+	return "ratelimit:" + id
+}
+
+func (s *RateLimitStore) GetRateLimit(ctx context.Context, id string) (*core.RateLimitState, error) {
+	data, err := s.client.Get(ctx, rateLimitKey(id)).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get rate limit state: %w", err)
+	}
+	var state core.RateLimitState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal rate limit state: %w", err)
+	}
+	return &state, nil
+}
+
+func (s *RateLimitStore) SetRateLimit(ctx context.Context, id string, state core.RateLimitState) error {
+	ttl := time.Until(state.Expires())
+	if ttl <= 0 {
+		return nil
+	}
+	data, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("failed to marshal rate limit state: %w", err)
+	}
+	if err := s.client.Set(ctx, rateLimitKey(id), data, ttl).Err(); err != nil {
+		return fmt.Errorf("failed to set rate limit state: %w", err)
+	}
+	return nil
+}
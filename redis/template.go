@@ -0,0 +1,134 @@
+package redis
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"magicrouter/core"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// TemplateStore keeps prompt templates in Redis. The versions of a template are a
+// list, so the version number is the position in the list, next to the active version.
+type TemplateStore struct {
+	client *redis.Client
+}
+
+func NewTemplateStore(client *redis.Client) *TemplateStore {
+	return &TemplateStore{client: client}
+}
+
+func templateVersionsKey(projectID, id string) string {
+	return "template:" + projectID + ":" + id + ":versions"
+}
+
+func templateActiveKey(projectID, id string) string {
+	return "template:" + projectID + ":" + id + ":active"
+}
+
+// storedTemplate is a template version as kept in the list, the ID and version are implied.
+type storedTemplate struct {
+	Messages  []core.TemplateMessage `json:"messages"`
+	CreatedAt time.Time              `json:"created_at"`
+}
+
+func (s *TemplateStore) GetTemplate(ctx context.Context, projectID, id string, version int) (*core.PromptTemplate, error) {
+	if version == 0 {
+		active, err := s.client.Get(ctx, templateActiveKey(projectID, id)).Int()
+		if err == redis.Nil {
+			return nil, core.ErrTemplateNotFound
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to get active template version: %w", err)
+		}
+		version = active
+	}
+	if version < 1 {
+		return nil, core.ErrTemplateNotFound
+	}
+	data, err := s.client.LIndex(ctx, templateVersionsKey(projectID, id), int64(version-1)).Bytes()
+	if err == redis.Nil {
+		return nil, core.ErrTemplateNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get template: %w", err)
+	}
+	return decodeTemplate(id, version, data)
+}
+
+func (s *TemplateStore) ListTemplateVersions(ctx context.Context, projectID, id string) ([]core.PromptTemplate, int, error) {
+	pipe := s.client.Pipeline()
+	versionsCmd := pipe.LRange(ctx, templateVersionsKey(projectID, id), 0, -1)
+	activeCmd := pipe.Get(ctx, templateActiveKey(projectID, id))
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return nil, 0, fmt.Errorf("failed to list template versions: %w", err)
+	}
+	versions := versionsCmd.Val()
+	if len(versions) == 0 {
+		return nil, 0, core.ErrTemplateNotFound
+	}
+	active, _ := strconv.Atoi(activeCmd.Val())
+
+	templates := make([]core.PromptTemplate, len(versions))
+	for i, data := range versions {
+		tmpl, err := decodeTemplate(id, i+1, []byte(data))
+		if err != nil {
+			return nil, 0, err
+		}
+		templates[i] = *tmpl
+	}
+	return templates, active, nil
+}
+
+func (s *TemplateStore) CreateTemplateVersion(ctx context.Context, projectID, id string, messages []core.TemplateMessage) (*core.PromptTemplate, error) {
+	stored := storedTemplate{Messages: messages, CreatedAt: time.Now().UTC()}
+	data, err := json.Marshal(stored)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal template: %w", err)
+	}
+	pipe := s.client.TxPipeline()
+	pushCmd := pipe.RPush(ctx, templateVersionsKey(projectID, id), data)
+	// Only the first version becomes active on its own.
+	pipe.SetNX(ctx, templateActiveKey(projectID, id), 1, 0)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, fmt.Errorf("failed to store template: %w", err)
+	}
+	return &core.PromptTemplate{
+		ID:        id,
+		Version:   int(pushCmd.Val()),
+		Messages:  stored.Messages,
+		CreatedAt: stored.CreatedAt,
+	}, nil
+}
+
+func (s *TemplateStore) PromoteTemplateVersion(ctx context.Context, projectID, id string, version int) error {
+	// Versions are never removed, so one that exists now still exists when it is promoted.
+	count, err := s.client.LLen(ctx, templateVersionsKey(projectID, id)).Result()
+	if err != nil {
+		return fmt.Errorf("failed to count template versions: %w", err)
+	}
+	if version < 1 || int64(version) > count {
+		return core.ErrTemplateNotFound
+	}
+	if err := s.client.Set(ctx, templateActiveKey(projectID, id), version, 0).Err(); err != nil {
+		return fmt.Errorf("failed to promote template version: %w", err)
+	}
+	return nil
+}
+
+func decodeTemplate(id string, version int, data []byte) (*core.PromptTemplate, error) {
+	var stored storedTemplate
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal template: %w", err)
+	}
+	return &core.PromptTemplate{
+		ID:        id,
+		Version:   version,
+		Messages:  stored.Messages,
+		CreatedAt: stored.CreatedAt,
+	}, nil
+}
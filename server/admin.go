@@ -0,0 +1,178 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+
+	"magicrouter/core"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/rs/zerolog/log"
+)
+
+// adminAuth only lets requests bearing the admin token through.
+func adminAuth(adminToken string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			token, err := getBearerToken(r.Header)
+			if err != nil || subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+				writeError(w, HTTPError{
+					StatusCode: http.StatusUnauthorized,
+					Message:    "Incorrect admin token provided.",
+					Type:       "invalid_request_error",
+					Code:       "invalid_api_key",
+				})
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// adminRoutes mounts the admin API, see Handler.
+func (s *Server) adminRoutes(r chi.Router) {
+	r.Use(adminAuth(s.adminToken))
+	// Metrics include the spend of every project.
+	r.Handle("/debug/vars", expvar.Handler())
+	if s.templates != nil {
+		r.Route("/projects/{projectID}/templates/{templateID}", func(r chi.Router) {
+			r.Get("/", handleError(s.listTemplateVersionsHandler))
+			r.Post("/versions", handleError(s.createTemplateVersionHandler))
+			r.Put("/active", handleError(s.promoteTemplateVersionHandler))
+		})
+	}
+	if s.keys != nil {
+		r.Get("/keys/disabled", handleError(s.listDisabledKeysHandler))
+		r.Put("/keys/{keyID}/disabled", handleError(s.disableKeyHandler))
+		r.Delete("/keys/{keyID}/disabled", handleError(s.enableKeyHandler))
+	}
+}
+
+type templateVersions struct {
+	ID            string                `json:"id"`
+	ActiveVersion int                   `json:"active_version"`
+	Versions      []core.PromptTemplate `json:"versions,omitempty"`
+}
+
+func writeJSON(w http.ResponseWriter, statusCode int, v any) error {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		return fmt.Errorf("failed to write response body: %w", err)
+	}
+	return nil
+}
+
+func templateNotFound(err error) error {
+	if errors.Is(err, core.ErrTemplateNotFound) {
+		return HTTPError{
+			StatusCode: http.StatusNotFound,
+			Message:    "The template or version does not exist.",
+			Code:       "template_not_found",
+			Err:        err,
+		}
+	}
+	return err
+}
+
+func (s *Server) listTemplateVersionsHandler(w http.ResponseWriter, r *http.Request) error {
+	id := chi.URLParam(r, "templateID")
+	versions, active, err := s.templates.ListTemplateVersions(r.Context(), chi.URLParam(r, "projectID"), id)
+	if err != nil {
+		return templateNotFound(err)
+	}
+	return writeJSON(w, http.StatusOK, templateVersions{ID: id, ActiveVersion: active, Versions: versions})
+}
+
+func (s *Server) createTemplateVersionHandler(w http.ResponseWriter, r *http.Request) error {
+	var req struct {
+		Messages []core.TemplateMessage `json:"messages"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return HTTPError{StatusCode: http.StatusBadRequest, Message: "invalid request body", Err: err}
+	}
+	if len(req.Messages) == 0 {
+		return HTTPError{StatusCode: http.StatusBadRequest, Message: "messages must not be empty", Param: "messages"}
+	}
+	for _, msg := range req.Messages {
+		if msg.Role == "" {
+			return HTTPError{StatusCode: http.StatusBadRequest, Message: "every message needs a role", Param: "messages"}
+		}
+	}
+
+	projectID := chi.URLParam(r, "projectID")
+	tmpl, err := s.templates.CreateTemplateVersion(r.Context(), projectID, chi.URLParam(r, "templateID"), req.Messages)
+	if err != nil {
+		return err
+	}
+	log.Info().
+		Str("project_id", projectID).
+		Str("template", tmpl.ID).
+		Int("template_version", tmpl.Version).
+		Msg("template_version_created")
+	return writeJSON(w, http.StatusCreated, tmpl)
+}
+
+// promoteTemplateVersionHandler sets the version used by requests that don't pin one.
+// Promoting an older version rolls the template back.
+func (s *Server) promoteTemplateVersionHandler(w http.ResponseWriter, r *http.Request) error {
+	var req struct {
+		Version int `json:"version"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return HTTPError{StatusCode: http.StatusBadRequest, Message: "invalid request body", Err: err}
+	}
+
+	projectID, id := chi.URLParam(r, "projectID"), chi.URLParam(r, "templateID")
+	if err := s.templates.PromoteTemplateVersion(r.Context(), projectID, id, req.Version); err != nil {
+		return templateNotFound(err)
+	}
+	log.Info().
+		Str("project_id", projectID).
+		Str("template", id).
+		Int("template_version", req.Version).
+		Msg("template_version_promoted")
+	return writeJSON(w, http.StatusOK, templateVersions{ID: id, ActiveVersion: req.Version})
+}
+
+func (s *Server) listDisabledKeysHandler(w http.ResponseWriter, r *http.Request) error {
+	disabled, err := s.keys.DisabledKeys(r.Context())
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, struct {
+		Disabled map[string]string `json:"disabled"`
+	}{disabled})
+}
+
+// disableKeyHandler stops routes from using a provider key, e.g. because it leaked.
+func (s *Server) disableKeyHandler(w http.ResponseWriter, r *http.Request) error {
+	var req struct {
+		Reason string `json:"reason"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		return HTTPError{StatusCode: http.StatusBadRequest, Message: "invalid request body", Err: err}
+	}
+	keyID := chi.URLParam(r, "keyID")
+	if err := s.keys.DisableKey(r.Context(), keyID, req.Reason); err != nil {
+		return err
+	}
+	log.Warn().Str("key_id", keyID).Str("reason", req.Reason).Msg("provider_key_disabled")
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func (s *Server) enableKeyHandler(w http.ResponseWriter, r *http.Request) error {
+	keyID := chi.URLParam(r, "keyID")
+	if err := s.keys.EnableKey(r.Context(), keyID); err != nil {
+		return err
+	}
+	log.Info().Str("key_id", keyID).Msg("provider_key_enabled")
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
@@ -0,0 +1,380 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"magicrouter/core"
+	"magicrouter/webhook"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/rs/zerolog/log"
+	"github.com/sashabaranov/go-openai"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+const (
+	// jobPollTimeout is how long workers wait for a job before checking for shutdown.
+	jobPollTimeout = time.Second
+	maxJobBackoff  = time.Minute
+)
+
+// jobView is how jobs are shown to clients and webhooks, without their token and request.
+type jobView struct {
+	ID        string          `json:"id"`
+	Object    string          `json:"object"`
+	Status    core.JobStatus  `json:"status"`
+	Attempts  int             `json:"attempts"`
+	RouteID   string          `json:"route_id,omitempty"`
+	Result    *core.JobResult `json:"result,omitempty"`
+	Error     string          `json:"error,omitempty"`
+	CreatedAt int64           `json:"created_at"`
+	UpdatedAt int64           `json:"updated_at"`
+}
+
+func newJobView(job *core.Job) jobView {
+	return jobView{
+		ID:        job.ID,
+		Object:    "async.job",
+		Status:    job.Status,
+		Attempts:  job.Attempts,
+		RouteID:   job.RouteID,
+		Result:    job.Result,
+		Error:     job.Error,
+		CreatedAt: job.CreatedAt.Unix(),
+		UpdatedAt: job.UpdatedAt.Unix(),
+	}
+}
+
+func newJobID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate job id: %w", err)
+	}
+	return "job_" + hex.EncodeToString(b), nil
+}
+
+// webhookURL removes the webhook_url field from body and checks it.
+func webhookURL(body []byte) (string, []byte, error) {
+	field := gjson.GetBytes(body, "webhook_url")
+	if !field.Exists() {
+		return "", body, nil
+	}
+	u, err := url.Parse(field.String())
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", body, HTTPError{
+			StatusCode: http.StatusBadRequest,
+			Message:    "webhook_url must be an http or https URL",
+			Param:      "webhook_url",
+			Err:        err,
+		}
+	}
+	body, err = sjson.DeleteBytes(body, "webhook_url")
+	if err != nil {
+		return "", body, fmt.Errorf("failed to remove webhook_url: %w", err)
+	}
+	return u.String(), body, nil
+}
+
+// webhookHost returns the host of hook, which webhookURL checked, without its port.
+func webhookHost(hook string) string {
+	u, _ := url.Parse(hook)
+	return u.Hostname()
+}
+
+// enqueueJobHandler accepts a chat completion to run in the background. Requests are
+// checked and rewritten as they would be synchronously before they are queued.
+func (s *Server) enqueueJobHandler(w http.ResponseWriter, r *http.Request) error {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read request body: %w", err)
+	}
+	var req openai.ChatCompletionRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		return HTTPError{
+			StatusCode: http.StatusBadRequest,
+			Message:    "invalid request body",
+			Err:        err,
+		}
+	}
+	if req.Stream {
+		return HTTPError{
+			StatusCode: http.StatusBadRequest,
+			Message:    "Asynchronous completions can't be streamed.",
+			Param:      "stream",
+		}
+	}
+	quality, body, err := minQuality(r, body)
+	if err != nil {
+		return err
+	}
+	hook, body, err := webhookURL(body)
+	if err != nil {
+		return err
+	}
+
+	token := getToken(r.Context())
+	if err := s.checkBudget(r.Context(), token); err != nil {
+		return err
+	}
+	cfg, err := s.projectStore.GetConfig(token.ProjectID)
+	if err != nil {
+		return fmt.Errorf("failed to get project config: %w", err)
+	}
+	if hook != "" && (cfg.Async == nil || cfg.Async.WebhookSecret == "") {
+		return HTTPError{
+			StatusCode: http.StatusBadRequest,
+			Message:    "The project has no webhook secret to sign webhooks with.",
+			Param:      "webhook_url",
+		}
+	}
+	if hook != "" && !cfg.Async.AllowsWebhookHost(webhookHost(hook)) {
+		return HTTPError{
+			StatusCode: http.StatusBadRequest,
+			Message:    "Webhooks can't be sent to this host.",
+			Param:      "webhook_url",
+		}
+	}
+	if cfg.PII != nil {
+		// Tokenized personal data would have to be kept until the job is done to be restored.
+		return HTTPError{
+			StatusCode: http.StatusBadRequest,
+			Message:    "Asynchronous completions are not available for projects with a PII policy.",
+		}
+	}
+
+	body, _, err = s.renderTemplate(r.Context(), token.ProjectID, body)
+	if err != nil {
+		return err
+	}
+	if cfg.Transform != nil {
+		body, err = cfg.Transform.Apply(body)
+		if err != nil {
+			return fmt.Errorf("failed to transform request: %w", err)
+		}
+	}
+	guardrails, err := s.guardrails(cfg)
+	if err != nil {
+		return err
+	}
+	if err := guardrails.CheckRequest(r.Context(), body); err != nil {
+		return err
+	}
+
+	id, err := newJobID()
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	job := &core.Job{
+		ID:         id,
+		Token:      token,
+		Request:    body,
+		MinQuality: quality,
+		WebhookURL: hook,
+		Status:     core.JobQueued,
+		CreatedAt:  now,
+		UpdatedAt:  now,
+	}
+	if err := s.jobs.Enqueue(r.Context(), job); err != nil {
+		return fmt.Errorf("failed to enqueue job: %w", err)
+	}
+	log.Info().Str("project_id", token.ProjectID).Str("job_id", id).Msg("job_enqueued")
+	return writeJSON(w, http.StatusAccepted, newJobView(job))
+}
+
+func (s *Server) getJobHandler(w http.ResponseWriter, r *http.Request) error {
+	job, err := s.jobs.GetJob(r.Context(), chi.URLParam(r, "jobID"))
+	if err != nil {
+		return fmt.Errorf("failed to get job: %w", err)
+	}
+	// Jobs of other projects don't exist as far as the token is concerned.
+	if job == nil || job.Token.ProjectID != getToken(r.Context()).ProjectID {
+		return HTTPError{
+			StatusCode: http.StatusNotFound,
+			Message:    "The job does not exist.",
+			Code:       "job_not_found",
+		}
+	}
+	return writeJSON(w, http.StatusOK, newJobView(job))
+}
+
+// startJobWorkers runs queued jobs until ctx is cancelled.
+func (s *Server) startJobWorkers(ctx context.Context) {
+	if s.jobs == nil {
+		return
+	}
+	for i := 0; i < s.jobWorkers; i++ {
+		s.jobsRunning.Add(1)
+		go func() {
+			defer s.jobsRunning.Done()
+			for ctx.Err() == nil {
+				job, err := s.jobs.Dequeue(ctx, jobPollTimeout)
+				if err != nil {
+					if ctx.Err() == nil {
+						log.Err(err).Msg("failed to dequeue job")
+						time.Sleep(jobPollTimeout)
+					}
+					continue
+				}
+				if job != nil {
+					s.runJob(ctx, job)
+				}
+			}
+		}()
+	}
+}
+
+// waitJobs waits for the jobs being run to finish or be requeued.
+func (s *Server) waitJobs(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		s.jobsRunning.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// runJob attempts job until it completes or runs out of attempts, backing off between
+// attempts. Attempts aren't interrupted by ctx, the job is requeued instead of retried
+// once ctx is cancelled.
+func (s *Server) runJob(ctx context.Context, job *core.Job) {
+	runCtx := context.WithoutCancel(ctx)
+	logger := log.With().Str("project_id", job.Token.ProjectID).Str("job_id", job.ID).Logger()
+
+	cfg, err := s.projectStore.GetConfig(job.Token.ProjectID)
+	if err != nil {
+		job.Error = fmt.Sprintf("failed to get project config: %v", err)
+		s.finishJob(runCtx, job, core.AsyncConfig{})
+		return
+	}
+	var async core.AsyncConfig
+	if cfg.Async != nil {
+		async = *cfg.Async
+	}
+
+	backoff := s.jobBackoff
+	for {
+		job.Status = core.JobRunning
+		job.Attempts++
+		s.updateJob(runCtx, job)
+
+		retry := s.attemptJob(runCtx, cfg, job)
+		if !retry || job.Attempts >= async.MaxAttemptsOrDefault() {
+			break
+		}
+		logger.Warn().Int("attempts", job.Attempts).Str("error", job.Error).Msg("job_attempt_failed")
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			job.Status = core.JobQueued
+			job.UpdatedAt = time.Now().UTC()
+			if err := s.jobs.Enqueue(runCtx, job); err != nil {
+				logger.Err(err).Msg("failed to requeue job")
+			}
+			return
+		}
+		backoff = min(2*backoff, maxJobBackoff)
+	}
+	s.finishJob(runCtx, job, async)
+}
+
+// attemptJob sends the request of job once, recording the outcome in job.
+// It reports whether the job should be attempted again.
+func (s *Server) attemptJob(ctx context.Context, cfg *core.ProjectConfig, job *core.Job) bool {
+	ctx, cancel := context.WithTimeout(ctx, s.requestTimeout)
+	defer cancel()
+	ctx = s.routingContext(core.WithPriority(core.WithMinQuality(ctx, job.MinQuality), job.Token.Priority), cfg.ID)
+	if cfg.Concurrency != nil {
+		release, err := s.limiters.Get("project:"+cfg.ID, *cfg.Concurrency).Acquire(ctx)
+		if err != nil {
+			job.Error = err.Error()
+			return true
+		}
+		defer release()
+	}
+
+	// Invalid guardrails fail the job before anything is paid for.
+	guardrails, err := s.guardrails(cfg)
+	if err != nil {
+		job.Error = err.Error()
+		return false
+	}
+	model := cfg.Model(gjson.GetBytes(job.Request, "model").String())
+	ctx = core.WithUsageRecorder(ctx, func(route core.Route, usage core.Usage) {
+		s.recordUsage(ctx, job.Token, route, usage)
+	})
+	service := core.NewFallbackChatService(model.Routes, s.services, core.NoOpBreaker{}, s.fallbackOptions(cfg, model, job.Request)...)
+	response, err := service.ChatCompletion(ctx, job.Request)
+	if err != nil {
+		job.Error = err.Error()
+		return true
+	}
+	defer response.Body.Close()
+	job.RouteID = response.Route.ID
+
+	if err := guardrails.CheckCompletion(ctx, job.Request, response.Response); err != nil {
+		s.recordRejectedUsage(ctx, job.Token, response)
+		job.Error = err.Error()
+		return false
+	}
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		job.Error = fmt.Sprintf("failed to read response body: %v", err)
+		return true
+	}
+	if response.StatusCode == http.StatusOK {
+		if usage, ok := core.ParseUsage(body); ok {
+			s.recordUsage(ctx, job.Token, response.Route, usage)
+		}
+	}
+	if !json.Valid(body) {
+		body, _ = json.Marshal(string(body))
+	}
+	job.Result = &core.JobResult{StatusCode: response.StatusCode, Body: body}
+	job.Error = ""
+	return response.StatusCode == http.StatusTooManyRequests || response.StatusCode >= 500
+}
+
+// finishJob records the final state of job and notifies its webhook.
+func (s *Server) finishJob(ctx context.Context, job *core.Job, async core.AsyncConfig) {
+	job.Status = core.JobFailed
+	if job.Error == "" && job.Result != nil && job.Result.StatusCode < 300 {
+		job.Status = core.JobSucceeded
+	}
+	s.updateJob(ctx, job)
+	log.Info().
+		Str("project_id", job.Token.ProjectID).
+		Str("job_id", job.ID).
+		Str("status", string(job.Status)).
+		Int("attempts", job.Attempts).
+		Msg("job_done")
+
+	if job.WebhookURL == "" || async.WebhookSecret == "" {
+		return
+	}
+	hook := webhook.NewSigned(s.webhookClient, job.WebhookURL, async.WebhookSecret)
+	if err := hook.Send(ctx, "async.job."+string(job.Status), newJobView(job)); err != nil {
+		log.Err(err).Str("job_id", job.ID).Msg("failed to send job webhook")
+	}
+}
+
+func (s *Server) updateJob(ctx context.Context, job *core.Job) {
+	job.UpdatedAt = time.Now().UTC()
+	if err := s.jobs.UpdateJob(ctx, job); err != nil {
+		log.Err(err).Str("job_id", job.ID).Msg("failed to update job")
+	}
+}
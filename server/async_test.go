@@ -0,0 +1,126 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"magicrouter/core"
+	"magicrouter/inmem"
+	"magicrouter/mocks"
+	"magicrouter/webhook"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/tidwall/gjson"
+)
+
+func TestAsyncJobs(t *testing.T) {
+	received := make(chan *http.Request, 1)
+	var hookBody []byte
+	hooks := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hookBody, _ = io.ReadAll(r.Body)
+		received <- r
+	}))
+	defer hooks.Close()
+
+	mockService := mocks.NewChatService(t)
+	mockService.On("ChatCompletion", mock.Anything, mock.Anything, "gpt-4o", "").
+		Return(&http.Response{
+			StatusCode: http.StatusBadGateway,
+			Body:       io.NopCloser(strings.NewReader(`upstream unavailable`)),
+		}, nil).
+		Once()
+	mockService.On("ChatCompletion", mock.Anything, mock.Anything, "gpt-4o", "").
+		Return(&http.Response{
+			StatusCode: http.StatusOK,
+			Body:       io.NopCloser(strings.NewReader(`{"choices": [{"message": {"content": "hi"}}]}`)),
+		}, nil).
+		Once()
+	s := testServer(&core.ProjectConfig{Async: &core.AsyncConfig{WebhookSecret: "secret"}}, mockService,
+		WithAsyncJobs(inmem.NewJobQueue(10, time.Hour), 1))
+	s.jobBackoff = time.Millisecond
+	// The webhook is sent to a loopback address.
+	s.webhookClient = hooks.Client()
+
+	r := httptest.NewRequest(http.MethodPost, "/v1/async/chat/completions",
+		strings.NewReader(fmt.Sprintf(`{"model": "gpt-4o", "messages": [], "webhook_url": %q}`, hooks.URL)))
+	r.Header.Set("Authorization", "Bearer test")
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, r)
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	var job jobView
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &job))
+	assert.Equal(t, core.JobQueued, job.Status)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s.startJobWorkers(ctx)
+	defer func() {
+		cancel()
+		assert.NoError(t, s.waitJobs(context.Background()))
+	}()
+
+	select {
+	case hook := <-received:
+		var timestamp int64
+		var signature string
+		_, err := fmt.Sscanf(hook.Header.Get(webhook.SignatureHeader), "t=%d,v1=%s", &timestamp, &signature)
+		assert.NoError(t, err)
+		assert.Equal(t, webhook.Sign("secret", time.Unix(timestamp, 0), hookBody), signature)
+		assert.Equal(t, "async.job.succeeded", gjson.GetBytes(hookBody, "type").String())
+	case <-time.After(time.Second):
+		t.Fatal("webhook not received")
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "/v1/async/jobs/"+job.ID, nil)
+	r.Header.Set("Authorization", "Bearer test")
+	w = httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &job))
+	assert.Equal(t, core.JobSucceeded, job.Status)
+	assert.Equal(t, 2, job.Attempts)
+	assert.Equal(t, "route1", job.RouteID)
+	assert.JSONEq(t, `{"choices": [{"message": {"content": "hi"}}]}`, string(job.Result.Body))
+}
+
+func TestAsyncJobs_Rejected(t *testing.T) {
+	s := testServer(&core.ProjectConfig{}, mocks.NewChatService(t), WithAsyncJobs(inmem.NewJobQueue(10, time.Hour), 1))
+	restricted := testServer(&core.ProjectConfig{Async: &core.AsyncConfig{
+		WebhookSecret: "secret",
+		WebhookHosts:  []string{"hooks.example.com", "*.example.org"},
+	}}, mocks.NewChatService(t), WithAsyncJobs(inmem.NewJobQueue(10, time.Hour), 1))
+
+	tests := []struct {
+		name   string
+		server *Server
+		method string
+		path   string
+		body   string
+		status int
+	}{
+		{"streams", s, http.MethodPost, "/v1/async/chat/completions", `{"model": "gpt-4o", "stream": true}`, http.StatusBadRequest},
+		{"webhook without secret", s, http.MethodPost, "/v1/async/chat/completions", `{"model": "gpt-4o", "webhook_url": "https://example.com"}`, http.StatusBadRequest},
+		{"invalid webhook", s, http.MethodPost, "/v1/async/chat/completions", `{"model": "gpt-4o", "webhook_url": "example"}`, http.StatusBadRequest},
+		{"webhook host not allowed", restricted, http.MethodPost, "/v1/async/chat/completions", `{"model": "gpt-4o", "messages": [], "webhook_url": "http://169.254.169.254/latest"}`, http.StatusBadRequest},
+		{"webhook subdomain not allowed", restricted, http.MethodPost, "/v1/async/chat/completions", `{"model": "gpt-4o", "messages": [], "webhook_url": "https://example.org.evil.com"}`, http.StatusBadRequest},
+		{"allowed webhook host", restricted, http.MethodPost, "/v1/async/chat/completions", `{"model": "gpt-4o", "messages": [], "webhook_url": "https://HOOKS.example.com:8443/jobs"}`, http.StatusAccepted},
+		{"allowed webhook subdomain", restricted, http.MethodPost, "/v1/async/chat/completions", `{"model": "gpt-4o", "messages": [], "webhook_url": "https://a.b.example.org"}`, http.StatusAccepted},
+		{"unknown job", s, http.MethodGet, "/v1/async/jobs/job_1", "", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			r.Header.Set("Authorization", "Bearer test")
+			w := httptest.NewRecorder()
+			tt.server.Handler().ServeHTTP(w, r)
+			assert.Equal(t, tt.status, w.Code)
+		})
+	}
+}
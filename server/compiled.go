@@ -0,0 +1,48 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"sync"
+
+	"magicrouter/core"
+)
+
+// compiledProject holds what is built from a project config once rather than on every
+// request. It is replaced when the compiled parts of the config change.
+type compiledProject struct {
+	// version hashes the parts of the config it was compiled from.
+	version [sha256.Size]byte
+
+	redactorOnce sync.Once
+	redactor     *core.Redactor
+	redactorErr  error
+
+	guardrailsOnce sync.Once
+	guardrails     *core.GuardrailChain
+	guardrailsErr  error
+}
+
+func (s *Server) compiled(cfg *core.ProjectConfig) *compiledProject {
+	// Stores may return a new config on every call, so configs are told apart by content.
+	data, _ := json.Marshal(struct {
+		PII        *core.PIIPolicy
+		Guardrails []core.GuardrailConfig
+	}{cfg.PII, cfg.Guardrails})
+	version := sha256.Sum256(data)
+	if c, ok := s.compiledProjects.Load(cfg.ID); ok && c.(*compiledProject).version == version {
+		return c.(*compiledProject)
+	}
+	c := &compiledProject{version: version}
+	s.compiledProjects.Store(cfg.ID, c)
+	return c
+}
+
+// redactor returns the redactor of the PII policy of cfg.
+func (s *Server) redactor(cfg *core.ProjectConfig) (*core.Redactor, error) {
+	c := s.compiled(cfg)
+	c.redactorOnce.Do(func() {
+		c.redactor, c.redactorErr = core.NewRedactor(*cfg.PII)
+	})
+	return c.redactor, c.redactorErr
+}
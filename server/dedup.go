@@ -0,0 +1,128 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"magicrouter/core"
+	"magicrouter/metrics"
+
+	"github.com/rs/zerolog/log"
+)
+
+// coalescedHeader is set on responses shared with another identical request.
+const coalescedHeader = "X-Magicrouter-Coalesced"
+
+// responseRecorder passes a response through while keeping a copy of it.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	header http.Header
+	body   bytes.Buffer
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+		r.header = r.ResponseWriter.Header().Clone()
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(p []byte) (int, error) {
+	if r.status == 0 {
+		r.WriteHeader(http.StatusOK)
+	}
+	r.body.Write(p)
+	return r.ResponseWriter.Write(p)
+}
+
+// Unwrap lets http.ResponseController flush the underlying writer.
+func (r *responseRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// response returns the recorded response. The cost isn't part of it, it was billed once.
+func (r *responseRecorder) response() core.CachedResponse {
+	header := r.header.Clone()
+	header.Del(costHeader)
+	header.Del("Trailer")
+	return core.CachedResponse{
+		StatusCode: r.status,
+		Header:     header,
+		Body:       r.body.Bytes(),
+	}
+}
+
+// writeCached replays a recorded response.
+func writeCached(w http.ResponseWriter, resp core.CachedResponse) error {
+	for k, v := range resp.Header {
+		w.Header()[k] = v
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(resp.Body)))
+	w.WriteHeader(resp.StatusCode)
+	_, err := w.Write(resp.Body)
+	return err
+}
+
+// coalesce joins the flight of requests identical to body. When another request
+// leads it, its response is written to w and done is true. Otherwise the returned
+// writer records the response to share it and finish must be called once the request
+// is over with its error.
+func (s *Server) coalesce(ctx context.Context, w http.ResponseWriter, cfg *core.ProjectConfig, body []byte, includeUsage bool) (rw http.ResponseWriter, finish func(error), done bool, err error) {
+	hash, err := core.RequestHash(body)
+	if err != nil {
+		return nil, nil, false, fmt.Errorf("failed to hash request: %w", err)
+	}
+	variant, _ := ctx.Value(variantContextKey{}).(string)
+	key := fmt.Sprintf("%s:%s:%t:%s", cfg.ID, variant, includeUsage, hash)
+
+	timeout := cfg.Dedup.TimeoutOrDefault()
+	leader, err := s.flights.Acquire(ctx, key, timeout)
+	if err != nil {
+		// Don't block traffic when the flight store is unavailable.
+		log.Err(err).Msg("failed to acquire flight")
+		return w, func(error) {}, false, nil
+	}
+
+	if !leader {
+		wctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		resp, err := s.flights.Wait(wctx, key)
+		if ctx.Err() != nil {
+			// The client is gone, there is nothing to respond to.
+			return w, nil, true, nil
+		}
+		if err != nil {
+			log.Err(err).Msg("failed to wait for flight")
+		}
+		if resp == nil {
+			return w, func(error) {}, false, nil
+		}
+		metrics.Coalesced.Add(cfg.ID, 1)
+		w.Header().Set(coalescedHeader, "true")
+		if err := writeCached(w, *resp); err != nil {
+			log.Err(err).Msg("failed to write coalesced response")
+		}
+		return w, nil, true, nil
+	}
+
+	rec := &responseRecorder{ResponseWriter: w}
+	return rec, func(reqErr error) {
+		ctx := context.WithoutCancel(ctx)
+		var err error
+		if reqErr != nil || rec.status < 200 || rec.status >= 300 {
+			// Followers make their own request rather than share a failure,
+			// including upstream errors passed through as they are.
+			err = s.flights.Abandon(ctx, key)
+		} else {
+			err = s.flights.Complete(ctx, key, rec.response())
+		}
+		if err != nil {
+			log.Err(err).Msg("failed to finish flight")
+		}
+	}, false, nil
+}
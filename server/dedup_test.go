@@ -0,0 +1,123 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"magicrouter/core"
+	"magicrouter/inmem"
+	"magicrouter/mocks"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// testServer serves project1 with a single route of mockService to the token "test".
+func testServer(cfg *core.ProjectConfig, mockService *mocks.ChatService, opts ...Option) *Server {
+	cfg.ID = "project1"
+	cfg.Routes = []core.Route{{ID: "route1", Provider: "openai", Model: "gpt-4o"}}
+	return New(
+		inmem.TokenStore{"test": &core.Token{ID: "token1", ProjectID: "project1"}},
+		core.ChatServices{"openai": mockService},
+		inmem.ProjectStore{"project1": cfg},
+		opts...,
+	)
+}
+
+func postCompletion(s *Server, body string, headers ...string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(body))
+	r.Header.Set("Authorization", "Bearer test")
+	for i := 0; i+1 < len(headers); i += 2 {
+		r.Header.Set(headers[i], headers[i+1])
+	}
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, r)
+	return w
+}
+
+func TestChatCompletionHandler_Dedup(t *testing.T) {
+	release := make(chan time.Time)
+	mockService := mocks.NewChatService(t)
+	mockService.On("ChatCompletion", mock.Anything, mock.Anything, "gpt-4o", "").
+		WaitUntil(release).
+		Return(&http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Content-Type": []string{"application/json"}},
+			Body:       io.NopCloser(strings.NewReader(`{"choices": [{"message": {"content": "hi"}}]}`)),
+		}, nil).
+		Once()
+	s := testServer(&core.ProjectConfig{Dedup: &core.DedupConfig{}}, mockService, WithDeduplication(inmem.NewFlightStore()))
+
+	bodies := []string{
+		`{"model": "gpt-4o", "messages": [{"role": "user", "content": "hi"}]}`,
+		`{"messages": [{"content": "hi", "role": "user"}], "model": "gpt-4o"}`,
+		`{"model": "gpt-4o",   "messages": [{"role": "user", "content": "hi"}]}`,
+	}
+	responses := make([]*httptest.ResponseRecorder, len(bodies))
+	var wg sync.WaitGroup
+	for i, body := range bodies {
+		wg.Add(1)
+		go func(i int, body string) {
+			defer wg.Done()
+			responses[i] = postCompletion(s, body)
+		}(i, body)
+		// Let the first request lead.
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	coalesced := 0
+	for _, w := range responses {
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.JSONEq(t, `{"choices": [{"message": {"content": "hi"}}]}`, w.Body.String())
+		assert.Equal(t, "route1", w.Header().Get(routeHeader))
+		if w.Header().Get(coalescedHeader) == "true" {
+			coalesced++
+		}
+	}
+	assert.Equal(t, 2, coalesced)
+}
+
+func TestChatCompletionHandler_DedupUpstreamError(t *testing.T) {
+	release := make(chan time.Time)
+	mockService := mocks.NewChatService(t)
+	mockService.On("ChatCompletion", mock.Anything, mock.Anything, "gpt-4o", "").
+		WaitUntil(release).
+		Return(func(_ context.Context, _ json.RawMessage, _, _ string) *http.Response {
+			return &http.Response{
+				StatusCode: http.StatusInternalServerError,
+				Header:     http.Header{"Content-Type": []string{"application/json"}},
+				Body:       io.NopCloser(strings.NewReader(`{"error": {"message": "overloaded"}}`)),
+			}
+		}, nil).
+		Twice()
+	s := testServer(&core.ProjectConfig{Dedup: &core.DedupConfig{}}, mockService, WithDeduplication(inmem.NewFlightStore()))
+
+	body := `{"model": "gpt-4o", "messages": [{"role": "user", "content": "hi"}]}`
+	responses := make([]*httptest.ResponseRecorder, 2)
+	var wg sync.WaitGroup
+	for i := range responses {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			responses[i] = postCompletion(s, body)
+		}(i)
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(release)
+	wg.Wait()
+
+	// The follower made its own request instead of sharing the leader's error.
+	for _, w := range responses {
+		assert.Empty(t, w.Header().Get(coalescedHeader))
+	}
+}
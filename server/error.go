@@ -1,12 +1,33 @@
 package server
 
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"magicrouter/core"
+)
+
+// attemptsHeader lists the outcome of each route attempted when all of them failed.
+const attemptsHeader = "X-Magicrouter-Attempts"
+
 type HTTPError struct {
 	StatusCode int
 	Message    string
-	Err        error
+	// Type, Param and Code mirror the fields of OpenAI's error object.
+	Type  string
+	Param string
+	Code  string
+	Err   error
 }
 
 func (e HTTPError) Error() string {
+	if e.Err == nil {
+		return e.Message
+	}
 	return e.Err.Error()
 }
 
@@ -15,5 +36,219 @@ func (e HTTPError) Unwrap() error {
 }
 
 func (e HTTPError) MarshalJSON() ([]byte, error) {
-	return []byte(`{"message": "` + e.Message + `"}`), nil
+	type body struct {
+		Message string  `json:"message"`
+		Type    string  `json:"type"`
+		Param   *string `json:"param"`
+		Code    *string `json:"code"`
+	}
+	b := body{Message: e.Message, Type: e.Type}
+	if e.Param != "" {
+		b.Param = &e.Param
+	}
+	if e.Code != "" {
+		b.Code = &e.Code
+	}
+	return json.Marshal(struct {
+		Error body `json:"error"`
+	}{b})
+}
+
+// errorResponse returns the response handleError writes for err.
+func errorResponse(err error) core.CachedResponse {
+	header := http.Header{"Content-Type": []string{"application/json"}}
+	var fallbackErr core.FallbackError
+	if errors.As(err, &fallbackErr) && len(fallbackErr) > 0 {
+		header.Set(attemptsHeader, formatAttempts(fallbackErr))
+	}
+	httpErr := toHTTPError(err)
+	body, _ := json.Marshal(httpErr)
+	return core.CachedResponse{StatusCode: httpErr.StatusCode, Header: header, Body: append(body, '\n')}
+}
+
+func writeError(w http.ResponseWriter, err HTTPError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(err.StatusCode)
+	json.NewEncoder(w).Encode(err)
+}
+
+// toHTTPError maps any error to an HTTPError so that clients always get an OpenAI style error.
+func toHTTPError(err error) HTTPError {
+	var httpErr HTTPError
+	if errors.As(err, &httpErr) {
+		if httpErr.Type == "" {
+			httpErr.Type = errorType(httpErr.StatusCode)
+		}
+		if httpErr.Message == "" {
+			httpErr.Message = http.StatusText(httpErr.StatusCode)
+		}
+		return httpErr
+	}
+
+	var fallbackErr core.FallbackError
+	if errors.As(err, &fallbackErr) {
+		return fallbackHTTPError(fallbackErr)
+	}
+
+	if errors.Is(err, core.ErrUnsupportedCapability) {
+		return HTTPError{
+			StatusCode: http.StatusBadRequest,
+			Message:    "None of the models configured for this request support it: " + err.Error(),
+			Type:       errorType(http.StatusBadRequest),
+			Code:       "unsupported_capability",
+			Err:        err,
+		}
+	}
+
+	if errors.Is(err, core.ErrUnsupportedSchema) {
+		return HTTPError{
+			StatusCode: http.StatusBadRequest,
+			Message:    "The response format can't be validated: " + err.Error(),
+			Type:       errorType(http.StatusBadRequest),
+			Param:      "response_format",
+			Code:       "unsupported_schema",
+			Err:        err,
+		}
+	}
+
+	var violation *core.GuardrailViolation
+	if errors.As(err, &violation) {
+		return HTTPError{
+			StatusCode: http.StatusBadRequest,
+			Message:    fmt.Sprintf("The %s was rejected by our content policy: %s", violation.Stage, violation.Reason),
+			Type:       errorType(http.StatusBadRequest),
+			Code:       "content_policy_violation",
+			Err:        err,
+		}
+	}
+
+	if errors.Is(err, core.ErrInvalidStructuredOutput) {
+		return HTTPError{
+			StatusCode: http.StatusBadGateway,
+			Message:    "No model returned output matching the requested response format.",
+			Type:       errorType(http.StatusBadGateway),
+			Param:      "response_format",
+			Code:       "invalid_structured_output",
+			Err:        err,
+		}
+	}
+
+	if errors.Is(err, core.ErrConcurrencyLimited) {
+		return concurrencyHTTPError(err)
+	}
+
+	if errors.Is(err, core.ErrQualityUnavailable) {
+		return HTTPError{
+			StatusCode: http.StatusBadRequest,
+			Message:    "No model configured for this request meets the minimum quality set by " + minQualityHeader + " or metadata.min_quality.",
+			Type:       errorType(http.StatusBadRequest),
+			Param:      "metadata.min_quality",
+			Code:       "quality_unavailable",
+			Err:        err,
+		}
+	}
+
+	if errors.Is(err, core.ErrContextLengthExceeded) {
+		return HTTPError{
+			StatusCode: http.StatusBadRequest,
+			Message:    "This model's maximum context length is exceeded: " + err.Error(),
+			Type:       errorType(http.StatusBadRequest),
+			Param:      "messages",
+			Code:       "context_length_exceeded",
+			Err:        err,
+		}
+	}
+
+	return HTTPError{
+		StatusCode: http.StatusInternalServerError,
+		Message:    "The server had an error while processing your request.",
+		Type:       errorType(http.StatusInternalServerError),
+		Err:        err,
+	}
+}
+
+func fallbackHTTPError(err core.FallbackError) HTTPError {
+	switch {
+	case len(err) == 0:
+		return HTTPError{
+			StatusCode: http.StatusServiceUnavailable,
+			Message:    "No route is currently available to serve the request.",
+			Type:       errorType(http.StatusServiceUnavailable),
+			Code:       "no_route_available",
+			Err:        err,
+		}
+	case err.All(core.ErrProviderRateLimited):
+		return HTTPError{
+			StatusCode: http.StatusTooManyRequests,
+			Message:    "Rate limit reached on all routes. Please try again later.",
+			Type:       "requests",
+			Code:       "rate_limit_exceeded",
+			Err:        err,
+		}
+	case err.All(core.ErrConcurrencyLimited):
+		return concurrencyHTTPError(err)
+	case err.All(core.ErrProviderTimeout):
+		return HTTPError{
+			StatusCode: http.StatusGatewayTimeout,
+			Message:    "All routes timed out.",
+			Type:       errorType(http.StatusGatewayTimeout),
+			Code:       "upstream_timeout",
+			Err:        err,
+		}
+	default:
+		return HTTPError{
+			StatusCode: http.StatusBadGateway,
+			Message:    "All routes failed to serve the request.",
+			Type:       errorType(http.StatusBadGateway),
+			Code:       "upstream_error",
+			Err:        err,
+		}
+	}
+}
+
+func concurrencyHTTPError(err error) HTTPError {
+	return HTTPError{
+		StatusCode: http.StatusTooManyRequests,
+		Message:    "Too many concurrent requests. Please try again later.",
+		Type:       "requests",
+		Code:       "concurrency_limit_exceeded",
+		Err:        err,
+	}
+}
+
+func errorType(statusCode int) string {
+	switch {
+	case statusCode == http.StatusUnauthorized:
+		return "authentication_error"
+	case statusCode == http.StatusTooManyRequests:
+		return "requests"
+	case statusCode >= 500:
+		return "server_error"
+	default:
+		return "invalid_request_error"
+	}
+}
+
+// formatAttempts renders the outcome of each route, e.g. "route1=rate_limited, route2=timeout".
+func formatAttempts(err core.FallbackError) string {
+	routes := make([]string, 0, len(err))
+	for route := range err {
+		routes = append(routes, route)
+	}
+	sort.Strings(routes)
+
+	attempts := make([]string, len(routes))
+	for i, route := range routes {
+		outcome := "error"
+		switch {
+		case errors.Is(err[route], core.ErrProviderRateLimited):
+			outcome = "rate_limited"
+		case errors.Is(err[route], core.ErrProviderTimeout):
+			outcome = "timeout"
+		case errors.Is(err[route], core.ErrConcurrencyLimited):
+			outcome = "saturated"
+		}
+		attempts[i] = fmt.Sprintf("%s=%s", route, outcome)
+	}
+	return strings.Join(attempts, ", ")
 }
@@ -0,0 +1,116 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"magicrouter/core"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestToHTTPError(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        error
+		statusCode int
+		code       string
+	}{
+		{
+			name:       "unknown error",
+			err:        errors.New("kaboom"),
+			statusCode: http.StatusInternalServerError,
+		},
+		{
+			name:       "all routes rate limited",
+			err:        fmt.Errorf("wrapped: %w", core.FallbackError{"route1": core.ErrProviderRateLimited, "route2": core.ErrProviderRateLimited}),
+			statusCode: http.StatusTooManyRequests,
+			code:       "rate_limit_exceeded",
+		},
+		{
+			name:       "all routes timed out",
+			err:        core.FallbackError{"route1": core.ErrProviderTimeout},
+			statusCode: http.StatusGatewayTimeout,
+			code:       "upstream_timeout",
+		},
+		{
+			name:       "mixed failures",
+			err:        core.FallbackError{"route1": core.ErrProviderTimeout, "route2": core.ErrProviderRateLimited},
+			statusCode: http.StatusBadGateway,
+			code:       "upstream_error",
+		},
+		{
+			name:       "no route attempted",
+			err:        core.FallbackError{},
+			statusCode: http.StatusServiceUnavailable,
+			code:       "no_route_available",
+		},
+		{
+			name:       "no route meets the minimum quality",
+			err:        fmt.Errorf("%w of 5", core.ErrQualityUnavailable),
+			statusCode: http.StatusBadRequest,
+			code:       "quality_unavailable",
+		},
+		{
+			name:       "invalid structured output",
+			err:        fmt.Errorf("%w: route1: invalid JSON", core.ErrInvalidStructuredOutput),
+			statusCode: http.StatusBadGateway,
+			code:       "invalid_structured_output",
+		},
+		{
+			name:       "unsupported response schema",
+			err:        fmt.Errorf("%w: #: keyword format isn't supported", core.ErrUnsupportedSchema),
+			statusCode: http.StatusBadRequest,
+			code:       "unsupported_schema",
+		},
+		{
+			name:       "project queue full",
+			err:        fmt.Errorf("%w: project:p1 queue is full", core.ErrConcurrencyLimited),
+			statusCode: http.StatusTooManyRequests,
+			code:       "concurrency_limit_exceeded",
+		},
+		{
+			name:       "all routes saturated",
+			err:        core.FallbackError{"route1": core.ErrConcurrencyLimited},
+			statusCode: http.StatusTooManyRequests,
+			code:       "concurrency_limit_exceeded",
+		},
+		{
+			name:       "http error",
+			err:        HTTPError{StatusCode: http.StatusBadRequest, Message: "invalid request body"},
+			statusCode: http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			httpErr := toHTTPError(tt.err)
+			assert.Equal(t, tt.statusCode, httpErr.StatusCode)
+			assert.Equal(t, tt.code, httpErr.Code)
+			assert.NotEmpty(t, httpErr.Type)
+			assert.NotEmpty(t, httpErr.Message)
+		})
+	}
+}
+
+func TestHTTPError_MarshalJSON(t *testing.T) {
+	body, err := json.Marshal(HTTPError{
+		StatusCode: http.StatusBadRequest,
+		Message:    `quotes " are escaped`,
+		Type:       "invalid_request_error",
+		Param:      "messages",
+	})
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"error": {"message": "quotes \" are escaped", "type": "invalid_request_error", "param": "messages", "code": null}}`, string(body))
+}
+
+func TestFormatAttempts(t *testing.T) {
+	err := core.FallbackError{
+		"route2": core.ErrProviderTimeout,
+		"route1": core.ErrProviderRateLimited,
+		"route3": errors.New("kaboom"),
+	}
+	assert.Equal(t, "route1=rate_limited, route2=timeout, route3=error", formatAttempts(err))
+}
@@ -0,0 +1,49 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"magicrouter/core"
+	"magicrouter/webhook"
+)
+
+const defaultGuardrailTimeout = 5 * time.Second
+
+// guardrails returns the guardrail chain of a project.
+func (s *Server) guardrails(cfg *core.ProjectConfig) (*core.GuardrailChain, error) {
+	c := s.compiled(cfg)
+	c.guardrailsOnce.Do(func() {
+		c.guardrails, c.guardrailsErr = s.buildGuardrails(cfg)
+	})
+	return c.guardrails, c.guardrailsErr
+}
+
+func (s *Server) buildGuardrails(cfg *core.ProjectConfig) (*core.GuardrailChain, error) {
+	guardrails := make([]core.NamedGuardrail, 0, len(cfg.Guardrails))
+	for i, gc := range cfg.Guardrails {
+		name := gc.Name
+		if name == "" {
+			name = fmt.Sprintf("%s_%d", gc.Type, i)
+		}
+		var (
+			g   core.Guardrail
+			err error
+		)
+		if gc.Type == core.GuardrailWebhook {
+			timeout := time.Duration(gc.Timeout)
+			if timeout <= 0 {
+				timeout = defaultGuardrailTimeout
+			}
+			g = webhook.NewGuardrail(&http.Client{Timeout: timeout}, gc.URL)
+		} else {
+			g, err = core.NewGuardrail(gc, s.services)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid guardrail %s: %w", name, err)
+		}
+		guardrails = append(guardrails, core.NamedGuardrail{Name: name, Stages: gc.Stages, Guardrail: g})
+	}
+	return core.NewGuardrailChain(cfg.ID, guardrails...), nil
+}
@@ -0,0 +1,82 @@
+package server
+
+import (
+	"expvar"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"magicrouter/core"
+	"magicrouter/metrics"
+	"magicrouter/mocks"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestChatCompletionHandler_Guardrails(t *testing.T) {
+	mockService := mocks.NewChatService(t)
+	s := testServer(&core.ProjectConfig{
+		Guardrails: []core.GuardrailConfig{
+			{Name: "words", Type: core.GuardrailBlocklist, Keywords: []string{"forbidden"}},
+		},
+	}, mockService)
+
+	w := postCompletion(s, `{"model": "gpt-4o", "messages": [{"role": "user", "content": "something forbidden"}]}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.JSONEq(t, `{"error": {
+		"message": "The request was rejected by our content policy: words",
+		"type": "invalid_request_error",
+		"param": null,
+		"code": "content_policy_violation"
+	}}`, w.Body.String())
+}
+
+func TestChatCompletionHandler_GuardrailBillsRejectedOutput(t *testing.T) {
+	mockService := mocks.NewChatService(t)
+	mockService.On("ChatCompletion", mock.Anything, mock.Anything, "gpt-4o", "").
+		Return(&http.Response{
+			StatusCode: http.StatusOK,
+			Body:       io.NopCloser(strings.NewReader(`{"choices": [{"message": {"content": "something forbidden"}}], "usage": {"prompt_tokens": 1234}}`)),
+		}, nil)
+	s := testServer(&core.ProjectConfig{
+		Guardrails: []core.GuardrailConfig{
+			{Name: "words", Type: core.GuardrailBlocklist, Keywords: []string{"forbidden"}, Stages: []core.GuardrailStage{core.GuardrailStageResponse}},
+		},
+	}, mockService)
+	promptTokens := func() int64 {
+		if v, ok := metrics.PromptTokens.Get("project1/route1").(*expvar.Int); ok {
+			return v.Value()
+		}
+		return 0
+	}
+	before := promptTokens()
+
+	w := postCompletion(s, `{"model": "gpt-4o", "messages": []}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, before+1234, promptTokens())
+}
+
+func TestServer_CompiledProjects(t *testing.T) {
+	s := testServer(&core.ProjectConfig{}, mocks.NewChatService(t))
+	config := func(keyword string) *core.ProjectConfig {
+		return &core.ProjectConfig{ID: "project1", Guardrails: []core.GuardrailConfig{
+			{Name: "words", Type: core.GuardrailBlocklist, Keywords: []string{keyword}},
+		}}
+	}
+
+	// Configs loaded again share what was compiled, changed ones replace it.
+	first := s.compiled(config("forbidden"))
+	assert.Same(t, first, s.compiled(config("forbidden")))
+	changed := s.compiled(config("banned"))
+	assert.NotSame(t, first, changed)
+	assert.Same(t, changed, s.compiled(config("banned")))
+
+	entries := 0
+	s.compiledProjects.Range(func(any, any) bool {
+		entries++
+		return true
+	})
+	assert.Equal(t, 1, entries)
+}
@@ -0,0 +1,60 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+func (s *Server) healthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(`{"status":"ok"}`))
+}
+
+// readyz reports whether the server should receive traffic. It fails while
+// shutting down and when any of the readiness checks fails.
+func (s *Server) readyz(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+	defer cancel()
+
+	var (
+		mu     sync.Mutex
+		wg     sync.WaitGroup
+		checks = make(map[string]string, len(s.readinessChecks))
+		ready  = !s.draining.Load()
+	)
+	for name, check := range s.readinessChecks {
+		wg.Add(1)
+		go func(name string, ping func(context.Context) error) {
+			defer wg.Done()
+			status := "ok"
+			if err := ping(ctx); err != nil {
+				// readyz isn't authenticated, errors can name hosts and ports.
+				log.Err(err).Str("check", name).Msg("readiness check failed")
+				status = "unavailable"
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			checks[name] = status
+			ready = ready && status == "ok"
+		}(name, check.Ping)
+	}
+	wg.Wait()
+
+	resp := struct {
+		Status string            `json:"status"`
+		Checks map[string]string `json:"checks"`
+	}{Status: "ok", Checks: checks}
+	statusCode := http.StatusOK
+	if !ready {
+		resp.Status = "unavailable"
+		statusCode = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(resp)
+}
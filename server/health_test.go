@@ -0,0 +1,55 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"magicrouter/inmem"
+	"magicrouter/mocks"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestReadyz(t *testing.T) {
+	get := func(s *Server) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		s.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		return w
+	}
+
+	t.Run("ready", func(t *testing.T) {
+		redis := mocks.NewHealthChecker(t)
+		redis.On("Ping", mock.Anything).Return(nil).Once()
+		s := New(inmem.TokenStore{}, nil, inmem.ProjectStore{}, WithReadinessCheck("redis", redis))
+		w := get(s)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.JSONEq(t, `{"status": "ok", "checks": {"redis": "ok"}}`, w.Body.String())
+	})
+
+	t.Run("check failing", func(t *testing.T) {
+		redis := mocks.NewHealthChecker(t)
+		redis.On("Ping", mock.Anything).Return(errors.New("dial tcp 10.0.0.5:6379: connection refused")).Once()
+		s := New(inmem.TokenStore{}, nil, inmem.ProjectStore{}, WithReadinessCheck("redis", redis))
+		w := get(s)
+		assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+		assert.JSONEq(t, `{"status": "unavailable", "checks": {"redis": "unavailable"}}`, w.Body.String())
+	})
+
+	t.Run("draining", func(t *testing.T) {
+		s := New(inmem.TokenStore{}, nil, inmem.ProjectStore{})
+		s.draining.Store(true)
+		assert.Equal(t, http.StatusServiceUnavailable, get(s).Code)
+	})
+}
+
+func TestDebugVars(t *testing.T) {
+	s := New(inmem.TokenStore{}, nil, inmem.ProjectStore{}, WithAdminToken("admin"))
+
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/admin/v1/debug/vars", nil))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Equal(t, http.StatusOK, adminRequest(s, http.MethodGet, "/admin/v1/debug/vars", "").Code)
+}
@@ -0,0 +1,134 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"magicrouter/core"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	idempotencyKeyHeader  = "Idempotency-Key"
+	idempotentReplyHeader = "Idempotent-Replayed"
+	maxIdempotencyKeyLen  = 255
+	// idempotencyLease is how long a request holds its key, retries take over once it expires.
+	idempotencyLease = 10 * time.Minute
+	// idempotencyPollInterval is how often retries check on a request still in flight.
+	idempotencyPollInterval = 100 * time.Millisecond
+)
+
+// idempotent claims the idempotency key of a request. Retries of a completed request
+// get its response written to w and done is true, retries of one still in flight wait
+// for it. Otherwise the returned writer records the response to store it and finish
+// must be called once the request is over with its error and whether it was billed.
+func (s *Server) idempotent(ctx context.Context, w http.ResponseWriter, key string, body []byte) (rw http.ResponseWriter, finish func(error, bool), done bool, err error) {
+	if len(key) > maxIdempotencyKeyLen {
+		return nil, nil, false, HTTPError{
+			StatusCode: http.StatusBadRequest,
+			Message:    "The Idempotency-Key header must be at most 255 characters long.",
+			Code:       "invalid_idempotency_key",
+			Err:        errors.New("idempotency key too long"),
+		}
+	}
+
+	hash, err := core.RequestHash(body)
+	if err != nil {
+		return nil, nil, false, fmt.Errorf("failed to hash request: %w", err)
+	}
+
+	// The owner token makes sure that only this request stores its outcome, even if its
+	// lease expires and a retry takes the key over.
+	owner, err := newIdempotencyOwner()
+	if err != nil {
+		return nil, nil, false, err
+	}
+
+	ticker := time.NewTicker(idempotencyPollInterval)
+	defer ticker.Stop()
+	for {
+		record, claimed, err := s.idempotency.Begin(ctx, key, hash, owner, idempotencyLease)
+		if err != nil {
+			// Don't block traffic when the idempotency store is unavailable.
+			log.Err(err).Msg("failed to claim idempotency key")
+			return w, func(error, bool) {}, false, nil
+		}
+		if claimed {
+			break
+		}
+		if record.RequestHash != hash {
+			return nil, nil, false, HTTPError{
+				StatusCode: http.StatusConflict,
+				Message:    "Keys for idempotent requests can only be used with the same parameters they were first used with.",
+				Type:       errorType(http.StatusConflict),
+				Code:       "idempotency_key_conflict",
+				Err:        errors.New("idempotency key reused with a different request"),
+			}
+		}
+		if record.Response != nil {
+			w.Header().Set(idempotentReplyHeader, "true")
+			if err := writeCached(w, *record.Response); err != nil {
+				log.Err(err).Msg("failed to write idempotent response")
+			}
+			return w, nil, true, nil
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				return nil, nil, false, HTTPError{
+					StatusCode: http.StatusConflict,
+					Message:    "A request with this idempotency key is still in progress. Please try again later.",
+					Type:       errorType(http.StatusConflict),
+					Code:       "idempotency_key_in_use",
+					Err:        ctx.Err(),
+				}
+			}
+			// The client is gone, there is nothing to respond to.
+			return w, nil, true, nil
+		}
+	}
+
+	rec := &responseRecorder{ResponseWriter: w}
+	return rec, func(reqErr error, billed bool) {
+		ctx := context.WithoutCancel(ctx)
+		var err error
+		switch {
+		case !billed && (reqErr != nil || rec.status == 0 || rec.status >= http.StatusInternalServerError),
+			reqErr == nil && rec.status == 0:
+			// No upstream call completed, let the client retry.
+			err = s.idempotency.Release(ctx, key, owner)
+		case rec.status == 0:
+			// The request failed after it was billed, e.g. because of a guardrail. Retries get
+			// the same error instead of being billed again.
+			resp := errorResponse(reqErr)
+			for k, v := range rec.Header() {
+				if _, ok := resp.Header[k]; !ok && k != costHeader {
+					resp.Header[k] = v
+				}
+			}
+			err = s.idempotency.Finish(ctx, key, owner, core.IdempotencyRecord{RequestHash: hash, Response: &resp}, s.idempotencyTTL)
+		default:
+			resp := rec.response()
+			err = s.idempotency.Finish(ctx, key, owner, core.IdempotencyRecord{RequestHash: hash, Response: &resp}, s.idempotencyTTL)
+		}
+		if err != nil {
+			log.Err(err).Msg("failed to store idempotent response")
+		}
+	}, false, nil
+}
+
+func newIdempotencyOwner() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate idempotency owner: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
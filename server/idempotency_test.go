@@ -0,0 +1,91 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"magicrouter/core"
+	"magicrouter/inmem"
+	"magicrouter/mocks"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestChatCompletionHandler_Idempotency(t *testing.T) {
+	mockService := mocks.NewChatService(t)
+	mockService.On("ChatCompletion", mock.Anything, mock.Anything, "gpt-4o", "").
+		Return(&http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Content-Type": []string{"application/json"}},
+			Body:       io.NopCloser(strings.NewReader(`{"id": "chatcmpl-1"}`)),
+		}, nil).
+		Once()
+	s := testServer(&core.ProjectConfig{}, mockService, WithIdempotency(inmem.NewIdempotencyStore(), 0))
+	body := `{"model": "gpt-4o", "messages": [{"role": "user", "content": "hi"}]}`
+
+	first := postCompletion(s, body, idempotencyKeyHeader, "key1")
+	assert.Equal(t, http.StatusOK, first.Code)
+	assert.JSONEq(t, `{"id": "chatcmpl-1"}`, first.Body.String())
+	assert.Empty(t, first.Header().Get(idempotentReplyHeader))
+
+	retry := postCompletion(s, body, idempotencyKeyHeader, "key1")
+	assert.Equal(t, http.StatusOK, retry.Code)
+	assert.JSONEq(t, `{"id": "chatcmpl-1"}`, retry.Body.String())
+	assert.Equal(t, "true", retry.Header().Get(idempotentReplyHeader))
+	assert.Equal(t, "route1", retry.Header().Get(routeHeader))
+
+	conflict := postCompletion(s, `{"model": "gpt-4o", "messages": []}`, idempotencyKeyHeader, "key1")
+	assert.Equal(t, http.StatusConflict, conflict.Code)
+	assert.Contains(t, conflict.Body.String(), "idempotency_key_conflict")
+}
+
+func TestChatCompletionHandler_IdempotencyRelease(t *testing.T) {
+	mockService := mocks.NewChatService(t)
+	mockService.On("ChatCompletion", mock.Anything, mock.Anything, "gpt-4o", "").
+		Return(nil, core.ErrProviderTimeout).
+		Once()
+	mockService.On("ChatCompletion", mock.Anything, mock.Anything, "gpt-4o", "").
+		Return(&http.Response{
+			StatusCode: http.StatusOK,
+			Body:       io.NopCloser(strings.NewReader(`{"id": "chatcmpl-2"}`)),
+		}, nil).
+		Once()
+	s := testServer(&core.ProjectConfig{}, mockService, WithIdempotency(inmem.NewIdempotencyStore(), 0))
+	body := `{"model": "gpt-4o", "messages": []}`
+
+	failed := postCompletion(s, body, idempotencyKeyHeader, "key1")
+	assert.Equal(t, http.StatusGatewayTimeout, failed.Code)
+
+	// Failed attempts aren't stored, the retry goes upstream.
+	retry := postCompletion(s, body, idempotencyKeyHeader, "key1")
+	assert.Equal(t, http.StatusOK, retry.Code)
+	assert.JSONEq(t, `{"id": "chatcmpl-2"}`, retry.Body.String())
+}
+
+func TestChatCompletionHandler_IdempotencyBilledFailure(t *testing.T) {
+	mockService := mocks.NewChatService(t)
+	mockService.On("ChatCompletion", mock.Anything, mock.Anything, "gpt-4o", "").
+		Return(&http.Response{
+			StatusCode: http.StatusOK,
+			Body:       io.NopCloser(strings.NewReader(`{"choices": [{"message": {"content": "something forbidden"}}]}`)),
+		}, nil).
+		Once()
+	s := testServer(&core.ProjectConfig{
+		Guardrails: []core.GuardrailConfig{
+			{Name: "words", Type: core.GuardrailBlocklist, Keywords: []string{"forbidden"}},
+		},
+	}, mockService, WithIdempotency(inmem.NewIdempotencyStore(), 0))
+	body := `{"model": "gpt-4o", "messages": []}`
+
+	failed := postCompletion(s, body, idempotencyKeyHeader, "key1")
+	assert.Equal(t, http.StatusBadRequest, failed.Code)
+
+	// The rejected completion was paid for, the retry gets the same error instead of going upstream.
+	retry := postCompletion(s, body, idempotencyKeyHeader, "key1")
+	assert.Equal(t, http.StatusBadRequest, retry.Code)
+	assert.Equal(t, "true", retry.Header().Get(idempotentReplyHeader))
+	assert.JSONEq(t, failed.Body.String(), retry.Body.String())
+}
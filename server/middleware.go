@@ -2,6 +2,8 @@ package server
 
 import (
 	"context"
+	"fmt"
+	"io"
 	"net/http"
 	"runtime/debug"
 
@@ -11,10 +13,10 @@ import (
 	"github.com/rs/zerolog"
 )
 
-type projectIDContextKey struct{}
+type tokenContextKey struct{}
 
-func getProjectID(ctx context.Context) string {
-	return ctx.Value(projectIDContextKey{}).(string)
+func getToken(ctx context.Context) *core.Token {
+	return ctx.Value(tokenContextKey{}).(*core.Token)
 }
 
 func resolveToken(resolver core.TokenResolver) func(http.Handler) http.Handler {
@@ -22,20 +24,39 @@ func resolveToken(resolver core.TokenResolver) func(http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			apiToken, err := getBearerToken(r.Header)
 			if err != nil {
-				w.WriteHeader(http.StatusUnauthorized)
+				writeError(w, HTTPError{
+					StatusCode: http.StatusUnauthorized,
+					Message:    "You didn't provide an API key.",
+					Type:       "invalid_request_error",
+				})
 				return
 			}
-			projectID, err := resolver.Resolve(apiToken)
+			token, err := resolver.Resolve(apiToken)
 			if err != nil {
-				w.WriteHeader(http.StatusUnauthorized)
+				writeError(w, HTTPError{
+					StatusCode: http.StatusUnauthorized,
+					Message:    "Incorrect API key provided.",
+					Type:       "invalid_request_error",
+					Code:       "invalid_api_key",
+				})
 				return
 			}
-			ctx := context.WithValue(r.Context(), projectIDContextKey{}, projectID)
+			ctx := context.WithValue(r.Context(), tokenContextKey{}, token)
 			next.ServeHTTP(w, r.WithContext(ctx))
 		})
 	}
 }
 
+// redaction prepares requests for their records to be redacted once their project's
+// PII policy is known, masked records are written to out.
+func redaction(out io.Writer) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(w, r.WithContext(core.WithRedaction(r.Context(), out)))
+		})
+	}
+}
+
 func requestLogger(logger zerolog.Logger) func(next http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		fn := func(w http.ResponseWriter, r *http.Request) {
@@ -43,7 +64,7 @@ func requestLogger(logger zerolog.Logger) func(next http.Handler) http.Handler {
 			defer func() {
 				if r := recover(); r != nil && r != http.ErrAbortHandler {
 					logger.Error().Interface("recover", r).Bytes("stack", debug.Stack()).Msg("incoming_request_panic")
-					ww.WriteHeader(http.StatusInternalServerError)
+					writeError(ww, toHTTPError(fmt.Errorf("panic: %v", r)))
 				}
 				logger.Info().Fields(map[string]interface{}{
 					"remote_addr": r.RemoteAddr,
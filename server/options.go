@@ -0,0 +1,160 @@
+package server
+
+import (
+	"io"
+	"time"
+
+	"magicrouter/core"
+	"magicrouter/webhook"
+)
+
+type Option func(*Server)
+
+// WithBudgets enforces token budgets and records the spend of each request.
+func WithBudgets(budgets *core.BudgetEnforcer) Option {
+	return func(s *Server) {
+		s.budgets = budgets
+	}
+}
+
+// WithPricing sets the catalog used to compute the cost of requests.
+// Routes with a price of their own don't need to be in it.
+func WithPricing(catalog core.PricingCatalog) Option {
+	return func(s *Server) {
+		s.pricing = catalog
+	}
+}
+
+// WithLatencyRouting enables latency aware routing for projects that opt into it.
+func WithLatencyRouting(strategy *core.LatencyStrategy) Option {
+	return func(s *Server) {
+		s.latency = strategy
+	}
+}
+
+// WithShadowing mirrors requests of projects with a shadow route configured.
+func WithShadowing(shadower *core.Shadower) Option {
+	return func(s *Server) {
+		s.shadower = shadower
+	}
+}
+
+// WithDeduplication coalesces identical requests of projects that opt into it.
+func WithDeduplication(store core.FlightStore) Option {
+	return func(s *Server) {
+		s.flights = store
+	}
+}
+
+// WithIdempotency lets clients retry requests safely with an Idempotency-Key header.
+// Responses are kept for ttl, 24h if zero.
+func WithIdempotency(store core.IdempotencyStore, ttl time.Duration) Option {
+	return func(s *Server) {
+		if ttl <= 0 {
+			ttl = 24 * time.Hour
+		}
+		s.idempotency = store
+		s.idempotencyTTL = ttl
+	}
+}
+
+// WithTemplates lets requests reference prompt templates, which are managed through the admin API.
+func WithTemplates(store core.TemplateStore) Option {
+	return func(s *Server) {
+		s.templates = store
+	}
+}
+
+// WithKeyPool rotates between the keys of routes with several keys, which can be
+// disabled through the admin API.
+func WithKeyPool(pool *core.KeyPool) Option {
+	return func(s *Server) {
+		s.keys = pool
+	}
+}
+
+// WithRateLimitTracking records the rate limit headers of providers in store and
+// skips routes and keys that are about to be throttled.
+func WithRateLimitTracking(store core.RateLimitStore) Option {
+	return func(s *Server) {
+		s.rateLimits = core.NewRateLimitTracker(store)
+	}
+}
+
+// WithAsyncJobs serves asynchronous completions from queue, run by the given number of workers.
+// Webhooks are only sent to public addresses.
+func WithAsyncJobs(queue core.JobQueue, workers int) Option {
+	return func(s *Server) {
+		s.jobs = queue
+		s.jobWorkers = workers
+		s.jobBackoff = time.Second
+		s.webhookClient = webhook.NewPublicClient(10 * time.Second)
+	}
+}
+
+// WithAdminToken enables the admin API for requests bearing token.
+func WithAdminToken(token string) Option {
+	return func(s *Server) {
+		s.adminToken = token
+	}
+}
+
+// WithAddr sets the address to listen on. Defaults to ":9200".
+func WithAddr(addr string) Option {
+	return func(s *Server) {
+		s.addr = addr
+	}
+}
+
+// WithTimeouts sets how long to wait for request headers and how long to keep idle connections open.
+func WithTimeouts(readHeader, idle time.Duration) Option {
+	return func(s *Server) {
+		s.readHeaderTimeout = readHeader
+		s.idleTimeout = idle
+	}
+}
+
+// WithRequestTimeout sets the deadline of completions, streams included. Defaults to 10m.
+func WithRequestTimeout(timeout time.Duration) Option {
+	return func(s *Server) {
+		s.requestTimeout = timeout
+	}
+}
+
+// WithShutdownTimeout sets how long to wait for in-flight requests on shutdown. Defaults to 30s.
+func WithShutdownTimeout(timeout time.Duration) Option {
+	return func(s *Server) {
+		s.shutdownTimeout = timeout
+	}
+}
+
+// WithDrainDelay sets how long /readyz reports not ready before shutting down, while
+// requests are still served. Defaults to 5s.
+func WithDrainDelay(delay time.Duration) Option {
+	return func(s *Server) {
+		s.drainDelay = delay
+	}
+}
+
+// WithLogOutput sets where records about requests of projects with a PII policy are
+// written once masked. It should be the output of the global logger, os.Stderr by default.
+func WithLogOutput(w io.Writer) Option {
+	return func(s *Server) {
+		s.logOutput = w
+	}
+}
+
+// WithTLS serves over TLS. The certificate is reloaded whenever the files change.
+func WithTLS(certFile, keyFile string) Option {
+	return func(s *Server) {
+		s.tlsCertFile = certFile
+		s.tlsKeyFile = keyFile
+	}
+}
+
+// WithReadinessCheck adds a dependency that must be reachable for /readyz to succeed.
+func WithReadinessCheck(name string, check core.HealthChecker) Option {
+	return func(s *Server) {
+		s.readinessChecks[name] = check
+	}
+}
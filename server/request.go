@@ -0,0 +1,83 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"magicrouter/core"
+
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+const (
+	minQualityHeader = "X-Magicrouter-Min-Quality"
+	priorityHeader   = "X-Magicrouter-Priority"
+)
+
+// requestPriority is the priority of the token, which the priority header can lower,
+// e.g. for batch jobs, but not raise.
+func requestPriority(r *http.Request, token *core.Token) (int, error) {
+	v := r.Header.Get(priorityHeader)
+	if v == "" {
+		return token.Priority, nil
+	}
+	priority, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, HTTPError{
+			StatusCode: http.StatusBadRequest,
+			Message:    priorityHeader + " must be an integer",
+			Err:        err,
+		}
+	}
+	return min(priority, token.Priority), nil
+}
+
+// minQuality reads the minimum route quality from the header or the metadata.min_quality
+// field of the request. The field is removed from body as providers don't know about it.
+func minQuality(r *http.Request, body []byte) (int, []byte, error) {
+	quality := 0
+	v := r.Header.Get(minQualityHeader)
+	if v != "" {
+		q, err := strconv.Atoi(v)
+		if err != nil {
+			return 0, body, HTTPError{
+				StatusCode: http.StatusBadRequest,
+				Message:    minQualityHeader + " must be an integer",
+				Err:        err,
+			}
+		}
+		quality = q
+	}
+
+	field := gjson.GetBytes(body, "metadata.min_quality")
+	if !field.Exists() {
+		return quality, body, nil
+	}
+	q, err := strconv.Atoi(field.String())
+	if err != nil {
+		return 0, body, HTTPError{
+			StatusCode: http.StatusBadRequest,
+			Message:    "metadata.min_quality must be an integer",
+			Param:      "metadata.min_quality",
+			Err:        err,
+		}
+	}
+	// The header takes precedence, even when it explicitly sets no minimum.
+	if v == "" {
+		quality = q
+	}
+
+	body, err = sjson.DeleteBytes(body, "metadata.min_quality")
+	if err != nil {
+		return 0, body, fmt.Errorf("failed to remove min_quality: %w", err)
+	}
+	if len(gjson.GetBytes(body, "metadata").Map()) == 0 {
+		body, err = sjson.DeleteBytes(body, "metadata")
+		if err != nil {
+			return 0, body, fmt.Errorf("failed to remove metadata: %w", err)
+		}
+	}
+	return quality, body, nil
+}
@@ -0,0 +1,72 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"magicrouter/core"
+	"magicrouter/mocks"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestMinQuality(t *testing.T) {
+	tests := []struct {
+		name    string
+		header  string
+		body    string
+		quality int
+		rest    string
+	}{
+		{"none", "", `{"model": "gpt-4o"}`, 0, `{"model": "gpt-4o"}`},
+		{"metadata", "", `{"metadata": {"min_quality": 2}}`, 2, `{}`},
+		{"header wins", "3", `{"metadata": {"min_quality": 2, "user": "a"}}`, 3, `{"metadata": {"user": "a"}}`},
+		{"explicit zero header wins", "0", `{"metadata": {"min_quality": 2}}`, 0, `{}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+			if tt.header != "" {
+				r.Header.Set(minQualityHeader, tt.header)
+			}
+			quality, body, err := minQuality(r, []byte(tt.body))
+			assert.NoError(t, err)
+			assert.Equal(t, tt.quality, quality)
+			assert.JSONEq(t, tt.rest, string(body))
+		})
+	}
+}
+
+func TestChatCompletionHandler_RequestTimeout(t *testing.T) {
+	mockService := mocks.NewChatService(t)
+	mockService.On("ChatCompletion", mock.Anything, mock.Anything, "gpt-4o", "").
+		Run(func(args mock.Arguments) {
+			// The attempt inherits the deadline of the request.
+			<-args.Get(0).(context.Context).Done()
+		}).
+		Return(nil, core.ErrProviderTimeout).
+		Once()
+	s := testServer(&core.ProjectConfig{}, mockService, WithRequestTimeout(20*time.Millisecond))
+
+	w := postCompletion(s, `{"model": "gpt-4o", "messages": []}`)
+	assert.Equal(t, http.StatusGatewayTimeout, w.Code)
+}
+
+func TestChatCompletionHandler_RedactedLogs(t *testing.T) {
+	mockService := mocks.NewChatService(t)
+	mockService.On("ChatCompletion", mock.Anything, mock.Anything, "gpt-4o", "").
+		Return(nil, errors.New("unexpected reply for jane@example.com")).
+		Once()
+	var out bytes.Buffer
+	s := testServer(&core.ProjectConfig{PII: &core.PIIPolicy{Action: core.PIIMask}}, mockService, WithLogOutput(&out))
+
+	postCompletion(s, `{"model": "gpt-4o", "messages": []}`)
+	assert.Contains(t, out.String(), "unexpected reply for [EMAIL]")
+	assert.NotContains(t, out.String(), "jane@example.com")
+}
@@ -1,19 +1,27 @@
 package server
 
 import (
-	"bufio"
+	"context"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"os"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"magicrouter/core"
+	"magicrouter/webhook"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/rs/zerolog/log"
 	"github.com/sashabaranov/go-openai"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
 )
 
 func getBearerToken(headers http.Header) (string, error) {
@@ -27,32 +35,142 @@ func getBearerToken(headers http.Header) (string, error) {
 	return strings.TrimPrefix(authHeader, "Bearer "), nil
 }
 
-func proxySSE(w http.ResponseWriter, body io.Reader) {
-	w.Header().Set("Content-Type", "text/event-stream")
-	w.WriteHeader(http.StatusOK)
-	flusher := w.(http.Flusher)
-	for scanner := bufio.NewScanner(body); scanner.Scan(); {
-		w.Write(scanner.Bytes())
-		w.Write([]byte("\n"))
-		flusher.Flush()
-	}
-}
-
 type Server struct {
 	tokenResolver core.TokenResolver
 	services      core.ChatServices
 	projectStore  core.ProjectStore
+	budgets       *core.BudgetEnforcer
+	pricing       core.PricingCatalog
+	latency       *core.LatencyStrategy
+	hedges        *core.HedgeLimiter
+	shadower      *core.Shadower
+	flights       core.FlightStore
+	idempotency   core.IdempotencyStore
+	// idempotencyTTL is how long responses are kept for retries with the same idempotency key.
+	idempotencyTTL time.Duration
+	templates      core.TemplateStore
+	keys           *core.KeyPool
+	rateLimits     *core.RateLimitTracker
+	limiters       *core.Limiters
+	jobs           core.JobQueue
+	jobWorkers     int
+	// jobBackoff is the delay before the second attempt of a job, it doubles with every attempt.
+	jobBackoff    time.Duration
+	webhookClient webhook.HTTPClient
+	jobsRunning   sync.WaitGroup
+	// compiledProjects caches a *compiledProject per project ID.
+	compiledProjects sync.Map
+	// adminToken authenticates admin API requests, the admin API is disabled when empty.
+	adminToken string
+
+	addr              string
+	readHeaderTimeout time.Duration
+	idleTimeout       time.Duration
+	shutdownTimeout   time.Duration
+	requestTimeout    time.Duration
+	drainDelay        time.Duration
+	tlsCertFile       string
+	tlsKeyFile        string
+	logOutput         io.Writer
+	readinessChecks   map[string]core.HealthChecker
+	draining          atomic.Bool
+}
+
+func New(tokenStore core.TokenResolver, services core.ChatServices, projectStore core.ProjectStore, opts ...Option) *Server {
+	s := &Server{
+		tokenResolver:     tokenStore,
+		services:          services,
+		projectStore:      projectStore,
+		addr:              ":9200",
+		readHeaderTimeout: 10 * time.Second,
+		idleTimeout:       120 * time.Second,
+		shutdownTimeout:   30 * time.Second,
+		requestTimeout:    10 * time.Minute,
+		drainDelay:        5 * time.Second,
+		logOutput:         os.Stderr,
+		readinessChecks:   make(map[string]core.HealthChecker),
+		hedges:            core.NewHedgeLimiter(),
+		limiters:          core.NewLimiters(),
+	}
+	// Stores that can be pinged are checked for readiness without further configuration.
+	if hc, ok := tokenStore.(core.HealthChecker); ok {
+		s.readinessChecks["token_store"] = hc
+	}
+	if hc, ok := projectStore.(core.HealthChecker); ok {
+		s.readinessChecks["project_store"] = hc
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+func (s *Server) checkBudget(ctx context.Context, token *core.Token) error {
+	if s.budgets == nil {
+		return nil
+	}
+	err := s.budgets.Check(ctx, token)
+	if errors.Is(err, core.ErrBudgetExceeded) {
+		return HTTPError{
+			StatusCode: http.StatusTooManyRequests,
+			Message:    "You exceeded your current quota: " + err.Error(),
+			Type:       "insufficient_quota",
+			Code:       "insufficient_quota",
+			Err:        err,
+		}
+	}
+	if err != nil {
+		// Don't block traffic when the budget store is unavailable.
+		log.Err(err).Msg("failed to check budget")
+	}
+	return nil
 }
 
-func New(tokenStore core.TokenResolver, services core.ChatServices, projectStore core.ProjectStore) *Server {
-	return &Server{
-		tokenResolver: tokenStore,
-		services:      services,
-		projectStore:  projectStore,
+// routingContext makes the routes of projectID share the limiters, keys and rate limits of the server.
+func (s *Server) routingContext(ctx context.Context, projectID string) context.Context {
+	ctx = core.WithProject(ctx, projectID)
+	ctx = core.WithLimiters(ctx, s.limiters)
+	if s.keys != nil {
+		ctx = core.WithKeyPool(ctx, s.keys)
+	}
+	if s.rateLimits != nil {
+		ctx = core.WithRateLimits(ctx, s.rateLimits)
 	}
+	return ctx
 }
 
-func (s *Server) ChatCompletionHandler(w http.ResponseWriter, r *http.Request) error {
+func (s *Server) fallbackOptions(cfg *core.ProjectConfig, model core.VirtualModel, body []byte) []core.FallbackOption {
+	opts := []core.FallbackOption{
+		core.WithCapabilities(core.RequiredCapabilities(body)),
+	}
+	if cfg.StreamFailover {
+		opts = append(opts, core.WithStreamFailover())
+	}
+	if cfg.StructuredOutput != nil {
+		opts = append(opts, core.WithStructuredOutput(*cfg.StructuredOutput))
+	}
+	if hedge := cfg.Hedging; hedge != nil {
+		opts = append(opts, core.WithHedging(*hedge, func() bool {
+			return s.hedges.Allow(cfg.ID, hedge.MaxPerMinute)
+		}))
+	}
+	switch model.Routing {
+	case core.RoutingLatency:
+		if s.latency != nil {
+			opts = append(opts, core.WithStrategy(s.latency.ForProject(cfg.ID)))
+		}
+	case core.RoutingCost:
+		opts = append(opts, core.WithStrategy(core.NewCostStrategy(s.pricing)))
+	}
+	return opts
+}
+
+func (s *Server) ChatCompletionHandler(w http.ResponseWriter, r *http.Request) (err error) {
+	start := time.Now()
+	// Queueing and every attempt count against the deadline of the request.
+	ctx, cancel := context.WithTimeout(r.Context(), s.requestTimeout)
+	defer cancel()
+	r = r.WithContext(ctx)
 	// We need to read the body twice, so let's keep it in a slice.
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
@@ -70,32 +188,238 @@ func (s *Server) ChatCompletionHandler(w http.ResponseWriter, r *http.Request) e
 		}
 	}
 
+	quality, body, err := minQuality(r, body)
+	if err != nil {
+		return err
+	}
+	ctx = core.WithMinQuality(ctx, quality)
+	token := getToken(r.Context())
+	priority, err := requestPriority(r, token)
+	if err != nil {
+		return err
+	}
+	ctx = s.routingContext(core.WithPriority(ctx, priority), token.ProjectID)
+
+	// billed is set once an upstream call completed, the request can't be retried for free anymore.
+	var billed bool
+	// Retries with the same idempotency key get the response of the first attempt.
+	if key := r.Header.Get(idempotencyKeyHeader); key != "" && s.idempotency != nil {
+		var (
+			finish func(error, bool)
+			done   bool
+		)
+		w, finish, done, err = s.idempotent(ctx, w, token.ProjectID+":"+key, body)
+		if err != nil || done {
+			return err
+		}
+		defer func() { finish(err, billed) }()
+	}
+
+	// Requests can reference a prompt template instead of sending all the messages.
+	body, tmpl, err := s.renderTemplate(ctx, token.ProjectID, body)
+	if err != nil {
+		return err
+	}
+	if tmpl != nil {
+		w.Header().Set(templateHeader, formatTemplate(tmpl))
+	}
+
+	// Ask for usage in the last chunk of streams so that they can be accounted for.
+	includeUsage := gjson.GetBytes(body, "stream_options.include_usage").Bool()
+	if req.Stream && !includeUsage {
+		body, err = sjson.SetBytes(body, "stream_options.include_usage", true)
+		if err != nil {
+			return fmt.Errorf("failed to set stream options: %w", err)
+		}
+	}
+
+	if err := s.checkBudget(r.Context(), token); err != nil {
+		return err
+	}
+
 	// Get project config which contains fallback configuration
-	projectID := getProjectID(r.Context())
-	cfg, err := s.projectStore.GetConfig(projectID)
+	cfg, err := s.projectStore.GetConfig(token.ProjectID)
 	if err != nil {
 		return fmt.Errorf("failed to get project config: %w", err)
 	}
 
+	// Waiting for a slot counts against the deadline of the request.
+	if cfg.Concurrency != nil {
+		release, err := s.limiters.Get("project:"+cfg.ID, *cfg.Concurrency).Acquire(ctx)
+		if err != nil {
+			return err
+		}
+		defer release()
+	}
+
+	if cfg.Transform != nil {
+		body, err = cfg.Transform.Apply(body)
+		if err != nil {
+			return fmt.Errorf("failed to transform request: %w", err)
+		}
+	}
+
+	// Keep personal data from leaving the network, tokenized data is restored in the response.
+	var vault *core.PIIVault
+	if cfg.PII != nil {
+		redactor, err := s.redactor(cfg)
+		if err != nil {
+			return fmt.Errorf("invalid pii policy: %w", err)
+		}
+		body, vault, err = redactor.Redact(body)
+		if errors.Is(err, core.ErrPIIDetected) {
+			return HTTPError{
+				StatusCode: http.StatusBadRequest,
+				Message:    "The request was blocked because it contains personal data.",
+				Param:      "messages",
+				Code:       "pii_detected",
+				Err:        err,
+			}
+		}
+		if err != nil {
+			return err
+		}
+		ctx = core.WithRedactor(ctx, redactor)
+	}
+
+	guardrails, err := s.guardrails(cfg)
+	if err != nil {
+		return err
+	}
+	if err := guardrails.CheckRequest(ctx, body); err != nil {
+		return err
+	}
+
 	// Send request to provider
-	service := core.NewFallbackChatService(cfg.Routes, s.services, core.NoOpBreaker{})
-	response, err := service.ChatCompletion(r.Context(), json.RawMessage(body))
+	model := cfg.Model(req.Model)
+	if experiment, ok := cfg.Experiment(req.Model); ok {
+		key := req.User
+		if experiment.StickyHeader != "" && r.Header.Get(experiment.StickyHeader) != "" {
+			key = r.Header.Get(experiment.StickyHeader)
+		}
+		variant := experiment.Assign(key)
+		model = variant.VirtualModel
+		assignment := experiment.ID + "/" + variant.Name
+		w.Header().Set(variantHeader, assignment)
+		ctx = context.WithValue(ctx, variantContextKey{}, assignment)
+		log.Info().
+			Str("project_id", cfg.ID).
+			Str("experiment", experiment.ID).
+			Str("variant", variant.Name).
+			Msg("experiment_assignment")
+	}
+	// Identical requests in flight share one upstream call. Streams aren't shared.
+	if cfg.Dedup != nil && s.flights != nil && !req.Stream {
+		var (
+			finish func(error)
+			done   bool
+		)
+		w, finish, done, err = s.coalesce(ctx, w, cfg, body, includeUsage)
+		if err != nil || done {
+			return err
+		}
+		defer func() { finish(err) }()
+	}
+
+	// Mirror to the shadow route, which is compared with the primary once it's done.
+	var primary core.ShadowResult
+	if cfg.Shadow != nil && s.shadower != nil {
+		if shadow := s.shadower.Mirror(ctx, cfg.ID, *cfg.Shadow, body); shadow != nil {
+			defer func() {
+				primary.LatencyMS = time.Since(start).Milliseconds()
+				if err != nil {
+					primary.Error = err.Error()
+				}
+				shadow.Finish(primary)
+			}()
+		}
+	}
+
+	// Responses discarded along the way, e.g. invalid structured outputs, are billed too.
+	var discarded float64
+	ctx = core.WithUsageRecorder(ctx, func(route core.Route, usage core.Usage) {
+		billed = true
+		discarded += s.recordUsage(ctx, token, route, usage)
+	})
+	service := core.NewFallbackChatService(model.Routes, s.services, core.NoOpBreaker{}, s.fallbackOptions(cfg, model, body)...)
+	response, err := service.ChatCompletion(ctx, json.RawMessage(body))
 	if err != nil {
 		return fmt.Errorf("service request failed: %w", err)
 	}
-	defer io.Copy(io.Discard, response.Body)
+	billed = billed || response.StatusCode/100 == 2 || len(response.BrokenSegments()) > 0
+	// Closing the body aborts the upstream request if the client went away mid-stream.
 	defer response.Body.Close()
+	// Guardrails see the output before personal data is restored.
+	if err := guardrails.CheckCompletion(ctx, body, response.Response); err != nil {
+		s.recordRejectedUsage(ctx, token, response)
+		return err
+	}
+	if vault != nil {
+		if err := vault.RestoreResponse(response.Response); err != nil {
+			return err
+		}
+	}
+	primary.RouteID = response.Route.ID
+	primary.Model = response.Route.Model
+	primary.StatusCode = response.StatusCode
 
 	// Proxy provider response
-	if response.Header.Get("Content-Type") == "text/event-stream" {
-		proxySSE(w, response.Body)
-		return nil
+	w.Header().Set(routeHeader, response.Route.ID)
+	if strings.HasPrefix(response.Header.Get("Content-Type"), "text/event-stream") {
+		// The cost and the route that finished the stream are only known once it is done,
+		// so they are sent as trailers.
+		w.Header().Set("Trailer", costHeader+", "+finalRouteHeader)
+		var (
+			usage  *core.Usage
+			output strings.Builder
+		)
+		err := proxySSE(w, response.Response, func(data []byte) bool {
+			output.WriteString(gjson.GetBytes(data, "choices.0.delta.content").String())
+			u, ok := core.ParseUsage(data)
+			if !ok {
+				return true
+			}
+			usage = &u
+			// Drop the usage-only chunk we asked for if the client didn't.
+			return includeUsage || gjson.GetBytes(data, "choices.#").Int() > 0
+		})
+		primary.Output = output.String()
+		// Routes that broke midway are billed for the output they produced, even if the stream failed.
+		var cost float64
+		segments := response.BrokenSegments()
+		for _, segment := range segments {
+			cost += s.recordUsage(ctx, token, segment.Route, segment.Usage)
+		}
+		final := response.FinalRoute()
+		primary.RouteID, primary.Model = final.ID, final.Model
+		w.Header().Set(finalRouteHeader, final.ID)
+		if usage != nil {
+			cost += s.recordUsage(ctx, token, final, *usage)
+			primary.Usage = *usage
+		}
+		if usage != nil || len(segments) > 0 {
+			w.Header().Set(costHeader, formatCost(cost))
+			primary.Cost = cost
+		}
+		return err
 	}
 
+	respBody, err := io.ReadAll(response.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read response body: %w", err)
+	}
+	if usage, ok := core.ParseUsage(respBody); ok && response.StatusCode == http.StatusOK {
+		cost := discarded + s.recordUsage(ctx, token, response.Route, usage)
+		w.Header().Set(costHeader, formatCost(cost))
+		primary.Usage, primary.Cost = usage, cost
+	} else if discarded > 0 {
+		w.Header().Set(costHeader, formatCost(discarded))
+	}
+	primary.Output = core.CompletionText(respBody)
 	w.WriteHeader(response.StatusCode)
-	_, err = io.Copy(w, response.Body)
+	_, err = w.Write(respBody)
 	if err != nil {
-		return fmt.Errorf("failed to copy response body: %w", err)
+		return fmt.Errorf("failed to write response body: %w", err)
 	}
 	return nil
 }
@@ -104,28 +428,103 @@ func handleError(fn func(http.ResponseWriter, *http.Request) error) func(http.Re
 	return func(w http.ResponseWriter, r *http.Request) {
 		err := fn(w, r)
 		if err == nil {
-			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
-		log.Error().Err(err).Msg("request failed")
-		httpErr, ok := err.(HTTPError)
-		if ok {
-			w.WriteHeader(httpErr.StatusCode)
-			if httpErr.Message != "" {
-				json.NewEncoder(w).Encode(httpErr)
-			}
+		// Errors can quote the request, they are redacted like it once its project is known.
+		core.Logger(r.Context()).Error().Err(err).Msg("request failed")
+		if errors.As(err, &streamError{}) {
+			// The response has already started, the client was told in-stream.
 			return
 		}
+		resp := errorResponse(err)
+		for k, v := range resp.Header {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(resp.StatusCode)
+		w.Write(resp.Body)
 	}
 }
 
-func (s *Server) ListenAndServe() error {
+// Handler returns the HTTP handler serving the API and health endpoints.
+func (s *Server) Handler() http.Handler {
 	r := chi.NewRouter()
-	r.Use(requestLogger(log.Logger))
+	r.Get("/healthz", s.healthz)
+	r.Get("/readyz", s.readyz)
 	r.Group(func(r chi.Router) {
-		r.Use(resolveToken(s.tokenResolver))
-		r.Post("/v1/chat/completions", handleError(s.ChatCompletionHandler))
+		r.Use(requestLogger(log.Logger))
+		r.Use(redaction(s.logOutput))
+		r.Group(func(r chi.Router) {
+			r.Use(resolveToken(s.tokenResolver))
+			r.Post("/v1/chat/completions", handleError(s.ChatCompletionHandler))
+			if s.jobs != nil {
+				r.Post("/v1/async/chat/completions", handleError(s.enqueueJobHandler))
+				r.Get("/v1/async/jobs/{jobID}", handleError(s.getJobHandler))
+			}
+		})
+		if s.adminToken != "" {
+			r.Route("/admin/v1", s.adminRoutes)
+		}
 	})
+	return r
+}
 
-	return http.ListenAndServe(":9200", r)
+// ListenAndServe serves until ctx is cancelled and then shuts down gracefully,
+// waiting up to the shutdown timeout for in-flight requests and streams to finish.
+func (s *Server) ListenAndServe(ctx context.Context) error {
+	srv := &http.Server{
+		Addr:              s.addr,
+		Handler:           s.Handler(),
+		ReadHeaderTimeout: s.readHeaderTimeout,
+		IdleTimeout:       s.idleTimeout,
+		// Streams can run for minutes, so there is deliberately no write timeout.
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		var err error
+		if s.tlsCertFile != "" {
+			var certs *certReloader
+			certs, err = newCertReloader(s.tlsCertFile, s.tlsKeyFile)
+			if err != nil {
+				errCh <- err
+				return
+			}
+			srv.TLSConfig = &tls.Config{GetCertificate: certs.GetCertificate}
+			err = srv.ListenAndServeTLS("", "")
+		} else {
+			err = srv.ListenAndServe()
+		}
+		errCh <- err
+	}()
+	log.Info().Str("addr", s.addr).Bool("tls", s.tlsCertFile != "").Msg("server started")
+	s.startJobWorkers(ctx)
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+	}
+
+	// Keep serving while load balancers notice /readyz failing and stop sending traffic.
+	s.draining.Store(true)
+	log.Info().Dur("delay", s.drainDelay).Msg("draining")
+	time.Sleep(s.drainDelay)
+
+	log.Info().Dur("timeout", s.shutdownTimeout).Msg("shutting down")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), s.shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		srv.Close()
+		return fmt.Errorf("failed to shutdown gracefully: %w", err)
+	}
+	if err := s.waitJobs(shutdownCtx); err != nil {
+		return fmt.Errorf("failed to shutdown gracefully: %w", err)
+	}
+	// Requests and jobs that crossed a budget threshold may still be sending alerts.
+	if s.budgets != nil {
+		if err := s.budgets.Wait(shutdownCtx); err != nil {
+			return fmt.Errorf("failed to send budget alerts: %w", err)
+		}
+	}
+	return nil
 }
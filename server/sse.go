@@ -0,0 +1,94 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"magicrouter/sse"
+)
+
+// streamError is a failure after a stream has started, when it's too late for an error response.
+type streamError struct {
+	error
+}
+
+func (e streamError) Unwrap() error {
+	return e.error
+}
+
+// sseWriter writes events to the client, flushing each one when the writer supports it.
+type sseWriter struct {
+	w  http.ResponseWriter
+	rc *http.ResponseController
+}
+
+func newSSEWriter(w http.ResponseWriter) *sseWriter {
+	return &sseWriter{w: w, rc: http.NewResponseController(w)}
+}
+
+func (s *sseWriter) WriteEvent(ev sse.Event) error {
+	if err := sse.WriteEvent(s.w, ev); err != nil {
+		return err
+	}
+	if err := s.rc.Flush(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		return err
+	}
+	return nil
+}
+
+// proxySSE copies the event stream of resp to w with the upstream status code.
+// Events whose data keep returns false for are dropped. When the stream fails
+// midway, e.g. upstream broke or ended without [DONE] or a guardrail cut it off,
+// the client is sent an error event. The returned error is a streamError.
+func proxySSE(w http.ResponseWriter, resp *http.Response, keep func(data []byte) bool) error {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(resp.StatusCode)
+
+	writer := newSSEWriter(w)
+	events := sse.NewReader(resp.Body)
+	done := false
+	for {
+		ev, err := events.Next()
+		if err == io.EOF {
+			if done {
+				return nil
+			}
+			// Upstream closed the connection between events.
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			streamErr := fmt.Errorf("stream failed: %w", err)
+			httpErr := toHTTPError(streamErr)
+			if httpErr.StatusCode >= http.StatusInternalServerError {
+				httpErr = HTTPError{
+					StatusCode: http.StatusBadGateway,
+					Message:    "The upstream stream was interrupted.",
+					Type:       errorType(http.StatusBadGateway),
+					Code:       "stream_interrupted",
+					Err:        streamErr,
+				}
+			}
+			writer.WriteEvent(errorEvent(httpErr))
+			return streamError{streamErr}
+		}
+		done = bytes.Equal(ev.Data, sse.Done)
+		if !done && !keep(ev.Data) {
+			continue
+		}
+		if err := writer.WriteEvent(ev); err != nil {
+			// The client went away, returning closes the upstream body which aborts it.
+			return streamError{fmt.Errorf("failed to write event: %w", err)}
+		}
+	}
+}
+
+// errorEvent renders err the way OpenAI reports errors in streams.
+func errorEvent(err HTTPError) sse.Event {
+	data, _ := json.Marshal(err)
+	return sse.Event{Data: data}
+}
@@ -0,0 +1,117 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func eventStream(status int, body io.Reader) *http.Response {
+	return &http.Response{
+		StatusCode: status,
+		Header:     http.Header{"Content-Type": []string{"text/event-stream"}},
+		Body:       io.NopCloser(body),
+	}
+}
+
+func keepAll([]byte) bool { return true }
+
+func TestProxySSE(t *testing.T) {
+	large := strings.Repeat("a", 1<<20)
+	upstream := ": keep-alive\n\n" +
+		"data: {\"n\":1}\n\n" +
+		"data: line1\ndata: line2\n\n" +
+		"data: " + large + "\n\n" +
+		"data: [DONE]\n\n"
+
+	w := httptest.NewRecorder()
+	err := proxySSE(w, eventStream(http.StatusOK, strings.NewReader(upstream)), keepAll)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "text/event-stream", w.Header().Get("Content-Type"))
+	assert.True(t, w.Flushed)
+	assert.Equal(t, "data: {\"n\":1}\n\n"+
+		"data: line1\ndata: line2\n\n"+
+		"data: "+large+"\n\n"+
+		"data: [DONE]\n\n", w.Body.String())
+}
+
+func TestProxySSE_Filter(t *testing.T) {
+	upstream := "data: keep\n\ndata: drop\n\ndata: [DONE]\n\n"
+	w := httptest.NewRecorder()
+	err := proxySSE(w, eventStream(http.StatusOK, strings.NewReader(upstream)), func(data []byte) bool {
+		return string(data) != "drop"
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "data: keep\n\ndata: [DONE]\n\n", w.Body.String())
+}
+
+func TestProxySSE_UpstreamStatus(t *testing.T) {
+	w := httptest.NewRecorder()
+	err := proxySSE(w, eventStream(http.StatusAccepted, strings.NewReader("data: x\n\ndata: [DONE]\n\n")), keepAll)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusAccepted, w.Code)
+}
+
+// plainWriter is a ResponseWriter that can't be flushed.
+type plainWriter struct {
+	header http.Header
+	body   strings.Builder
+	err    error
+}
+
+func (w *plainWriter) Header() http.Header { return w.header }
+func (w *plainWriter) WriteHeader(int)     {}
+func (w *plainWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	return w.body.Write(p)
+}
+
+func TestProxySSE_NoFlusher(t *testing.T) {
+	w := &plainWriter{header: http.Header{}}
+	err := proxySSE(w, eventStream(http.StatusOK, strings.NewReader("data: x\n\ndata: [DONE]\n\n")), keepAll)
+	assert.NoError(t, err)
+	assert.Equal(t, "data: x\n\ndata: [DONE]\n\n", w.body.String())
+}
+
+func TestProxySSE_ClientGone(t *testing.T) {
+	w := &plainWriter{header: http.Header{}, err: errors.New("broken pipe")}
+	err := proxySSE(w, eventStream(http.StatusOK, strings.NewReader("data: x\n\n")), keepAll)
+	assert.ErrorAs(t, err, &streamError{})
+}
+
+type failingReader struct {
+	data string
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	if r.data == "" {
+		return 0, errors.New("connection reset")
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func TestProxySSE_UpstreamError(t *testing.T) {
+	w := httptest.NewRecorder()
+	err := proxySSE(w, eventStream(http.StatusOK, &failingReader{data: "data: x\n\n"}), keepAll)
+	assert.ErrorAs(t, err, &streamError{})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "data: x\n\n")
+	assert.Contains(t, w.Body.String(), `"code":"stream_interrupted"`)
+}
+
+func TestProxySSE_EndWithoutDone(t *testing.T) {
+	w := httptest.NewRecorder()
+	err := proxySSE(w, eventStream(http.StatusOK, strings.NewReader("data: x\n\n")), keepAll)
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	assert.Contains(t, w.Body.String(), `"code":"stream_interrupted"`)
+}
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"magicrouter/core"
+
+	"github.com/rs/zerolog/log"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+// templateHeader tells clients which template version their request was rendered from.
+const templateHeader = "X-Magicrouter-Template"
+
+// templateRef is the template field clients send instead of, or before, their messages.
+type templateRef struct {
+	ID string `json:"id"`
+	// Version pins a version, the active one is used if zero.
+	Version   int               `json:"version"`
+	Variables map[string]string `json:"variables"`
+}
+
+// renderTemplate replaces the template field of body with the rendered messages,
+// followed by the messages of the request if any. It returns the version used.
+func (s *Server) renderTemplate(ctx context.Context, projectID string, body []byte) ([]byte, *core.PromptTemplate, error) {
+	field := gjson.GetBytes(body, "template")
+	if !field.Exists() {
+		return body, nil, nil
+	}
+	if s.templates == nil {
+		return nil, nil, HTTPError{
+			StatusCode: http.StatusBadRequest,
+			Message:    "Prompt templates are not enabled.",
+			Param:      "template",
+		}
+	}
+	var ref templateRef
+	if err := json.Unmarshal([]byte(field.Raw), &ref); err != nil || ref.ID == "" {
+		return nil, nil, HTTPError{
+			StatusCode: http.StatusBadRequest,
+			Message:    "template must be an object with an id, an optional version and string variables",
+			Param:      "template",
+			Err:        err,
+		}
+	}
+
+	tmpl, err := s.templates.GetTemplate(ctx, projectID, ref.ID, ref.Version)
+	if errors.Is(err, core.ErrTemplateNotFound) {
+		message := fmt.Sprintf("The template %s does not exist.", ref.ID)
+		if ref.Version != 0 {
+			message = fmt.Sprintf("The template %s does not have a version %d.", ref.ID, ref.Version)
+		}
+		return nil, nil, HTTPError{
+			StatusCode: http.StatusNotFound,
+			Message:    message,
+			Param:      "template",
+			Code:       "template_not_found",
+			Err:        err,
+		}
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get template: %w", err)
+	}
+	rendered, err := tmpl.Render(ref.Variables)
+	if errors.Is(err, core.ErrTemplateVariableMissing) {
+		return nil, nil, HTTPError{
+			StatusCode: http.StatusBadRequest,
+			Message:    err.Error(),
+			Param:      "template.variables",
+			Code:       "template_variable_missing",
+			Err:        err,
+		}
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	messages := make([]any, 0, len(rendered))
+	for _, msg := range rendered {
+		messages = append(messages, msg)
+	}
+	for _, msg := range gjson.GetBytes(body, "messages").Array() {
+		messages = append(messages, json.RawMessage(msg.Raw))
+	}
+	body, err = sjson.SetBytes(body, "messages", messages)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to set messages: %w", err)
+	}
+	body, err = sjson.DeleteBytes(body, "template")
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to remove template: %w", err)
+	}
+	log.Info().
+		Str("project_id", projectID).
+		Str("template", tmpl.ID).
+		Int("template_version", tmpl.Version).
+		Msg("template_rendered")
+	return body, tmpl, nil
+}
+
+func formatTemplate(tmpl *core.PromptTemplate) string {
+	return tmpl.ID + "@" + strconv.Itoa(tmpl.Version)
+}
@@ -0,0 +1,91 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"magicrouter/core"
+	"magicrouter/inmem"
+	"magicrouter/mocks"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/tidwall/gjson"
+)
+
+func adminRequest(s *Server, method, path, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	r.Header.Set("Authorization", "Bearer admin")
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, r)
+	return w
+}
+
+func TestChatCompletionHandler_Templates(t *testing.T) {
+	mockService := mocks.NewChatService(t)
+	s := testServer(&core.ProjectConfig{}, mockService, WithTemplates(inmem.NewTemplateStore()), WithAdminToken("admin"))
+	path := "/admin/v1/projects/project1/templates/greeting"
+
+	w := adminRequest(s, http.MethodPost, path+"/versions", `{"messages": [{"role": "system", "content": "Greet {{name}}."}]}`)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	w = adminRequest(s, http.MethodPost, path+"/versions", `{"messages": [{"role": "system", "content": "Greet {{name}} warmly."}]}`)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.Equal(t, int64(2), gjson.Get(w.Body.String(), "version").Int())
+
+	rendered := func(content string) any {
+		return mock.MatchedBy(func(req json.RawMessage) bool {
+			return !gjson.GetBytes(req, "template").Exists() &&
+				gjson.GetBytes(req, "messages.0.content").String() == content &&
+				gjson.GetBytes(req, "messages.1.content").String() == "Hi"
+		})
+	}
+	mockService.On("ChatCompletion", mock.Anything, rendered("Greet Jo."), "gpt-4o", "").
+		Return(&http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(`{"choices": []}`))}, nil).Once()
+	mockService.On("ChatCompletion", mock.Anything, rendered("Greet Jo warmly."), "gpt-4o", "").
+		Return(&http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(`{"choices": []}`))}, nil).Once()
+
+	t.Run("new versions aren't active until promoted", func(t *testing.T) {
+		w := postCompletion(s, `{"model": "gpt-4o", "template": {"id": "greeting", "variables": {"name": "Jo"}}, "messages": [{"role": "user", "content": "Hi"}]}`)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "greeting@1", w.Header().Get(templateHeader))
+	})
+
+	t.Run("promoted version is used", func(t *testing.T) {
+		w := adminRequest(s, http.MethodPut, path+"/active", `{"version": 2}`)
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		w = postCompletion(s, `{"model": "gpt-4o", "template": {"id": "greeting", "variables": {"name": "Jo"}}, "messages": [{"role": "user", "content": "Hi"}]}`)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "greeting@2", w.Header().Get(templateHeader))
+	})
+
+	t.Run("lists versions", func(t *testing.T) {
+		w := adminRequest(s, http.MethodGet, path+"/", "")
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, int64(2), gjson.Get(w.Body.String(), "active_version").Int())
+		assert.Equal(t, int64(2), gjson.Get(w.Body.String(), "versions.#").Int())
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		w := postCompletion(s, `{"model": "gpt-4o", "template": {"id": "greeting", "version": 3, "variables": {"name": "Jo"}}}`)
+		assert.Equal(t, http.StatusNotFound, w.Code)
+		assert.Equal(t, "template_not_found", gjson.Get(w.Body.String(), "error.code").String())
+
+		w = postCompletion(s, `{"model": "gpt-4o", "template": {"id": "greeting"}}`)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.Equal(t, "template_variable_missing", gjson.Get(w.Body.String(), "error.code").String())
+
+		w = adminRequest(s, http.MethodPut, path+"/active", `{"version": 5}`)
+		assert.Equal(t, http.StatusNotFound, w.Code)
+
+		r := httptest.NewRequest(http.MethodGet, path+"/", nil)
+		r.Header.Set("Authorization", "Bearer test")
+		rec := httptest.NewRecorder()
+		s.Handler().ServeHTTP(rec, r)
+		assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	})
+}
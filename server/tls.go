@@ -0,0 +1,78 @@
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// certCheckInterval is how often the certificate files are checked for changes.
+const certCheckInterval = 10 * time.Second
+
+// certReloader serves a certificate from disk and reloads it when either file changes,
+// so renewed certificates are picked up without a restart.
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+	// checked is when the files were last checked, handshakes in between use the cached certificate.
+	checked time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	c := &certReloader{certFile: certFile, keyFile: keyFile}
+	if _, err := c.GetCertificate(nil); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.cert != nil && time.Since(c.checked) < certCheckInterval {
+		return c.cert, nil
+	}
+	c.checked = time.Now()
+	modTime, err := c.latestModTime()
+	if err != nil && c.cert == nil {
+		return nil, err
+	}
+	if c.cert != nil && (err != nil || !modTime.After(c.modTime)) {
+		return c.cert, nil
+	}
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		if c.cert != nil {
+			// Keep serving the old certificate, the files may be mid-rotation.
+			log.Err(err).Msg("failed to reload tls certificate")
+			return c.cert, nil
+		}
+		return nil, fmt.Errorf("failed to load tls certificate: %w", err)
+	}
+	c.cert = &cert
+	c.modTime = modTime
+	return c.cert, nil
+}
+
+func (c *certReloader) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, file := range []string{c.certFile, c.keyFile} {
+		info, err := os.Stat(file)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("failed to stat %s: %w", file, err)
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
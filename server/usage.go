@@ -0,0 +1,82 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strconv"
+
+	"magicrouter/core"
+	"magicrouter/metrics"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	routeHeader = "X-Magicrouter-Route"
+	// finalRouteHeader is the trailer naming the route that finished a stream, which
+	// differs from routeHeader when the stream failed over.
+	finalRouteHeader = "X-Magicrouter-Final-Route"
+	costHeader       = "X-Magicrouter-Cost"
+	variantHeader    = "X-Magicrouter-Variant"
+)
+
+// variantContextKey holds the experiment variant ("experiment/variant") a request was assigned to.
+type variantContextKey struct{}
+
+func formatCost(cost float64) string {
+	return strconv.FormatFloat(cost, 'f', -1, 64)
+}
+
+// recordUsage computes the cost of a completed request and feeds it into logs, metrics and budgets.
+func (s *Server) recordUsage(ctx context.Context, token *core.Token, route core.Route, usage core.Usage) float64 {
+	cost, ok := s.pricing.Cost(route, usage)
+	// Running without a catalog is reported once at startup.
+	if !ok && s.pricing != nil {
+		log.Warn().Str("provider", route.Provider).Str("model", route.Model).Msg("no price for route")
+	}
+
+	key := token.ProjectID + "/" + route.ID
+	metrics.Requests.Add(key, 1)
+	metrics.Cost.AddFloat(key, cost)
+	metrics.PromptTokens.Add(key, int64(usage.PromptTokens))
+	metrics.CompletionTokens.Add(key, int64(usage.CompletionTokens))
+
+	variant, _ := ctx.Value(variantContextKey{}).(string)
+	log.Info().
+		Str("project_id", token.ProjectID).
+		Str("token_id", token.ID).
+		Str("route_id", route.ID).
+		Str("provider", route.Provider).
+		Str("model", route.Model).
+		Int("prompt_tokens", usage.PromptTokens).
+		Int("cached_tokens", usage.PromptTokensDetails.CachedTokens).
+		Int("completion_tokens", usage.CompletionTokens).
+		Float64("cost", cost).
+		Str("variant", variant).
+		Msg("completion_usage")
+
+	if s.budgets != nil {
+		// The client may already be gone, the spend must be recorded regardless.
+		err := s.budgets.Record(context.WithoutCancel(ctx), token, cost)
+		if err != nil {
+			log.Err(err).Msg("failed to record spend")
+		}
+	}
+	return cost
+}
+
+// recordRejectedUsage bills a completion that was paid for upstream but not returned,
+// e.g. because a guardrail rejected it. Streams are billed as they are proxied.
+func (s *Server) recordRejectedUsage(ctx context.Context, token *core.Token, completion *core.Completion) {
+	if completion.StatusCode != http.StatusOK {
+		return
+	}
+	body, err := io.ReadAll(completion.Body)
+	if err != nil {
+		return
+	}
+	if usage, ok := core.ParseUsage(body); ok {
+		s.recordUsage(ctx, token, completion.Route, usage)
+	}
+}
@@ -0,0 +1,90 @@
+// Package sse reads and writes server-sent events as used by streaming chat completions.
+package sse
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+)
+
+// Done is the data of the event OpenAI ends streams with.
+var Done = []byte("[DONE]")
+
+type Event struct {
+	ID    string
+	Event string
+	// Data is the data of the event, multiple data lines are joined with "\n".
+	Data []byte
+}
+
+// Reader reads events from a stream. Lines can be of any length.
+type Reader struct {
+	r *bufio.Reader
+}
+
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: bufio.NewReader(r)}
+}
+
+// Next returns the next event. It returns io.EOF when the stream ended cleanly between events
+// and io.ErrUnexpectedEOF when it ended in the middle of one.
+func (r *Reader) Next() (Event, error) {
+	var (
+		ev      Event
+		data    [][]byte
+		started bool
+	)
+	for {
+		line, err := r.r.ReadBytes('\n')
+		if err != nil && (err != io.EOF || len(line) == 0) {
+			if err == io.EOF && started {
+				return ev, io.ErrUnexpectedEOF
+			}
+			return ev, err
+		}
+		line = bytes.TrimRight(line, "\r\n")
+
+		if len(line) == 0 {
+			if !started {
+				continue
+			}
+			ev.Data = bytes.Join(data, []byte("\n"))
+			return ev, nil
+		}
+		if line[0] == ':' {
+			// Comments are used as keep-alives.
+			continue
+		}
+		started = true
+		field, value, _ := bytes.Cut(line, []byte(":"))
+		value = bytes.TrimPrefix(value, []byte(" "))
+		switch string(field) {
+		case "data":
+			data = append(data, bytes.Clone(value))
+		case "event":
+			ev.Event = string(value)
+		case "id":
+			ev.ID = string(value)
+		}
+	}
+}
+
+// WriteEvent encodes ev to w.
+func WriteEvent(w io.Writer, ev Event) error {
+	var buf bytes.Buffer
+	if ev.ID != "" {
+		fmt.Fprintf(&buf, "id: %s\n", ev.ID)
+	}
+	if ev.Event != "" {
+		fmt.Fprintf(&buf, "event: %s\n", ev.Event)
+	}
+	for _, line := range bytes.Split(ev.Data, []byte("\n")) {
+		buf.WriteString("data: ")
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	buf.WriteByte('\n')
+	_, err := w.Write(buf.Bytes())
+	return err
+}
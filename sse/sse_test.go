@@ -0,0 +1,47 @@
+package sse
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReader(t *testing.T) {
+	large := strings.Repeat("x", 1<<20)
+	stream := ": keep-alive\n\n" +
+		"data: {\"a\": 1}\n\n" +
+		"event: error\r\nid: 7\r\ndata: line 1\r\ndata: line 2\r\n\r\n" +
+		"data: " + large + "\n\n" +
+		"data:no-space\n\n"
+	r := NewReader(strings.NewReader(stream))
+
+	for _, want := range []Event{
+		{Data: []byte(`{"a": 1}`)},
+		{ID: "7", Event: "error", Data: []byte("line 1\nline 2")},
+		{Data: []byte(large)},
+		{Data: []byte("no-space")},
+	} {
+		ev, err := r.Next()
+		assert.NoError(t, err)
+		assert.Equal(t, want, ev)
+	}
+	_, err := r.Next()
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestReader_Truncated(t *testing.T) {
+	r := NewReader(strings.NewReader("data: {\"a\": 1}\n\ndata: {\"b\""))
+	_, err := r.Next()
+	assert.NoError(t, err)
+	_, err = r.Next()
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+}
+
+func TestWriteEvent(t *testing.T) {
+	var buf bytes.Buffer
+	WriteEvent(&buf, Event{Event: "error", Data: []byte("line 1\nline 2")})
+	assert.Equal(t, "event: error\ndata: line 1\ndata: line 2\n\n", buf.String())
+}
@@ -0,0 +1,49 @@
+package webhook
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"syscall"
+	"time"
+)
+
+// ErrPrivateAddress is returned when connecting to an address that isn't publicly routable.
+var ErrPrivateAddress = errors.New("address is not public")
+
+// sharedAddressSpace is used for carrier-grade NAT (RFC 6598).
+var sharedAddressSpace = netip.MustParsePrefix("100.64.0.0/10")
+
+// NewPublicClient returns an HTTP client that only connects to public addresses, so that
+// webhook URLs chosen by clients can't reach the router's own network, such as cloud
+// metadata endpoints. Addresses are checked once resolved, which covers redirects and
+// hosts resolving to private addresses.
+func NewPublicClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: timeout,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			addrPort, err := netip.ParseAddrPort(address)
+			if err != nil {
+				return fmt.Errorf("invalid address %s: %w", address, err)
+			}
+			if !IsPublic(addrPort.Addr()) {
+				return fmt.Errorf("%w: %s", ErrPrivateAddress, addrPort.Addr())
+			}
+			return nil
+		},
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// The proxy would be checked instead of the webhook.
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return &http.Client{Timeout: timeout, Transport: transport}
+}
+
+// IsPublic reports whether addr is publicly routable. Loopback, private, link-local,
+// e.g. 169.254.169.254, and shared addresses aren't.
+func IsPublic(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	return addr.IsGlobalUnicast() && !addr.IsPrivate() && !sharedAddressSpace.Contains(addr)
+}
@@ -0,0 +1,42 @@
+package webhook
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsPublic(t *testing.T) {
+	for addr, public := range map[string]bool{
+		"93.184.215.14":        true,
+		"2606:4700::1111":      true,
+		"127.0.0.1":            false,
+		"::1":                  false,
+		"10.1.2.3":             false,
+		"172.16.0.1":           false,
+		"192.168.1.1":          false,
+		"169.254.169.254":      false,
+		"100.64.0.1":           false,
+		"0.0.0.0":              false,
+		"::ffff:10.0.0.1":      false,
+		"fd00:ec2::254":        false,
+		"fe80::1":              false,
+		"224.0.0.1":            false,
+		"255.255.255.255":      false,
+		"::ffff:93.184.215.14": true,
+	} {
+		assert.Equal(t, public, IsPublic(netip.MustParseAddr(addr)), addr)
+	}
+}
+
+func TestNewPublicClient(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	_, err := NewPublicClient(time.Second).Get(srv.URL)
+	assert.ErrorIs(t, err, ErrPrivateAddress)
+}
@@ -0,0 +1,166 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"magicrouter/core"
+)
+
+type HTTPClient interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+// Event is the payload posted to webhook endpoints.
+type Event struct {
+	Type      string    `json:"type"`
+	Timestamp time.Time `json:"timestamp"`
+	Data      any       `json:"data"`
+}
+
+// SignatureHeader holds the signature of events sent by clients with a secret,
+// formatted as "t=<unix timestamp>,v1=<hex signature>".
+const SignatureHeader = "X-Magicrouter-Signature"
+
+// Sign returns the HMAC-SHA256 of the timestamp and body, which receivers recompute
+// with the shared secret to authenticate events. Signing the timestamp lets them reject replays.
+func Sign(secret string, timestamp time.Time, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp.Unix(), 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Client posts events to a single webhook endpoint.
+type Client struct {
+	client HTTPClient
+	url    string
+	// secret signs events, they are not signed when empty.
+	secret string
+}
+
+func New(client HTTPClient, url string) *Client {
+	return &Client{
+		client: client,
+		url:    url,
+	}
+}
+
+// NewSigned returns a client signing events with secret, see SignatureHeader.
+func NewSigned(client HTTPClient, url, secret string) *Client {
+	return &Client{
+		client: client,
+		url:    url,
+		secret: secret,
+	}
+}
+
+func (c *Client) Send(ctx context.Context, eventType string, data any) error {
+	now := time.Now().UTC()
+	body, err := json.Marshal(Event{
+		Type:      eventType,
+		Timestamp: now,
+		Data:      data,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal event: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.secret != "" {
+		req.Header.Set(SignatureHeader, fmt.Sprintf("t=%d,v1=%s", now.Unix(), Sign(c.secret, now, body)))
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook responded with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Alert implements core.BudgetAlerter.
+func (c *Client) Alert(ctx context.Context, alert core.BudgetAlert) error {
+	return c.Send(ctx, "budget."+string(alert.Kind), alert)
+}
+
+// GuardrailCheck is the payload posted to policy services acting as guardrail.
+type GuardrailCheck struct {
+	Stage   core.GuardrailStage `json:"stage"`
+	Request json.RawMessage     `json:"request"`
+	Output  string              `json:"output,omitempty"`
+}
+
+// GuardrailVerdict is the response expected from policy services.
+type GuardrailVerdict struct {
+	Allowed bool   `json:"allowed"`
+	Reason  string `json:"reason"`
+}
+
+// Guardrail asks a policy service whether requests and responses are allowed.
+// It implements core.Guardrail.
+type Guardrail struct {
+	client HTTPClient
+	url    string
+}
+
+func NewGuardrail(client HTTPClient, url string) *Guardrail {
+	return &Guardrail{
+		client: client,
+		url:    url,
+	}
+}
+
+func (g *Guardrail) CheckRequest(ctx context.Context, req json.RawMessage) error {
+	return g.check(ctx, GuardrailCheck{Stage: core.GuardrailStageRequest, Request: req})
+}
+
+func (g *Guardrail) CheckResponse(ctx context.Context, req json.RawMessage, output string) error {
+	return g.check(ctx, GuardrailCheck{Stage: core.GuardrailStageResponse, Request: req, Output: output})
+}
+
+func (g *Guardrail) check(ctx context.Context, check GuardrailCheck) error {
+	body, err := json.Marshal(check)
+	if err != nil {
+		return fmt.Errorf("failed to marshal guardrail check: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, g.url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("guardrail responded with status %d", resp.StatusCode)
+	}
+	var verdict GuardrailVerdict
+	if err := json.NewDecoder(resp.Body).Decode(&verdict); err != nil {
+		return fmt.Errorf("failed to decode verdict: %w", err)
+	}
+	if !verdict.Allowed {
+		return &core.GuardrailViolation{Reason: verdict.Reason}
+	}
+	return nil
+}